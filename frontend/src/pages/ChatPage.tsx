@@ -62,6 +62,13 @@ const MessageContent = styled.p`
   padding: 0px;
 `;
 
+const TypingIndicator = styled.div`
+  min-height: 18px;
+  padding: 0 12px;
+  font-size: 12px;
+  color: #888;
+`;
+
 const InputArea = styled.div`
   display: flex;
   padding: 12px;
@@ -140,19 +147,106 @@ type ChatPageProps = {
 };
 
 type ServerMessage = {
-  tokenString: string;
+  id: string;
+  room_id: string;
+  user_id: string;
   username: string;
   content: string;
+  created_at: string;
+};
+
+// Every frame is wrapped in a versioned envelope
+const PROTOCOL_VERSION = 1;
+
+// Every frame counts against the server's per-connection rate limit, so read
+// receipts are batched and typing.start is sent no more often than the server
+// fans it out (typingInterval)
+const READ_RECEIPT_DELAY_MS = 1000;
+const TYPING_INTERVAL_MS = 2000;
+
+type Envelope = {
+  v: number;
+  type: string;
+  id: string;
+  ts: string;
+  payload: any;
+};
+
+// Reads the user id from the JWT payload (no verification, display only)
+const getTokenUserId = (token: string | null): string | null => {
+  if (!token) return null;
+
+  try {
+    const payload = token.split(".")[1].replace(/-/g, "+").replace(/_/g, "/");
+    return JSON.parse(atob(payload)).id ?? null;
+  } catch {
+    return null;
+  }
 };
 
 const ChatPage: React.FC<ChatPageProps> = ({ token, setToken }) => {
   const [messages, setMessages] = useState<ServerMessage[]>([]);
   const [input, setInput] = useState("");
+  const [typingUsers, setTypingUsers] = useState<Record<string, string>>({});
   const ws = useRef<WebSocket | null>(null);
+  const pendingRead = useRef<string | null>(null);
+  const readTimer = useRef<number | null>(null);
+  const lastTypingStart = useRef(0);
   const navigate = useNavigate();
+  const userId = getTokenUserId(token);
+
+  const sendFrame = (type: string, payload: unknown) => {
+    // The frame id lets the server drop retried sends
+    ws.current?.send(
+      JSON.stringify({
+        v: PROTOCOL_VERSION,
+        type,
+        id: crypto.randomUUID(),
+        ts: new Date().toISOString(),
+        payload,
+      })
+    );
+  };
+
+  // Only the latest message is reported read, once per READ_RECEIPT_DELAY_MS
+  const markRead = (messageId: string) => {
+    pendingRead.current = messageId;
+
+    if (readTimer.current !== null) return;
+
+    readTimer.current = window.setTimeout(() => {
+      readTimer.current = null;
+
+      if (pendingRead.current) {
+        sendFrame("read", { message_id: pendingRead.current });
+        pendingRead.current = null;
+      }
+    }, READ_RECEIPT_DELAY_MS);
+  };
+
+  const signalTyping = (typing: boolean) => {
+    if (!typing) {
+      if (lastTypingStart.current) {
+        sendFrame("typing.stop", {});
+        lastTypingStart.current = 0;
+      }
+      return;
+    }
+
+    // The server expires indicators, so repeated starts only keep it alive
+    const now = Date.now();
+
+    if (now - lastTypingStart.current >= TYPING_INTERVAL_MS) {
+      sendFrame("typing.start", {});
+      lastTypingStart.current = now;
+    }
+  };
 
   useEffect(() => {
-    ws.current = new WebSocket("ws://localhost:8000/chat/ws");
+    if (!token) return;
+
+    // Browsers cannot set headers on the handshake, so the token goes in the subprotocol
+    ws.current = new WebSocket("ws://localhost:8000/chat/ws", ["bearer", token]);
 
     // Set binary type for media chunks
     ws.current.binaryType = "arraybuffer";
@@ -160,8 +254,37 @@ const ChatPage: React.FC<ChatPageProps> = ({ token, setToken }) => {
     ws.current.onmessage = (event) => {
       // Check if it's JSON (chat)
       if (typeof event.data === "string") {
-        const data = JSON.parse(event.data) as ServerMessage;
-        setMessages((prev) => [...prev, data]);
+        const data = JSON.parse(event.data) as Envelope;
+
+        switch (data.type) {
+          case "chat.message":
+            setMessages((prev) => [...prev, data.payload as ServerMessage]);
+            // The chat is on screen, so anything received is read
+            if (data.payload.user_id !== userId) {
+              markRead(data.payload.id);
+            }
+            break;
+          case "typing.start":
+            setTypingUsers((prev) => ({ ...prev, [data.payload.user_id]: data.payload.username }));
+            break;
+          case "typing.stop":
+            setTypingUsers((prev) => {
+              const { [data.payload.user_id]: _, ...rest } = prev;
+              return rest;
+            });
+            break;
+          case "message.edited":
+            setMessages((prev) =>
+              prev.map((m) => (m.id === data.payload.id ? { ...m, content: data.payload.content } : m))
+            );
+            break;
+          case "message.deleted":
+            setMessages((prev) => prev.filter((m) => m.id !== data.payload.id));
+            break;
+          case "error":
+            console.warn("⚠️ Chat error", data.payload);
+            break;
+        }
       }
     };
 
@@ -174,23 +297,38 @@ const ChatPage: React.FC<ChatPageProps> = ({ token, setToken }) => {
     };
 
     return () => {
+      if (readTimer.current !== null) {
+        window.clearTimeout(readTimer.current);
+        readTimer.current = null;
+      }
       ws.current?.close();
     };
-  }, []);
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, [token]);
 
   const sendMessage = () => {
     if (ws.current && input.trim()) {
-      const message = {
-        tokenString: token,
-        content: input,
-      };
-      ws.current.send(JSON.stringify(message));
+      sendFrame("chat.send", { content: input });
       setInput("");
+      // Sending stops the indicator on the server
+      lastTypingStart.current = 0;
     }
   };
 
   const handleLogout = () => {
+    const refreshToken = localStorage.getItem("refreshToken");
+
+    if (refreshToken) {
+      // Revokes the session server-side, which also closes our WebSocket
+      fetch("http://localhost:8000/users/logout", {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify({ refresh_token: refreshToken }),
+      }).catch((err) => console.error(err));
+    }
+
     localStorage.removeItem("token");
+    localStorage.removeItem("refreshToken");
     setToken(null);
     navigate("/login", { replace: true });
   };
@@ -207,20 +345,28 @@ const ChatPage: React.FC<ChatPageProps> = ({ token, setToken }) => {
         </TopBar>
 
         <Messages>
-          {messages.map((msg, idx) => (
+          {messages.map((msg) => (
             <MessageItem
-              key={idx}
-              isSelf={msg.tokenString === token}
+              key={msg.id}
+              isSelf={msg.user_id === userId}
               username={msg.username}
               content={msg.content}
             />
           ))}
         </Messages>
 
+        <TypingIndicator>
+          {Object.keys(typingUsers).length > 0 &&
+            `${Object.values(typingUsers).join(", ")} typing...`}
+        </TypingIndicator>
+
         <InputArea>
           <Input
             value={input}
-            onChange={(e) => setInput(e.target.value)}
+            onChange={(e) => {
+              setInput(e.target.value);
+              signalTyping(e.target.value !== "");
+            }}
             placeholder="Type a message..."
             onKeyDown={(e) => e.key === "Enter" && sendMessage()}
           />
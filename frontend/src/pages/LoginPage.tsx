@@ -52,10 +52,11 @@ const LoginPage: React.FC<LoginPageProps> = ({ setToken }) => {
       }
 
       const data = await res.json();
-      localStorage.setItem("token", data.data);
+      localStorage.setItem("token", data.data.access_token);
+      localStorage.setItem("refreshToken", data.data.refresh_token);
 
       // Update App state
-      setToken(data.data);
+      setToken(data.data.access_token);
 
       navigate("/chat", { replace: true });
     } catch (err) {
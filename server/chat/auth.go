@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// Browsers cannot set headers on a WebSocket handshake, so the token may also
+// be offered as a subprotocol pair: new WebSocket(url, ["bearer", token]).
+const bearerSubprotocol = "bearer"
+
+// Clients that support neither exchange their access token for a ticket and
+// connect with ?ticket=<ticket>. Tickets are single use and expire quickly,
+// so a URL that ends up in a request log cannot be replayed.
+const wsTicketTTL = 30 * time.Second
+
+// authenticateUpgrade validates the credentials of a WebSocket handshake. It
+// looks at the Authorization header, then Sec-WebSocket-Protocol, then the
+// "ticket" query param, and returns the subprotocol to echo back, if any.
+// Access tokens are never read from the URL.
+func authenticateUpgrade(s *ChatService, r *http.Request) (*utils.AuthorizedUserInfo, string, error) {
+	tokenString, subprotocol := upgradeTokenString(r)
+
+	var claims *utils.AuthorizedUserInfo
+
+	if tokenString != "" {
+		validated, err := s.KeySet.ValidateTokenString(tokenString)
+
+		if err != nil {
+			return nil, "", utils.Unauthorized("invalid_token", err.Error())
+		}
+
+		claims = validated
+	} else if ticket := r.URL.Query().Get("ticket"); ticket != "" {
+		redeemed, err := s.redeemWsTicket(ticket)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		claims = redeemed
+	} else {
+		return nil, "", ErrMissingToken
+	}
+
+	revoked, err := s.Sessions.IsSessionRevoked(claims.SessionID)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if revoked {
+		return nil, "", ErrSessionRevoked
+	}
+
+	return claims, subprotocol, nil
+}
+
+func upgradeTokenString(r *http.Request) (string, string) {
+	if tokenString := utils.BearerToken(r); tokenString != "" {
+		return tokenString, ""
+	}
+
+	protocols := websocket.Subprotocols(r)
+
+	for i, protocol := range protocols {
+		if protocol == bearerSubprotocol && i + 1 < len(protocols) {
+			return protocols[i + 1], bearerSubprotocol
+		}
+	}
+
+	return "", ""
+}
+
+// issueWsTicket creates a ticket for the user of an authenticated request.
+func (s *ChatService) issueWsTicket(user *utils.AuthorizedUserInfo) (*WsTicket, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	ticket := base64.RawURLEncoding.EncodeToString(b)
+
+	if err := s.ChatRepository.insertWsTicket(hashWsTicket(ticket), user, time.Now().Add(wsTicketTTL)); err != nil {
+		return nil, err
+	}
+
+	return &WsTicket{Ticket: ticket, ExpiresIn: int(wsTicketTTL.Seconds())}, nil
+}
+
+func (s *ChatService) redeemWsTicket(ticket string) (*utils.AuthorizedUserInfo, error) {
+	return s.ChatRepository.consumeWsTicket(hashWsTicket(ticket))
+}
+
+// Tickets are random like refresh tokens, so a plain SHA-256 is enough.
+func hashWsTicket(ticket string) string {
+	sum := sha256.Sum256([]byte(ticket))
+	return hex.EncodeToString(sum[:])
+}
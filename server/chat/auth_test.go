@@ -0,0 +1,255 @@
+package chat
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/nambuitechx/nam-chilling-room-server/configs"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+var testUserInfo = utils.AuthorizedUserInfo{
+	ID: "22222222-2222-2222-2222-222222222222",
+	Username: "alice",
+	SessionID: "33333333-3333-3333-3333-333333333333",
+	Role: utils.RoleUser,
+}
+
+// signTestToken signs an access token for testUserInfo with role.
+func signTestToken(t *testing.T, keySet *utils.KeySet, role string) string {
+	t.Helper()
+
+	claims := testUserInfo
+	claims.Role = role
+	claims.RegisteredClaims = jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}
+	token, err := keySet.SignToken(&claims)
+
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return token
+}
+
+// newAuthTestServer serves the full chat router over a fake database that
+// knows the test room and keeps issued tickets in memory. Tests may script
+// more statements on the returned database.
+func newAuthTestServer(t *testing.T) (*httptest.Server, *utils.KeySet, *fakeDB) {
+	t.Helper()
+
+	keySet, err := utils.NewKeySet(&configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "test", JWTSecret: "secret"})
+
+	if err != nil {
+		t.Fatalf("failed to create key set: %v", err)
+	}
+
+	db := newFakeDB(t)
+
+	onRoom(db, testRoomID)
+
+	db.on(`SELECT EXISTS`, func(args []driver.Value) fakeResult {
+		return row([]string{"exists"}, false)
+	})
+
+	var mu sync.Mutex
+	tickets := map[string][]driver.Value{}
+
+	db.on(`INSERT INTO ws_tickets`, func(args []driver.Value) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+
+		tickets[args[0].(string)] = args[1:5]
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`DELETE FROM ws_tickets WHERE ticket_hash`, func(args []driver.Value) fakeResult {
+		mu.Lock()
+		defer mu.Unlock()
+
+		user, ok := tickets[args[0].(string)]
+
+		if !ok {
+			return fakeResult{}
+		}
+
+		delete(tickets, args[0].(string))
+		return row([]string{"user_id", "username", "session_id", "role"}, user...)
+	})
+
+	service := NewChatService(NewChatRepository(db.db), keySet, nopSessions{}, Config{SlowConsumerPolicy: PolicyDisconnect, EditWindow: time.Minute})
+	server := httptest.NewServer(NewChatRouter(service, NewMemoryBroker()))
+
+	t.Cleanup(func() {
+		server.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		if err := service.Shutdown(ctx); err != nil {
+			t.Errorf("failed to shut down: %v", err)
+		}
+	})
+
+	return server, keySet, db
+}
+
+func createTicket(t *testing.T, server *httptest.Server, token string) string {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL + "/ws-tickets", nil)
+	req.Header.Set("Authorization", "Bearer " + token)
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatalf("failed to create ticket: %v", err)
+	}
+
+	defer resp.Body.Close()
+
+	var body struct {
+		Data	WsTicket	`json:"data"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Data.Ticket == "" {
+		t.Fatalf("unexpected ticket response %d: %v", resp.StatusCode, err)
+	}
+
+	return body.Data.Ticket
+}
+
+func TestUpgradeTransports(t *testing.T) {
+	server, keySet, _ := newAuthTestServer(t)
+	token := signTestToken(t, keySet, utils.RoleUser)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room=" + testRoomID
+
+	tests := []struct {
+		name			string
+		dial			func() (*websocket.Conn, *http.Response, error)
+		subprotocol		string
+	}{
+		{
+			name: "authorization header",
+			dial: func() (*websocket.Conn, *http.Response, error) {
+				return websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+			},
+		},
+		{
+			name: "bearer subprotocol",
+			dial: func() (*websocket.Conn, *http.Response, error) {
+				dialer := websocket.Dialer{Subprotocols: []string{bearerSubprotocol, token}}
+				return dialer.Dial(wsURL, nil)
+			},
+			subprotocol: bearerSubprotocol,
+		},
+		{
+			name: "ticket param",
+			dial: func() (*websocket.Conn, *http.Response, error) {
+				return websocket.DefaultDialer.Dial(wsURL + "&ticket=" + createTicket(t, server, token), nil)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, resp, err := tt.dial()
+
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			defer conn.Close()
+
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+			}
+
+			if conn.Subprotocol() != tt.subprotocol {
+				t.Errorf("got subprotocol %q, want %q", conn.Subprotocol(), tt.subprotocol)
+			}
+		})
+	}
+}
+
+func TestUpgradeRejectsBadCredentials(t *testing.T) {
+	server, keySet, _ := newAuthTestServer(t)
+	token := signTestToken(t, keySet, utils.RoleUser)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?room=" + testRoomID
+
+	used := createTicket(t, server, token)
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL + "&ticket=" + used, nil)
+
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	conn.Close()
+
+	tests := []struct {
+		name	string
+		url		string
+		header	http.Header
+	}{
+		{name: "no credentials", url: wsURL},
+		{name: "access token in url", url: wsURL + "&token=" + token + "&access_token=" + token},
+		{name: "invalid token", url: wsURL, header: http.Header{"Authorization": {"Bearer invalid"}}},
+		{name: "unknown ticket", url: wsURL + "&ticket=unknown"},
+		{name: "reused ticket", url: wsURL + "&ticket=" + used},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, resp, err := websocket.DefaultDialer.Dial(tt.url, tt.header)
+
+			if err == nil {
+				conn.Close()
+				t.Fatal("handshake succeeded, want it rejected")
+			}
+
+			if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("got response %v, want status %d", resp, http.StatusUnauthorized)
+			}
+		})
+	}
+}
+
+func TestMetricsRequireAdmin(t *testing.T) {
+	server, keySet, _ := newAuthTestServer(t)
+
+	tests := []struct {
+		role		string
+		wantStatus	int
+	}{
+		{role: utils.RoleUser, wantStatus: http.StatusForbidden},
+		{role: utils.RoleModerator, wantStatus: http.StatusForbidden},
+		{role: utils.RoleAdmin, wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.role, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, server.URL + "/metrics", nil)
+			req.Header.Set("Authorization", "Bearer " + signTestToken(t, keySet, tt.role))
+
+			resp, err := http.DefaultClient.Do(req)
+
+			if err != nil {
+				t.Fatalf("failed to get metrics: %v", err)
+			}
+
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package chat
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Broker fans events out to every server instance so a room split across
+// replicas behaves like one hub. Publish must not block the caller: hubs call
+// it from their run loop. Subscribers are called from the broker's own
+// goroutine, including for events published by this instance.
+type Broker interface {
+	Publish(topic string, payload []byte) error
+	Subscribe(topic string, handler func(payload []byte)) (unsubscribe func())
+	Close() error
+}
+
+// subscriptions is the topic registry shared by the broker implementations.
+type subscriptions struct {
+	mu			sync.Mutex
+	nextID		int
+	handlers	map[string]map[int]func([]byte)
+}
+
+func (s *subscriptions) Subscribe(topic string, handler func(payload []byte)) func() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.handlers == nil {
+		s.handlers = make(map[string]map[int]func([]byte))
+	}
+
+	if s.handlers[topic] == nil {
+		s.handlers[topic] = make(map[int]func([]byte))
+	}
+
+	id := s.nextID
+	s.nextID++
+	s.handlers[topic][id] = handler
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		delete(s.handlers[topic], id)
+
+		if len(s.handlers[topic]) == 0 {
+			delete(s.handlers, topic)
+		}
+	}
+}
+
+// dispatch calls the handlers of topic outside the lock, so handlers may
+// subscribe or unsubscribe.
+func (s *subscriptions) dispatch(topic string, payload []byte) {
+	s.mu.Lock()
+	handlers := make([]func([]byte), 0, len(s.handlers[topic]))
+
+	for _, handler := range s.handlers[topic] {
+		handlers = append(handlers, handler)
+	}
+
+	s.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(payload)
+	}
+}
+
+type published struct {
+	topic	string
+	payload	[]byte
+}
+
+// MemoryBroker delivers events within the process. It is the default for a
+// single instance and lets several hub managers share a room in one process.
+type MemoryBroker struct {
+	subscriptions
+
+	mu		sync.Mutex
+	queue	[]published
+	closed	bool
+	wake	chan struct{}
+	stopped	chan struct{}
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	b := &MemoryBroker{
+		wake: make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+
+	go b.run()
+
+	return b
+}
+
+// Publish queues the event without bounds so it never blocks a hub.
+func (b *MemoryBroker) Publish(topic string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return ErrBrokerClosed
+	}
+
+	b.queue = append(b.queue, published{topic: topic, payload: payload})
+
+	select {
+		case b.wake <- struct{}{}:
+		default:
+	}
+
+	return nil
+}
+
+func (b *MemoryBroker) run() {
+	defer close(b.stopped)
+
+	for range b.wake {
+		b.mu.Lock()
+		queue := b.queue
+		b.queue = nil
+		closed := b.closed
+		b.mu.Unlock()
+
+		for _, event := range queue {
+			b.dispatch(event.topic, event.payload)
+		}
+
+		if closed {
+			return
+		}
+	}
+}
+
+// Close delivers what is queued and stops the broker.
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	b.mu.Unlock()
+
+	select {
+		case b.wake <- struct{}{}:
+		default:
+	}
+
+	<-b.stopped
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// Every instance listens on one channel; topics travel in the payload
+	postgresBrokerChannel	= "chat_events"
+
+	// NOTIFY payloads must be shorter than 8000 bytes
+	postgresMaxPayload		= 7999
+
+	postgresOutgoingSize	= 1024
+
+	// Larger events are stored in chat_broker_events for every instance to
+	// read, and deleted once that is surely done
+	postgresEventRetention	= 5 * time.Minute
+	postgresSweepInterval	= time.Minute
+)
+
+var ErrBrokerBacklog = errors.New("broker backlog full")
+
+// postgresNotification is the NOTIFY payload. Ref replaces Topic and Payload
+// for events stored in chat_broker_events.
+type postgresNotification struct {
+	Topic	string			`json:"topic,omitempty"`
+	Payload	json.RawMessage	`json:"payload,omitempty"`
+	Ref		int64			`json:"ref,omitempty"`
+}
+
+// PostgresBroker fans events out across instances with LISTEN/NOTIFY.
+// Notifications are sent through the shared *sql.DB and received on a
+// dedicated listener connection that reconnects on its own. Events too large
+// for NOTIFY go through the chat_broker_events table.
+type PostgresBroker struct {
+	subscriptions
+
+	db			*sql.DB
+	listener	*pq.Listener
+	outgoing	chan []byte
+
+	closeOnce	sync.Once
+	done		chan struct{}
+	workers		sync.WaitGroup
+}
+
+func NewPostgresBroker(db *sql.DB, dataSourceName string) (*PostgresBroker, error) {
+	listener := pq.NewListener(dataSourceName, 10 * time.Millisecond, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("chat broker listener: %v", err)
+		}
+	})
+
+	if err := listener.Listen(postgresBrokerChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	b := &PostgresBroker{
+		db: db,
+		listener: listener,
+		outgoing: make(chan []byte, postgresOutgoingSize),
+		done: make(chan struct{}),
+	}
+
+	b.workers.Add(2)
+	go b.receive()
+	go b.send()
+
+	return b, nil
+}
+
+// Publish queues the event for the sender goroutine. Events are dropped with
+// an error when the queue is full rather than blocking a hub on the database.
+func (b *PostgresBroker) Publish(topic string, payload []byte) error {
+	data, err := json.Marshal(postgresNotification{Topic: topic, Payload: payload})
+
+	if err != nil {
+		return err
+	}
+
+	select {
+		case <-b.done:
+			return ErrBrokerClosed
+		default:
+	}
+
+	select {
+		case b.outgoing <- data:
+			return nil
+		default:
+			return ErrBrokerBacklog
+	}
+}
+
+func (b *PostgresBroker) send() {
+	defer b.workers.Done()
+
+	sweep := time.NewTicker(postgresSweepInterval)
+	defer sweep.Stop()
+
+	for {
+		select {
+			case data := <-b.outgoing:
+				b.notify(data)
+
+			case <-sweep.C:
+				b.sweep()
+
+			case <-b.done:
+				// Flush what hubs published while shutting down
+				for {
+					select {
+						case data := <-b.outgoing:
+							b.notify(data)
+						default:
+							return
+					}
+				}
+		}
+	}
+}
+
+func (b *PostgresBroker) notify(data []byte) {
+	if len(data) > postgresMaxPayload {
+		ref, err := b.store(data)
+
+		if err != nil {
+			log.Printf("chat broker failed to store event: %v", err)
+			return
+		}
+
+		data, _ = json.Marshal(postgresNotification{Ref: ref})
+	}
+
+	if _, err := b.db.Exec("SELECT pg_notify($1, $2)", postgresBrokerChannel, string(data)); err != nil {
+		log.Printf("chat broker failed to publish: %v", err)
+	}
+}
+
+func (b *PostgresBroker) store(data []byte) (int64, error) {
+	var ref int64
+
+	err := b.db.QueryRow("INSERT INTO chat_broker_events(payload) VALUES($1) RETURNING id", data).Scan(&ref)
+
+	return ref, err
+}
+
+// load reads back a notification stored by another instance.
+func (b *PostgresBroker) load(ref int64) (*postgresNotification, error) {
+	var data []byte
+
+	if err := b.db.QueryRow("SELECT payload FROM chat_broker_events WHERE id = $1", ref).Scan(&data); err != nil {
+		return nil, err
+	}
+
+	var notification postgresNotification
+
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return nil, err
+	}
+
+	return &notification, nil
+}
+
+func (b *PostgresBroker) sweep() {
+	_, err := b.db.Exec(
+		"DELETE FROM chat_broker_events WHERE created_at < NOW() - make_interval(secs => $1)",
+		postgresEventRetention.Seconds(),
+	)
+
+	if err != nil {
+		log.Printf("chat broker failed to delete old events: %v", err)
+	}
+}
+
+func (b *PostgresBroker) receive() {
+	defer b.workers.Done()
+
+	for {
+		select {
+			case <-b.done:
+				return
+
+			case n, ok := <-b.listener.Notify:
+				if !ok {
+					return
+				}
+
+				// nil after a reconnect; events sent meanwhile are lost
+				if n == nil {
+					continue
+				}
+
+				var notification postgresNotification
+
+				if err := json.Unmarshal([]byte(n.Extra), &notification); err != nil {
+					log.Printf("chat broker received invalid payload: %v", err)
+					continue
+				}
+
+				if notification.Ref != 0 {
+					stored, err := b.load(notification.Ref)
+
+					if err != nil {
+						log.Printf("chat broker failed to load event %d: %v", notification.Ref, err)
+						continue
+					}
+
+					notification = *stored
+				}
+
+				b.dispatch(notification.Topic, notification.Payload)
+		}
+	}
+}
+
+func (b *PostgresBroker) Close() error {
+	var err error
+
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.workers.Wait()
+		err = b.listener.Close()
+	})
+
+	return err
+}
@@ -0,0 +1,72 @@
+//go:build postgres
+
+package chat
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// Run with a local, migrated Postgres:
+//
+//	CHAT_TEST_DATABASE_URL=postgres://... go test -race -tags postgres ./chat
+func newTestPostgresBroker(t *testing.T) *PostgresBroker {
+	t.Helper()
+
+	dsn := os.Getenv("CHAT_TEST_DATABASE_URL")
+
+	if dsn == "" {
+		t.Skip("CHAT_TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	broker, err := NewPostgresBroker(db, dsn)
+
+	if err != nil {
+		t.Fatalf("failed to start broker: %v", err)
+	}
+
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func TestPostgresBrokerSharesRoomsAcrossInstances(t *testing.T) {
+	testCrossInstance(t, newTestPostgresBroker(t), newTestPostgresBroker(t))
+}
+
+func TestPostgresBrokerLargeEvents(t *testing.T) {
+	publisher := newTestPostgresBroker(t)
+	subscriber := newTestPostgresBroker(t)
+
+	payload := []byte(`"` + string(bytes.Repeat([]byte("x"), 3 * postgresMaxPayload)) + `"`)
+	received := make(chan []byte, 1)
+
+	unsubscribe := subscriber.Subscribe("large", func(data []byte) {
+		received <- data
+	})
+	defer unsubscribe()
+
+	if err := publisher.Publish("large", payload); err != nil {
+		t.Fatalf("failed to publish: %v", err)
+	}
+
+	select {
+		case data := <-received:
+			if !bytes.Equal(data, payload) {
+				t.Errorf("received %d bytes, expected %d", len(data), len(payload))
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("large event was not delivered")
+	}
+}
@@ -0,0 +1,150 @@
+package chat
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// waitFor reads the client's queue up to the next event of eventType matching
+// match.
+func waitFor(t *testing.T, client *ChatClient, eventType string, match func(payload json.RawMessage) bool) Envelope {
+	t.Helper()
+
+	for {
+		event := nextEvent(t, client, eventType)
+
+		if match(event.Payload) {
+			return event
+		}
+	}
+}
+
+// waitClosed waits for the hub to remove the client.
+func waitClosed(t *testing.T, client *ChatClient) {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+
+	for {
+		select {
+			case _, ok := <-client.message:
+				if !ok {
+					return
+				}
+			case <-timeout:
+				t.Fatal("client was not closed")
+		}
+	}
+}
+
+func systemEvent(event string, userID string) func(json.RawMessage) bool {
+	return func(payload json.RawMessage) bool {
+		var system SystemPayload
+		json.Unmarshal(payload, &system)
+
+		return system.Event == event && system.UserID == userID
+	}
+}
+
+// testCrossInstance runs two hub managers, as two server instances would,
+// and checks that what happens on one reaches the clients of the other.
+func testCrossInstance(t *testing.T, brokerA Broker, brokerB Broker) {
+	a := newTestManager(t, PolicyDropOldest, brokerA)
+	b := newTestManager(t, PolicyDropOldest, brokerB)
+
+	watcher := joinStalled(t, b, testRoomID, "watcher")
+	settle(t, watcher.hub)
+
+	t.Run("presence", func(t *testing.T) {
+		alice := joinStalled(t, a, testRoomID, "alice")
+		settle(t, alice.hub)
+
+		waitFor(t, watcher, TypePresence, func(payload json.RawMessage) bool {
+			var presence PresencePayload
+			json.Unmarshal(payload, &presence)
+
+			return presence.UserID == "alice" && presence.Status == PresenceOnline
+		})
+
+		eventually(t, func() bool {
+			rooms := b.presence(testRoomID)
+			return len(rooms) == 1 && len(rooms[0].Users) == 2
+		}, "remote user missing from presence")
+	})
+
+	t.Run("messages", func(t *testing.T) {
+		sender := joinStalled(t, a, testRoomID, "sender")
+
+		// Large enough to need the table behind NOTIFY with PostgresBroker
+		for _, content := range []string{"hello", strings.Repeat("é", maxMessageLength)} {
+			message := ChatMessage{
+				ID: uuid.New().String(),
+				RoomID: testRoomID,
+				UserID: sender.user.ID,
+				Username: sender.user.Username,
+				Content: content,
+				CreatedAt: time.Now(),
+			}
+
+			sender.hub.broadcast <- inboundMessage{client: sender, key: uuid.New().String(), message: message}
+
+			waitFor(t, watcher, TypeChatMessage, func(payload json.RawMessage) bool {
+				var received ChatMessage
+				json.Unmarshal(payload, &received)
+
+				return received.ID == message.ID && received.Content == content
+			})
+		}
+	})
+
+	t.Run("moderation", func(t *testing.T) {
+		until := time.Now().Add(time.Minute)
+		a.dispatch(testRoomID, moderationAction{Kind: actionMute, UserID: "watcher", Until: &until})
+		waitFor(t, watcher, TypeSystem, systemEvent("user.muted", "watcher"))
+
+		bob := joinStalled(t, b, testRoomID, "bob")
+		settle(t, bob.hub)
+
+		a.dispatch(testRoomID, moderationAction{Kind: actionKick, UserID: "bob"})
+		waitClosed(t, bob)
+
+		if bob.closeCode != websocket.ClosePolicyViolation || bob.closeReason != "kicked" {
+			t.Errorf("expected a kick close frame, got %d %q", bob.closeCode, bob.closeReason)
+		}
+
+		waitFor(t, watcher, TypeSystem, systemEvent("user.kicked", "bob"))
+	})
+
+	t.Run("session revocation", func(t *testing.T) {
+		carol := joinStalled(t, b, testRoomID, "carol")
+		settle(t, carol.hub)
+
+		a.revokeSession(carol.user.SessionID)
+		waitClosed(t, carol)
+
+		if carol.closeReason != "session revoked" {
+			t.Errorf("expected a session revoked close frame, got %q", carol.closeReason)
+		}
+	})
+
+	t.Run("direct messages", func(t *testing.T) {
+		a.deliverToUsers([]string{"watcher"}, newEnvelope(TypeDirectMessage, DirectMessage{ID: "dm-1", RecipientID: "watcher"}))
+
+		waitFor(t, watcher, TypeDirectMessage, func(payload json.RawMessage) bool {
+			var message DirectMessage
+			json.Unmarshal(payload, &message)
+
+			return message.ID == "dm-1"
+		})
+	})
+}
+
+func TestMemoryBrokerSharesRoomsAcrossManagers(t *testing.T) {
+	broker := NewMemoryBroker()
+	testCrossInstance(t, broker, broker)
+}
@@ -1,67 +1,442 @@
 package chat
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/nambuitechx/nam-chilling-room-server/utils"
 )
 
+const (
+	// Time allowed to write a frame to the peer
+	writeWait		= 10 * time.Second
+
+	// Time allowed between two pongs before the connection is considered dead
+	pongWait		= 60 * time.Second
+
+	// Pings are sent within pongWait so a live peer always answers in time
+	pingPeriod		= (pongWait * 9) / 10
+
+	// Largest frame accepted from a client
+	maxFrameSize	= 64 * 1024
+)
+
+// clientTimeouts are the connection deadlines of a ChatClient, taken from its
+// hub manager so tests can shorten them.
+type clientTimeouts struct {
+	writeWait	time.Duration
+	pongWait	time.Duration
+	pingPeriod	time.Duration
+}
+
+var defaultClientTimeouts = clientTimeouts{
+	writeWait: writeWait,
+	pongWait: pongWait,
+	pingPeriod: pingPeriod,
+}
+
+// clientBufferSize is how many frames may wait for a client's writePump.
+const clientBufferSize = 256
+
+// ChatClient is one WebSocket connection in a hub. Ownership is split so each
+// resource has a single closer:
+//   - the hub closes message, exactly once, when it removes the client
+//   - writePump is the only writer and the only one closing conn
+//   - readPump cancels ctx when the peer goes away, which stops writePump
 type ChatClient struct {
 	hub		*ChatHub
 	conn	*websocket.Conn
-	message	chan IncomingMessage
+	user	*utils.AuthorizedUserInfo
+	message	chan Envelope
 	media	chan []byte
+
+	ctx		context.Context
+	cancel	context.CancelFunc
+
+	// Close frame sent once message is closed, set by the hub before closing it
+	closeCode	int
+	closeReason	string
+
+	// Slow consumer state, owned by the hub
+	lagWarned	bool
+	missed		int
+
+	// Flood control of this connection, owned by readPump
+	limiter		*connLimiter
+
+	timeouts	clientTimeouts
+}
+
+func newChatClient(hub *ChatHub, conn *websocket.Conn, user *utils.AuthorizedUserInfo) *ChatClient {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &ChatClient{
+		hub: hub,
+		conn: conn,
+		user: user,
+		message: make(chan Envelope, clientBufferSize),
+		ctx: ctx,
+		cancel: cancel,
+		closeCode: websocket.CloseNormalClosure,
+		limiter: newConnLimiter(),
+		timeouts: hub.manager.timeouts,
+	}
 }
 
 func (c *ChatClient) readPump() {
 	defer func() {
+		c.cancel()
 		c.hub.unregister <- c
-		c.conn.Close()
+		c.hub.manager.release(c.hub)
 	}()
 
+	// Oversized frames and missed pongs fail ReadMessage, which unregisters
+	// the client
+	c.conn.SetReadLimit(maxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.timeouts.pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(c.timeouts.pongWait))
+	})
+
 	for {
 		_, msg, err := c.conn.ReadMessage()
 
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket read error: %v", err)
+			}
 			break
 		}
 
-		var incomingMessage IncomingMessage
+		var frame Envelope
+		decodeErr := json.Unmarshal(msg, &frame)
+
+		// Invalid frames count too, so floods of garbage are throttled
+		if err := c.limiter.allow(len(msg)); err != nil {
+			c.reply(errorEnvelope(frame.ID, err))
+			continue
+		}
+
+		if decodeErr != nil {
+			c.reply(errorEnvelope("", ErrInvalidFrame))
+			continue
+		}
+
+		if frame.Version != ProtocolVersion {
+			c.reply(errorEnvelope(frame.ID, ErrUnsupportedVersion))
+			continue
+		}
 
-		if err := json.Unmarshal(msg, &incomingMessage); err != nil {
-			log.Printf("invalid json from client: %v", err)
-            continue
+		if err := c.handle(frame); err != nil {
+			c.reply(errorEnvelope(frame.ID, err))
 		}
+	}
+}
+
+// handle dispatches a client frame. Returned errors are reported to the
+// client as an error frame referencing the frame id.
+func (c *ChatClient) handle(frame Envelope) error {
+	switch frame.Type {
+		case TypeChatSend:
+			var payload ChatSendPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			if err := validateContent(payload.Content); err != nil {
+				return err
+			}
+
+			// The sender is the user authenticated at upgrade time and clients
+			// may only post to the room they joined. The hub rate limits and
+			// acks the frame.
+			message := ChatMessage{
+				ID: uuid.New().String(),
+				RoomID: c.hub.roomID,
+				UserID: c.user.ID,
+				Username: c.user.Username,
+				Content: payload.Content,
+				CreatedAt: time.Now(),
+			}
+
+			// A reply joins the thread of the message it answers, which is
+			// the thread's first message when that has no thread yet
+			if payload.ReplyTo != "" {
+				parent, err := c.lookupMessage(payload.ReplyTo)
+
+				if err != nil {
+					return err
+				}
+
+				message.ReplyToID = payload.ReplyTo
+				message.ThreadID = parent.ThreadID
+
+				if message.ThreadID == "" {
+					message.ThreadID = payload.ReplyTo
+				}
+			}
+
+			c.hub.broadcast <- inboundMessage{client: c, key: frame.ID, message: message}
+
+		case TypeMessageEdit, TypeMessageDelete:
+			var payload MessageEditPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			if payload.MessageID == "" {
+				return ErrMessageIDRequired
+			}
+
+			message, err := c.lookupMessage(payload.MessageID)
+
+			if err != nil {
+				return err
+			}
+
+			if frame.Type == TypeMessageEdit {
+				_, err = c.hub.manager.editMessage(message, c.user.ID, payload.Content)
+			} else {
+				err = c.hub.manager.deleteOwnMessage(message, c.user.ID)
+			}
+
+			if err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID, MessageID: payload.MessageID}))
+
+		case TypeTypingStart, TypeTypingStop:
+			c.hub.typingSignals <- typingSignal{client: c, active: frame.Type == TypeTypingStart}
+
+		case TypeReactionAdd, TypeReactionRemove:
+			var payload ReactionPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			if err := c.react(payload, frame.Type == TypeReactionAdd); err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID, MessageID: payload.MessageID}))
+
+		case TypeRead:
+			var payload ReadPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			if err := c.markRead(payload.MessageID); err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID, MessageID: payload.MessageID}))
+
+		case TypeDirectSend:
+			var payload DirectSendPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			message, err := c.hub.manager.sendDirect(c.user, payload.To, payload.Content)
+
+			if err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID, MessageID: message.ID}))
+
+		case TypeDirectRead:
+			var payload DirectReadPayload
+
+			if err := json.Unmarshal(frame.Payload, &payload); err != nil {
+				return ErrInvalidFrame
+			}
+
+			if payload.UserID == "" {
+				return ErrUserIDRequired
+			}
+
+			if _, err := c.hub.manager.markDirectRead(c.user.ID, payload.UserID, payload.MessageID); err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID, MessageID: payload.MessageID}))
+
+		case TypeModDelete, TypeModMute, TypeModUnmute, TypeModKick, TypeModBan:
+			var command ModerationCommand
+
+			if len(frame.Payload) > 0 {
+				if err := json.Unmarshal(frame.Payload, &command); err != nil {
+					return ErrInvalidFrame
+				}
+			}
+
+			if err := c.moderate(frame.Type, command); err != nil {
+				return err
+			}
+
+			c.reply(ackEnvelope(AckPayload{Ref: frame.ID}))
+
+		default:
+			return ErrUnknownType
+	}
+
+	return nil
+}
+
+// moderate runs a moderation command sent over the socket, scoped to the
+// client's room.
+func (c *ChatClient) moderate(commandType string, command ModerationCommand) error {
+	if !utils.HasRole(c.user.Role, utils.RoleModerator) {
+		return ErrNotModerator
+	}
+
+	manager := c.hub.manager
+
+	switch commandType {
+		case TypeModDelete:
+			if command.MessageID == "" {
+				return ErrMessageIDRequired
+			}
+
+			// Only messages of the client's room are found
+			message, err := c.lookupMessage(command.MessageID)
+
+			if err != nil {
+				return err
+			}
+
+			return manager.deleteMessage(message, c.user.ID)
+		case TypeModMute:
+			_, err := manager.muteUser(c.hub.roomID, command.ModerationPayload, c.user)
+			return err
+		case TypeModUnmute:
+			return manager.unmuteUser(c.hub.roomID, command.UserID)
+		case TypeModKick:
+			return manager.kickUser(c.hub.roomID, command.UserID, c.user)
+		default:
+			_, err := manager.banUser(c.hub.roomID, command.ModerationPayload, c.user)
+			return err
+	}
+}
+
+// markRead moves the user's read cursor and tells the room, so other clients
+// can show who has seen what.
+func (c *ChatClient) markRead(messageID string) error {
+	if messageID == "" {
+		return ErrMessageIDRequired
+	}
+
+	message, err := c.lookupMessage(messageID)
+
+	if err != nil {
+		return err
+	}
+
+	cursor, err := c.hub.manager.chatService.markRead(c.hub.roomID, c.user.ID, messageID, message.CreatedAt)
+
+	if err != nil {
+		return err
+	}
+
+	cursor.Username = c.user.Username
+	c.hub.roomEvents <- newEnvelope(TypeRead, cursor)
+
+	return nil
+}
+
+// lookupMessage finds a message of the client's room. Fresh messages may
+// still be waiting in the persister queue, so the hub is asked first.
+func (c *ChatClient) lookupMessage(messageID string) (*ChatMessage, error) {
+	reply := make(chan *ChatMessage, 1)
+	c.hub.recentLookup <- messageLookup{messageID: messageID, reply: reply}
+
+	if message := <-reply; message != nil {
+		return message, nil
+	}
+
+	return c.hub.manager.chatService.getRoomMessage(messageID, c.hub.roomID)
+}
+
+// react adds or removes the user's reaction and tells the room when that
+// changed anything.
+func (c *ChatClient) react(payload ReactionPayload, add bool) error {
+	if payload.MessageID == "" {
+		return ErrMessageIDRequired
+	}
+
+	if _, err := c.lookupMessage(payload.MessageID); err != nil {
+		return err
+	}
+
+	count, changed, err := c.hub.manager.chatService.react(payload.MessageID, c.user.ID, payload.Emoji, add)
 
-		c.hub.broadcast <- incomingMessage
+	if err != nil {
+		return err
 	}
+
+	if !changed {
+		return nil
+	}
+
+	action := "add"
+
+	if !add {
+		action = "remove"
+	}
+
+	c.hub.roomEvents <- newEnvelope(TypeReaction, ReactionEvent{
+		RoomID: c.hub.roomID,
+		MessageID: payload.MessageID,
+		UserID: c.user.ID,
+		Emoji: payload.Emoji,
+		Action: action,
+		Count: count,
+	})
+
+	return nil
 }
 
+// reply sends an event to this client only.
+func (c *ChatClient) reply(event Envelope) {
+	c.hub.direct <- directEvent{client: c, event: event}
+}
+
+// writePump is the only writer of the connection. It drains what the hub
+// queued before sending the close frame; a failed or timed out write closes
+// the connection, which ends readPump and unregisters the client.
 func (c *ChatClient) writePump() {
+	ticker := time.NewTicker(c.timeouts.pingPeriod)
+
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
 	for {
 		select {
 			// Send JSON
 			case msg, ok := <-c.message:
+				c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.writeWait))
+
 				if !ok {
+					// The hub removed the client
+					c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
 					return
 				}
 
-				claims, err := utils.ValidateTokenString(msg.TokenString)
-
-				if err != nil {
-					log.Printf("failed to validate token string: %v", err)
-					continue
-				}
-
-				responseMessage := map[string]any {
-					"tokenString": msg.TokenString,
-					"username": claims.Username,
-					"content": msg.Content,
-				}
-
-				data, err := json.Marshal(responseMessage)
+				data, err := json.Marshal(msg)
 
 				if err != nil {
 					log.Printf("invalid json message to send to client: %v", err)
@@ -70,7 +445,7 @@ func (c *ChatClient) writePump() {
 
 				if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
 					log.Printf("failed to send message to client: %v", err)
-					continue
+					return
 				}
 
 			// Send media
@@ -78,7 +453,24 @@ func (c *ChatClient) writePump() {
 				if !ok {
 					return
 				}
-				c.conn.WriteMessage(websocket.BinaryMessage, frame)
+
+				c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.writeWait))
+
+				if err := c.conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+					log.Printf("failed to send media to client: %v", err)
+					return
+				}
+
+			// The peer went away
+			case <-c.ctx.Done():
+				return
+
+			case <-ticker.C:
+				c.conn.SetWriteDeadline(time.Now().Add(c.timeouts.writeWait))
+
+				if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+					return
+				}
 		}
 	}
 }
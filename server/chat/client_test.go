@@ -0,0 +1,196 @@
+package chat
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// blockedFrames is fewer frames than a client queues, and more bytes than
+// the socket buffers of a loopback connection hold.
+const blockedFrames = 128
+
+func TestOversizedFrameClosesConnection(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+	server := newTestServer(t, m)
+	conn := dial(t, server, testRoomID, "big")
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 1 }, "client did not join")
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", maxFrameSize + 1))); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+
+	for {
+		_, _, err := conn.ReadMessage()
+
+		if err == nil {
+			continue
+		}
+
+		var closeErr *websocket.CloseError
+
+		if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseMessageTooBig {
+			t.Fatalf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+		}
+		break
+	}
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 0 }, "client was not unregistered")
+}
+
+func TestUnansweredPingsUnregister(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+	m.timeouts = clientTimeouts{writeWait: time.Second, pongWait: 300 * time.Millisecond, pingPeriod: 100 * time.Millisecond}
+	server := newTestServer(t, m)
+
+	// The dialer answers pings while reading; this peer reads, the other never does
+	live := dial(t, server, testRoomID, "live")
+
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 1 }, "live client did not join")
+
+	started := time.Now()
+	dial(t, server, testRoomID, "silent")
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 2 }, "silent client did not join")
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 1 }, "silent client was not unregistered")
+
+	if elapsed := time.Since(started); elapsed < m.timeouts.pongWait {
+		t.Errorf("silent client unregistered after %v, before pongWait", elapsed)
+	}
+
+	// Several pong waits later the live client is still there
+	time.Sleep(3 * m.timeouts.pongWait)
+
+	if count := m.clientCount(testRoomID); count != 1 {
+		t.Errorf("expected the live client to stay, got %d clients", count)
+	}
+}
+
+func TestBlockedWriterDropped(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+	m.timeouts = clientTimeouts{writeWait: 200 * time.Millisecond, pongWait: time.Minute, pingPeriod: time.Minute}
+	server := newTestServer(t, m)
+
+	dial(t, server, testRoomID, "blocked")
+	hub := runningHub(t, m, testRoomID)
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 1 }, "client did not join")
+
+	// Large frames fill the socket buffers of a peer that never reads, while
+	// the client's queue never fills up, so only the write deadline can
+	// remove it
+	payload := strings.Repeat("x", 256 * 1024)
+
+	for i := 0; i < blockedFrames; i++ {
+		select {
+			case hub.roomEvents <- newEnvelope("test.event", payload):
+			case <-hub.done:
+		}
+	}
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 0 }, "blocked client was not dropped")
+}
+
+func TestReadCursors(t *testing.T) {
+	const otherRoomID = "44444444-4444-4444-4444-444444444444"
+
+	base := time.Now().Add(-time.Minute)
+
+	history := []ChatMessage{
+		{ID: "old", RoomID: testRoomID, UserID: "alice", Content: "old", CreatedAt: base},
+		{ID: "new", RoomID: testRoomID, UserID: "alice", Content: "new", CreatedAt: base.Add(time.Second)},
+		{ID: "elsewhere", RoomID: otherRoomID, UserID: "alice", Content: "x", CreatedAt: base.Add(2 * time.Second)},
+	}
+
+	type read struct {
+		messageID	string
+		wantCursor	string
+		wantErr		error
+	}
+
+	tests := []struct {
+		name		string
+		reads		[]read
+		wantCursor	string
+	}{
+		{name: "first read", reads: []read{{messageID: "old", wantCursor: "old"}}, wantCursor: "old"},
+		{name: "moves forward", reads: []read{{messageID: "old", wantCursor: "old"}, {messageID: "new", wantCursor: "new"}}, wantCursor: "new"},
+		{name: "never moves back", reads: []read{{messageID: "new", wantCursor: "new"}, {messageID: "old", wantCursor: "new"}}, wantCursor: "new"},
+		{name: "message of another room", reads: []read{{messageID: "elsewhere", wantErr: ErrMessageNotFound}}},
+		{name: "missing message id", reads: []read{{wantErr: ErrMessageIDRequired}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onRoom(db, testRoomID)
+			onMessages(db).add(history...)
+			onReadCursors(db)
+
+			db.on(`SELECT EXISTS`, func(args []driver.Value) fakeResult {
+				return row([]string{"exists"}, false)
+			})
+
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+			author := joinStalled(t, m, testRoomID, "alice")
+			reader := joinStalled(t, m, testRoomID, "bob")
+
+			for i, r := range tt.reads {
+				err := reader.handle(frame(t, TypeRead, "read", ReadPayload{MessageID: r.messageID}))
+
+				if !errors.Is(err, r.wantErr) {
+					t.Fatalf("read %d: got %v, want %v", i, err, r.wantErr)
+				}
+
+				if err != nil {
+					continue
+				}
+
+				var cursor ReadCursor
+
+				if err := json.Unmarshal(nextEvent(t, author, TypeRead).Payload, &cursor); err != nil {
+					t.Fatalf("invalid read event: %v", err)
+				}
+
+				if cursor.UserID != "bob" || cursor.Username != "bob" || cursor.MessageID != r.wantCursor {
+					t.Errorf("read %d: got cursor %+v, want bob at %q", i, cursor, r.wantCursor)
+				}
+			}
+
+			// What a client reconnecting later is told
+			cursors, err := m.chatService.listReadCursors(testRoomID, "alice")
+
+			if err != nil {
+				t.Fatalf("failed to list cursors: %v", err)
+			}
+
+			got := ""
+
+			for _, cursor := range cursors {
+				if cursor.UserID == "bob" {
+					got = cursor.MessageID
+				}
+			}
+
+			if got != tt.wantCursor {
+				t.Errorf("got stored cursor %q, want %q", got, tt.wantCursor)
+			}
+		})
+	}
+}
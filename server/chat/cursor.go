@@ -0,0 +1,51 @@
+package chat
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// messageCursor identifies a position in the messages table. Ordering is by
+// (created_at, id) so messages sharing a timestamp are never skipped.
+type messageCursor struct {
+	CreatedAt	time.Time
+	ID			string
+}
+
+func newMessageCursor(message ChatMessage) messageCursor {
+	return messageCursor{
+		CreatedAt: message.CreatedAt,
+		ID: message.ID,
+	}
+}
+
+func (c messageCursor) encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeMessageCursor(s string) (*messageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	createdAtStr, id, ok := strings.Cut(string(raw), "|")
+
+	if !ok || id == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, createdAtStr)
+
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &messageCursor{
+		CreatedAt: createdAt,
+		ID: id,
+	}, nil
+}
@@ -0,0 +1,754 @@
+package chat
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDB answers each statement with the first handler whose pattern matches
+// the query. Statements without a handler return no rows and affect nothing,
+// which is all hubs need to load mutes and persist messages.
+type fakeDB struct {
+	db			*sql.DB
+	mu			sync.Mutex
+	handlers	[]fakeHandler
+}
+
+type fakeHandler struct {
+	pattern	*regexp.Regexp
+	handle	func(args []driver.Value) fakeResult
+}
+
+type fakeResult struct {
+	columns		[]string
+	rows		[][]driver.Value
+	affected	int64
+	err			error
+}
+
+var (
+	fakeDBs		sync.Map
+	fakeDBCount	atomic.Int64
+)
+
+func init() {
+	sql.Register("chat-fake", fakeDriver{})
+}
+
+func newFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+
+	name := strconv.FormatInt(fakeDBCount.Add(1), 10)
+	fake := &fakeDB{}
+	fakeDBs.Store(name, fake)
+
+	db, err := sql.Open("chat-fake", name)
+
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	fake.db = db
+
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBs.Delete(name)
+	})
+
+	return fake
+}
+
+// on answers queries matching pattern with handle. Handlers added later win.
+func (f *fakeDB) on(pattern string, handle func(args []driver.Value) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers = append([]fakeHandler{{pattern: regexp.MustCompile(pattern), handle: handle}}, f.handlers...)
+}
+
+func (f *fakeDB) result(query string, args []driver.Value) fakeResult {
+	f.mu.Lock()
+	handlers := f.handlers
+	f.mu.Unlock()
+
+	for _, h := range handlers {
+		if h.pattern.MatchString(query) {
+			return h.handle(args)
+		}
+	}
+
+	return fakeResult{}
+}
+
+// onRoom makes roomID exist.
+func onRoom(db *fakeDB, roomID string) {
+	db.on(`FROM rooms WHERE id`, func(args []driver.Value) fakeResult {
+		if args[0] != roomID {
+			return fakeResult{}
+		}
+
+		return row([]string{"id", "name", "created_at", "updated_at"}, roomID, "general", time.Now(), time.Now())
+	})
+}
+
+// row is a single row result.
+func row(columns []string, values ...driver.Value) fakeResult {
+	return fakeResult{columns: columns, rows: [][]driver.Value{values}}
+}
+
+type fakeDriver struct{}
+type fakeConn struct{ db *fakeDB }
+type fakeTx struct{}
+type fakeStmt struct {
+	db		*fakeDB
+	query	string
+}
+type fakeRows struct {
+	result	fakeResult
+	next	int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	db, _ := fakeDBs.Load(name)
+	return fakeConn{db: db.(*fakeDB)}, nil
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{db: c.db, query: query}, nil }
+func (fakeConn) Close() error { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (fakeTx) Commit() error { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func (fakeStmt) Close() error { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result := s.db.result(s.query, args)
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result := s.db.result(s.query, args)
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return &fakeRows{result: result}, nil
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.result.rows[r.next])
+	r.next++
+
+	return nil
+}
+
+// fakeMessages keeps the messages table in memory, for tests that edit or
+// delete messages.
+type fakeMessages struct {
+	mu			sync.Mutex
+	messages	map[string]ChatMessage
+	deleted		map[string]bool
+
+	// LIMIT of every page query
+	limits		[]int64
+
+	// message_edits rows, oldest first
+	edits		[]MessageEdit
+}
+
+var messageColumnNames = []string{"id", "room_id", "user_id", "username", "content", "reply_to_id", "thread_id", "edited_at", "created_at"}
+
+func onMessages(db *fakeDB) *fakeMessages {
+	f := &fakeMessages{messages: map[string]ChatMessage{}, deleted: map[string]bool{}}
+
+	// Batches from the persister and ensureMessage, seven values per row
+	db.on(`INSERT INTO messages`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for i := 0; i + 7 <= len(args); i += 7 {
+			id := args[i].(string)
+
+			if _, ok := f.messages[id]; ok {
+				continue
+			}
+
+			replyTo, _ := args[i + 4].(string)
+			threadID, _ := args[i + 5].(string)
+
+			f.messages[id] = ChatMessage{
+				ID: id,
+				RoomID: args[i + 1].(string),
+				UserID: args[i + 2].(string),
+				Content: args[i + 3].(string),
+				ReplyToID: replyTo,
+				ThreadID: threadID,
+				CreatedAt: args[i + 6].(time.Time),
+			}
+		}
+
+		return fakeResult{affected: int64(len(args) / 7)}
+	})
+
+	db.on(`FROM messages m JOIN users u ON u.id = m.user_id\s+WHERE m.id = \$1`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		m, ok := f.messages[args[0].(string)]
+
+		if !ok || f.deleted[m.ID] {
+			return fakeResult{}
+		}
+
+		return row(messageColumnNames, m.ID, m.RoomID, m.UserID, m.UserID, m.Content, m.ReplyToID, m.ThreadID, nil, m.CreatedAt)
+	})
+
+	db.on(`(?s)WHERE m.room_id = \$1 AND m.deleted_at IS NULL.*ORDER BY m.created_at ASC`, f.page(true))
+	db.on(`(?s)WHERE m.room_id = \$1 AND m.deleted_at IS NULL.*ORDER BY m.created_at DESC`, f.page(false))
+
+	db.on(`WHERE m.thread_id = \$1 AND m.deleted_at IS NULL`, f.thread)
+
+	db.on(`SELECT content FROM messages WHERE id = \$1 AND deleted_at IS NULL`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		m, ok := f.messages[args[0].(string)]
+
+		if !ok || f.deleted[m.ID] {
+			return fakeResult{}
+		}
+
+		return row([]string{"content"}, m.Content)
+	})
+
+	db.on(`INSERT INTO message_edits`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.edits = append(f.edits, MessageEdit{
+			ID: args[0].(string),
+			MessageID: args[1].(string),
+			PreviousContent: args[2].(string),
+			EditedBy: args[3].(string),
+			EditedAt: time.Now(),
+		})
+
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`UPDATE messages SET content`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		m := f.messages[args[0].(string)]
+		m.Content = args[1].(string)
+		f.messages[m.ID] = m
+
+		return row([]string{"edited_at"}, time.Now())
+	})
+
+	db.on(`FROM message_edits`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		result := fakeResult{columns: []string{"id", "message_id", "previous_content", "edited_by", "edited_at"}}
+
+		for _, edit := range f.edits {
+			if edit.MessageID == args[0] {
+				result.rows = append(result.rows, []driver.Value{edit.ID, edit.MessageID, edit.PreviousContent, edit.EditedBy, edit.EditedAt})
+			}
+		}
+
+		return result
+	})
+
+	db.on(`UPDATE messages SET deleted_at`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		m, ok := f.messages[args[0].(string)]
+
+		if !ok || f.deleted[m.ID] || m.RoomID != args[2] {
+			return fakeResult{}
+		}
+
+		f.deleted[m.ID] = true
+		return fakeResult{affected: 1}
+	})
+
+	return f
+}
+
+// page answers selectMessages: roomID, an optional cursor and the limit.
+func (f *fakeMessages) page(forward bool) func(args []driver.Value) fakeResult {
+	return func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.limits = append(f.limits, args[len(args) - 1].(int64))
+
+		var messages []ChatMessage
+
+		for _, m := range f.messages {
+			if m.RoomID != args[0] || f.deleted[m.ID] {
+				continue
+			}
+
+			if len(args) == 4 {
+				c := compareMessages(m, args[1].(time.Time), args[2].(string))
+
+				if (forward && c <= 0) || (!forward && c >= 0) {
+					continue
+				}
+			}
+
+			messages = append(messages, m)
+		}
+
+		sort.Slice(messages, func(i, j int) bool {
+			before := compareMessages(messages[i], messages[j].CreatedAt, messages[j].ID) < 0
+			return before == forward
+		})
+
+		result := fakeResult{columns: messageColumnNames}
+
+		for i, m := range messages {
+			if int64(i) == args[len(args) - 1].(int64) {
+				break
+			}
+
+			result.rows = append(result.rows, []driver.Value{m.ID, m.RoomID, m.UserID, m.UserID, m.Content, m.ReplyToID, m.ThreadID, nil, m.CreatedAt})
+		}
+
+		return result
+	}
+}
+
+// thread answers selectThreadReplies: the thread id, an optional cursor and
+// the limit.
+func (f *fakeMessages) thread(args []driver.Value) fakeResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var replies []ChatMessage
+
+	for _, m := range f.messages {
+		if m.ThreadID != args[0] || f.deleted[m.ID] {
+			continue
+		}
+
+		if len(args) == 4 && compareMessages(m, args[1].(time.Time), args[2].(string)) <= 0 {
+			continue
+		}
+
+		replies = append(replies, m)
+	}
+
+	sort.Slice(replies, func(i, j int) bool {
+		return compareMessages(replies[i], replies[j].CreatedAt, replies[j].ID) < 0
+	})
+
+	result := fakeResult{columns: messageColumnNames}
+
+	for i, m := range replies {
+		if int64(i) == args[len(args) - 1].(int64) {
+			break
+		}
+
+		result.rows = append(result.rows, []driver.Value{m.ID, m.RoomID, m.UserID, m.UserID, m.Content, m.ReplyToID, m.ThreadID, nil, m.CreatedAt})
+	}
+
+	return result
+}
+
+// compareMessages orders messages by (created_at, id) like the cursor does.
+func compareMessages(m ChatMessage, createdAt time.Time, id string) int {
+	if c := m.CreatedAt.Compare(createdAt); c != 0 {
+		return c
+	}
+
+	return strings.Compare(m.ID, id)
+}
+
+func (f *fakeMessages) add(messages ...ChatMessage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range messages {
+		f.messages[m.ID] = m
+	}
+}
+
+func (f *fakeMessages) isDeleted(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.deleted[id]
+}
+
+// fakeReadCursors keeps the read_cursors table in memory, keyed by user and room.
+type fakeReadCursors struct {
+	mu		sync.Mutex
+	cursors	map[string]ReadCursor
+}
+
+var readCursorColumnNames = []string{"user_id", "room_id", "message_id", "last_read_at"}
+
+func onReadCursors(db *fakeDB) *fakeReadCursors {
+	f := &fakeReadCursors{cursors: map[string]ReadCursor{}}
+
+	// Cursors only move forward; an older one returns no rows
+	db.on(`INSERT INTO read_cursors`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		cursor := ReadCursor{UserID: args[0].(string), RoomID: args[1].(string), MessageID: args[2].(string), LastReadAt: args[3].(time.Time)}
+		key := cursor.UserID + "|" + cursor.RoomID
+
+		if stored, ok := f.cursors[key]; ok && !stored.LastReadAt.Before(cursor.LastReadAt) {
+			return fakeResult{}
+		}
+
+		f.cursors[key] = cursor
+		return row(readCursorColumnNames, cursor.UserID, cursor.RoomID, cursor.MessageID, cursor.LastReadAt)
+	})
+
+	db.on(`FROM read_cursors WHERE user_id = \$1 AND room_id = \$2`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		cursor, ok := f.cursors[args[0].(string) + "|" + args[1].(string)]
+
+		if !ok {
+			return fakeResult{}
+		}
+
+		return row(readCursorColumnNames, cursor.UserID, cursor.RoomID, cursor.MessageID, cursor.LastReadAt)
+	})
+
+	db.on(`FROM read_cursors c`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		result := fakeResult{columns: []string{"user_id", "username", "room_id", "message_id", "last_read_at"}}
+
+		for _, cursor := range f.cursors {
+			if cursor.RoomID == args[0] {
+				result.rows = append(result.rows, []driver.Value{cursor.UserID, cursor.UserID, cursor.RoomID, cursor.MessageID, cursor.LastReadAt})
+			}
+		}
+
+		return result
+	})
+
+	return f
+}
+
+// fakeReactions keeps the message_reactions table in memory.
+type fakeReactions struct {
+	mu			sync.Mutex
+	reactions	map[[3]string]bool
+}
+
+func onReactions(db *fakeDB) *fakeReactions {
+	f := &fakeReactions{reactions: map[[3]string]bool{}}
+
+	key := func(args []driver.Value) [3]string {
+		return [3]string{args[0].(string), args[1].(string), args[2].(string)}
+	}
+
+	db.on(`INSERT INTO message_reactions`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if f.reactions[key(args)] {
+			return fakeResult{}
+		}
+
+		f.reactions[key(args)] = true
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`DELETE FROM message_reactions`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if !f.reactions[key(args)] {
+			return fakeResult{}
+		}
+
+		delete(f.reactions, key(args))
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`SELECT COUNT\(\*\) FROM message_reactions`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var count int64
+
+		for k := range f.reactions {
+			if k[0] == args[0] && k[2] == args[1] {
+				count++
+			}
+		}
+
+		return row([]string{"count"}, count)
+	})
+
+	// Message ids arrive as a Postgres array literal
+	db.on(`FROM message_reactions\s+WHERE message_id = ANY`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		ids := strings.Split(strings.Trim(args[0].(string), "{}"), ",")
+		result := fakeResult{columns: []string{"message_id", "emoji", "count"}}
+
+		for _, id := range ids {
+			counts := map[string]int64{}
+
+			for k := range f.reactions {
+				if k[0] == strings.Trim(id, `"`) {
+					counts[k[2]]++
+				}
+			}
+
+			emojis := make([]string, 0, len(counts))
+
+			for emoji := range counts {
+				emojis = append(emojis, emoji)
+			}
+
+			sort.Slice(emojis, func(i, j int) bool { return counts[emojis[i]] > counts[emojis[j]] || counts[emojis[i]] == counts[emojis[j]] && emojis[i] < emojis[j] })
+
+			for _, emoji := range emojis {
+				result.rows = append(result.rows, []driver.Value{strings.Trim(id, `"`), emoji, counts[emoji]})
+			}
+		}
+
+		return result
+	})
+
+	return f
+}
+
+// fakeDirect keeps the direct message tables in memory. users maps the ids of
+// the users table to whether they are still active.
+type fakeDirect struct {
+	mu				sync.Mutex
+	users			map[string]bool
+	conversations	map[[2]string]string
+	messages		[]DirectMessage
+	cursors			map[[2]string]time.Time
+
+	// LIMIT of every conversation list query
+	limits			[]int64
+}
+
+var directMessageColumnNames = []string{"id", "conversation_id", "sender_id", "username", "recipient_id", "content", "created_at"}
+
+func (f *fakeDirect) row(m DirectMessage) []driver.Value {
+	return []driver.Value{m.ID, m.ConversationID, m.SenderID, m.SenderID, m.RecipientID, m.Content, m.CreatedAt}
+}
+
+// newest returns the messages of conversationID, newest first.
+func (f *fakeDirect) newest(conversationID string) []DirectMessage {
+	messages := []DirectMessage{}
+
+	for _, m := range f.messages {
+		if m.ConversationID == conversationID {
+			messages = append(messages, m)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].CreatedAt.After(messages[j].CreatedAt) || messages[i].CreatedAt.Equal(messages[j].CreatedAt) && messages[i].ID > messages[j].ID
+	})
+
+	return messages
+}
+
+func onDirect(db *fakeDB, users map[string]bool) *fakeDirect {
+	f := &fakeDirect{users: users, conversations: map[[2]string]string{}, cursors: map[[2]string]time.Time{}}
+
+	db.on(`SELECT username FROM users WHERE id = \$1 AND deleted_at IS NULL`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		if !f.users[args[0].(string)] {
+			return fakeResult{}
+		}
+
+		return row([]string{"username"}, args[0])
+	})
+
+	db.on(`INSERT INTO direct_conversations`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		pair := [2]string{args[1].(string), args[2].(string)}
+
+		if _, ok := f.conversations[pair]; !ok {
+			f.conversations[pair] = args[0].(string)
+		}
+
+		return row([]string{"id"}, f.conversations[pair])
+	})
+
+	db.on(`INSERT INTO direct_messages`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		message := DirectMessage{ID: args[0].(string), ConversationID: args[1].(string), SenderID: args[2].(string), Content: args[3].(string), CreatedAt: args[4].(time.Time)}
+
+		for pair, id := range f.conversations {
+			if id == message.ConversationID {
+				message.RecipientID = pair[0]
+
+				if pair[0] == message.SenderID {
+					message.RecipientID = pair[1]
+				}
+			}
+		}
+
+		f.messages = append(f.messages, message)
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`SELECT id FROM direct_conversations WHERE user_a_id = \$1 AND user_b_id = \$2`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		id, ok := f.conversations[[2]string{args[0].(string), args[1].(string)}]
+
+		if !ok {
+			return fakeResult{}
+		}
+
+		return row([]string{"id"}, id)
+	})
+
+	// Pages carry a cursor in $2 and $3 when they do not start at the newest
+	db.on(`(?s)WHERE d.conversation_id = \$1.*ORDER BY d.created_at DESC`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		result := fakeResult{columns: directMessageColumnNames}
+
+		for _, m := range f.newest(args[0].(string)) {
+			if len(args) == 4 {
+				before := args[1].(time.Time)
+
+				if !m.CreatedAt.Before(before) && !(m.CreatedAt.Equal(before) && m.ID < args[2].(string)) {
+					continue
+				}
+			}
+
+			if int64(len(result.rows)) == args[len(args) - 1].(int64) {
+				break
+			}
+
+			result.rows = append(result.rows, f.row(m))
+		}
+
+		return result
+	})
+
+	db.on(`WHERE d.conversation_id = \$1 AND d.id = \$2`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, m := range f.messages {
+			if m.ConversationID == args[0] && m.ID == args[1] {
+				return fakeResult{columns: directMessageColumnNames, rows: [][]driver.Value{f.row(m)}}
+			}
+		}
+
+		return fakeResult{}
+	})
+
+	// Cursors only move forward, like GREATEST in the upsert
+	db.on(`INSERT INTO direct_read_cursors`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		key := [2]string{args[0].(string), args[1].(string)}
+
+		if readAt := args[2].(time.Time); readAt.After(f.cursors[key]) {
+			f.cursors[key] = readAt
+		}
+
+		return row([]string{"conversation_id", "user_id", "last_read_at"}, key[0], key[1], f.cursors[key])
+	})
+
+	db.on(`FROM direct_conversations c\s+JOIN users o`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		userID := args[0].(string)
+		limit, offset := args[1].(int64), args[2].(int64)
+		f.limits = append(f.limits, limit)
+
+		var latest []DirectMessage
+
+		for pair, id := range f.conversations {
+			if pair[0] == userID || pair[1] == userID {
+				latest = append(latest, f.newest(id)[0])
+			}
+		}
+
+		sort.Slice(latest, func(i, j int) bool { return latest[i].CreatedAt.After(latest[j].CreatedAt) })
+
+		result := fakeResult{columns: append(append([]string{}, directMessageColumnNames...), "other_id", "other_username", "unread")}
+
+		for i, m := range latest {
+			if int64(i) < offset || int64(len(result.rows)) == limit {
+				continue
+			}
+
+			otherID := m.RecipientID
+
+			if otherID == userID {
+				otherID = m.SenderID
+			}
+
+			var unread int64
+
+			for _, n := range f.messages {
+				if n.ConversationID == m.ConversationID && n.SenderID != userID && n.CreatedAt.After(f.cursors[[2]string{m.ConversationID, userID}]) {
+					unread++
+				}
+			}
+
+			result.rows = append(result.rows, append(f.row(m), otherID, otherID, unread))
+		}
+
+		return result
+	})
+
+	return f
+}
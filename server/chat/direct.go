@@ -0,0 +1,97 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// userEvent is sent to every connection of some users, whatever room they
+// joined, on every instance.
+type userEvent struct {
+	Origin		string		`json:"origin"`
+	UserIDs		[]string	`json:"user_ids"`
+	Envelope	Envelope	`json:"envelope"`
+}
+
+const usersTopic = "users"
+
+// sendDirect persists a direct message and delivers it to every connection of
+// both participants, so the sender's other tabs see it too.
+func (m *hubManager) sendDirect(sender *utils.AuthorizedUserInfo, recipientID string, content string) (*DirectMessage, error) {
+	if err := validateContent(content); err != nil {
+		return nil, err
+	}
+
+	if err := m.limits.get(sender.ID).allow(content); err != nil {
+		return nil, err
+	}
+
+	message, err := m.chatService.sendDirect(sender, recipientID, content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.deliverToUsers([]string{message.SenderID, message.RecipientID}, newEnvelope(TypeDirectMessage, message))
+
+	return message, nil
+}
+
+// markDirectRead moves the reader's cursor and tells both participants, so
+// the sender can show the message as seen.
+func (m *hubManager) markDirectRead(userID string, otherID string, messageID string) (*DirectReadCursor, error) {
+	cursor, err := m.chatService.markDirectRead(userID, otherID, messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.deliverToUsers([]string{userID, otherID}, newEnvelope(TypeDirectRead, cursor))
+
+	return cursor, nil
+}
+
+func (m *hubManager) deliverToUsers(userIDs []string, event Envelope) {
+	m.deliverToLocalUsers(userIDs, event)
+	m.publish(usersTopic, userEvent{Origin: m.instanceID, UserIDs: userIDs, Envelope: event})
+}
+
+// deliverToLocalUsers asks every running hub to pass event to the clients of
+// userIDs. Hubs own their clients' channels, so delivery goes through them.
+func (m *hubManager) deliverToLocalUsers(userIDs []string, event Envelope) {
+	// A hub that stopped has no clients to deliver to
+	for _, hub := range m.runningHubs("") {
+		select {
+			case hub.users <- userEvent{UserIDs: userIDs, Envelope: event}:
+			case <-hub.done:
+		}
+	}
+}
+
+func (m *hubManager) subscribeUsers() func() {
+	return m.broker.Subscribe(usersTopic, func(payload []byte) {
+		var event userEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			log.Printf("invalid user event: %v", err)
+			return
+		}
+
+		if event.Origin != m.instanceID {
+			m.deliverToLocalUsers(event.UserIDs, event.Envelope)
+		}
+	})
+}
+
+func (h *ChatHub) deliverToUsers(event userEvent) {
+	for client := range h.clients {
+		for _, userID := range event.UserIDs {
+			if client.user.ID == userID {
+				h.deliver(client, event.Envelope)
+				break
+			}
+		}
+	}
+}
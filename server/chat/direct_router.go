@@ -0,0 +1,120 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+func listConversations(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := utils.GetQueryInt(r, "limit", 20)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid limit", 400, err)
+			return
+		}
+
+		offset, err := utils.GetQueryInt(r, "offset", 0)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid offset", 400, err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		conversations, err := s.listConversations(claims.ID, limit, offset)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get conversations", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get conversations successfully",
+			"data": conversations,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listDirectMessages(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := utils.GetQueryInt(r, "limit", defaultMessagesLimit)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid limit", 400, err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		page, err := s.listDirectMessages(claims.ID, chi.URLParam(r, "userID"), r.URL.Query().Get("before"), limit)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get direct messages", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get direct messages successfully",
+			"data": page,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func sendDirectMessage(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload SendDirectPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		message, err := m.sendDirect(claims, chi.URLParam(r, "userID"), payload.Content)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to send direct message", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Send direct message successfully",
+			"data": *message,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func markDirectRead(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload ReadDirectPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		cursor, err := m.markDirectRead(claims.ID, chi.URLParam(r, "userID"), payload.MessageID)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to mark conversation read", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Mark conversation read successfully",
+			"data": *cursor,
+		})
+
+		w.Write(resp)
+	})
+}
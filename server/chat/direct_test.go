@@ -0,0 +1,365 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+func testUsers() map[string]bool {
+	return map[string]bool{"alice": true, "bob": true, "carol": true, "deleted": false}
+}
+
+func TestDirectDelivery(t *testing.T) {
+	const otherRoomID = "44444444-4444-4444-4444-444444444444"
+
+	tests := []struct {
+		name			string
+		recipientID		string
+		content			string
+		wantErr			error
+		wantDelivered	[]string
+	}{
+		{
+			name: "every connection of both participants",
+			recipientID: "bob",
+			content: "hi bob",
+			wantDelivered: []string{"alice", "alice in another room", "bob", "bob on another instance"},
+		},
+		{name: "to yourself", recipientID: "alice", content: "hi me", wantErr: ErrDirectToSelf, wantDelivered: []string{}},
+		{name: "missing recipient", recipientID: "", content: "hi", wantErr: ErrUserIDRequired, wantDelivered: []string{}},
+		{name: "unknown recipient", recipientID: "nobody", content: "hi", wantErr: ErrUserNotFound, wantDelivered: []string{}},
+		{name: "deleted recipient", recipientID: "deleted", content: "hi", wantErr: ErrUserNotFound, wantDelivered: []string{}},
+		{name: "empty content", recipientID: "bob", content: " ", wantErr: ErrContentRequired, wantDelivered: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onDirect(db, testUsers())
+			broker := NewMemoryBroker()
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, broker)
+			remote := newTestManager(t, PolicyDropOldest, broker)
+
+			connections := map[string]*ChatClient{
+				"alice": joinStalled(t, m, testRoomID, "alice"),
+				"alice in another room": joinStalledAs(t, m, otherRoomID, &utils.AuthorizedUserInfo{ID: "alice", Username: "alice", SessionID: "session-alice-2"}),
+				"bob": joinStalled(t, m, testRoomID, "bob"),
+				"carol": joinStalled(t, m, otherRoomID, "carol"),
+				"bob on another instance": joinStalled(t, remote, testRoomID, "bob"),
+				"carol on another instance": joinStalled(t, remote, testRoomID, "carol"),
+			}
+
+			sender := &utils.AuthorizedUserInfo{ID: "alice", Username: "alice", SessionID: "session-alice"}
+			_, err := m.sendDirect(sender, tt.recipientID, tt.content)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			received := map[string][]DirectMessage{}
+
+			// The other instance gets it through the broker
+			if err == nil {
+				var message DirectMessage
+				json.Unmarshal(nextEvent(t, connections["bob on another instance"], TypeDirectMessage).Payload, &message)
+				received["bob on another instance"] = append(received["bob on another instance"], message)
+			}
+
+			settle(t, runningHub(t, m, testRoomID))
+			settle(t, runningHub(t, m, otherRoomID))
+			settle(t, runningHub(t, remote, testRoomID))
+
+			for name, client := range connections {
+				for len(client.message) > 0 {
+					if event := <-client.message; event.Type == TypeDirectMessage {
+						var message DirectMessage
+						json.Unmarshal(event.Payload, &message)
+						received[name] = append(received[name], message)
+					}
+				}
+			}
+
+			delivered := []string{}
+
+			for _, name := range []string{"alice", "alice in another room", "bob", "carol", "bob on another instance", "carol on another instance"} {
+				if len(received[name]) == 0 {
+					continue
+				}
+
+				delivered = append(delivered, name)
+				message := received[name][0]
+
+				if len(received[name]) != 1 || message.SenderID != "alice" || message.RecipientID != tt.recipientID || message.Content != tt.content {
+					t.Errorf("%s got %+v", name, received[name])
+				}
+			}
+
+			if !reflect.DeepEqual(delivered, tt.wantDelivered) {
+				t.Errorf("got delivered to %v, want %v", delivered, tt.wantDelivered)
+			}
+		})
+	}
+}
+
+func TestConversations(t *testing.T) {
+	const (
+		opSend	= "send"
+		opRead	= "read"
+	)
+
+	// A read marks everything up to the message sent by step message as read
+	type step struct {
+		op		string
+		userID	string
+		otherID	string
+		message	int
+	}
+
+	type conversation struct {
+		userID	string
+		unread	int
+	}
+
+	tests := []struct {
+		name		string
+		steps		[]step
+		userID		string
+		limit		int
+		offset		int
+		want		[]conversation
+		wantLimit	int64
+	}{
+		{
+			name: "unread counts messages from the other user",
+			steps: []step{{op: opSend, userID: "alice", otherID: "bob"}, {op: opSend, userID: "bob", otherID: "alice"}, {op: opSend, userID: "bob", otherID: "alice"}},
+			userID: "alice",
+			want: []conversation{{userID: "bob", unread: 2}},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "seen from the other side",
+			steps: []step{{op: opSend, userID: "alice", otherID: "bob"}, {op: opSend, userID: "bob", otherID: "alice"}},
+			userID: "bob",
+			want: []conversation{{userID: "alice", unread: 1}},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "reading clears unread",
+			steps: []step{{op: opSend, userID: "bob", otherID: "alice"}, {op: opSend, userID: "bob", otherID: "alice"}, {op: opRead, userID: "alice", otherID: "bob", message: 1}},
+			userID: "alice",
+			want: []conversation{{userID: "bob", unread: 0}},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "reading an older message keeps the cursor",
+			steps: []step{
+				{op: opSend, userID: "bob", otherID: "alice"},
+				{op: opSend, userID: "bob", otherID: "alice"},
+				{op: opRead, userID: "alice", otherID: "bob", message: 1},
+				{op: opRead, userID: "alice", otherID: "bob", message: 0},
+			},
+			userID: "alice",
+			want: []conversation{{userID: "bob", unread: 0}},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "most recently active first",
+			steps: []step{{op: opSend, userID: "alice", otherID: "bob"}, {op: opSend, userID: "carol", otherID: "alice"}},
+			userID: "alice",
+			want: []conversation{{userID: "carol", unread: 1}, {userID: "bob", unread: 0}},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "other users' conversations are not listed",
+			steps: []step{{op: opSend, userID: "bob", otherID: "carol"}},
+			userID: "alice",
+			want: []conversation{},
+			wantLimit: defaultMessagesLimit,
+		},
+		{
+			name: "limit and offset",
+			steps: []step{{op: opSend, userID: "alice", otherID: "bob"}, {op: opSend, userID: "carol", otherID: "alice"}},
+			userID: "alice",
+			limit: 1,
+			offset: 1,
+			want: []conversation{{userID: "bob", unread: 0}},
+			wantLimit: 1,
+		},
+		{
+			name: "limit above the maximum",
+			userID: "alice",
+			limit: 1000,
+			offset: -5,
+			want: []conversation{},
+			wantLimit: maxMessagesLimit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			direct := onDirect(db, testUsers())
+
+			var sent []*DirectMessage
+
+			for i, st := range tt.steps {
+				// Keeps created_at strictly increasing
+				time.Sleep(time.Millisecond)
+
+				switch st.op {
+					case opSend:
+						message, err := s.sendDirect(&utils.AuthorizedUserInfo{ID: st.userID, Username: st.userID}, st.otherID, "hello")
+
+						if err != nil {
+							t.Fatalf("step %d: failed to send: %v", i, err)
+						}
+
+						sent = append(sent, message)
+
+					case opRead:
+						if _, err := s.markDirectRead(st.userID, st.otherID, sent[st.message].ID); err != nil {
+							t.Fatalf("step %d: failed to read: %v", i, err)
+						}
+				}
+			}
+
+			conversations, err := s.listConversations(tt.userID, tt.limit, tt.offset)
+
+			if err != nil {
+				t.Fatalf("failed to list conversations: %v", err)
+			}
+
+			got := []conversation{}
+
+			for _, c := range conversations {
+				got = append(got, conversation{userID: c.UserID, unread: c.Unread})
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+
+			if len(direct.limits) != 1 || direct.limits[0] != tt.wantLimit {
+				t.Errorf("got limits %v, want %d", direct.limits, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestMarkDirectReadErrors(t *testing.T) {
+	tests := []struct {
+		name		string
+		otherID		string
+		messageID	func(sent map[string]string) string
+		wantErr		error
+	}{
+		{name: "message of the conversation", otherID: "bob", messageID: func(sent map[string]string) string { return sent["bob"] }},
+		{name: "missing message id", otherID: "bob", messageID: func(map[string]string) string { return "" }, wantErr: ErrMessageIDRequired},
+		{name: "no conversation", otherID: "deleted", messageID: func(sent map[string]string) string { return sent["bob"] }, wantErr: ErrConversationNotFound},
+		{name: "message of another conversation", otherID: "bob", messageID: func(sent map[string]string) string { return sent["carol"] }, wantErr: ErrMessageNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			onDirect(db, testUsers())
+
+			sent := map[string]string{}
+
+			for _, userID := range []string{"bob", "carol"} {
+				message, err := s.sendDirect(&utils.AuthorizedUserInfo{ID: userID, Username: userID}, "alice", "hello")
+
+				if err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+
+				sent[userID] = message.ID
+			}
+
+			if _, err := s.markDirectRead("alice", tt.otherID, tt.messageID(sent)); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListDirectMessages(t *testing.T) {
+	tests := []struct {
+		name		string
+		otherID		string
+		before		func(first *DirectMessagePage) string
+		limit		int
+		want		[]int
+		wantMore	bool
+		wantErr		error
+	}{
+		{name: "newest first", otherID: "bob", want: []int{2, 1, 0}},
+		{name: "first page", otherID: "bob", limit: 2, want: []int{2, 1}, wantMore: true},
+		{name: "next page", otherID: "bob", limit: 2, before: func(first *DirectMessagePage) string { return first.NextCursor }, want: []int{0}},
+		{name: "no conversation", otherID: "carol", wantErr: ErrConversationNotFound},
+		{name: "invalid cursor", otherID: "bob", before: func(*DirectMessagePage) string { return "nope" }, wantErr: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			onDirect(db, testUsers())
+
+			var ids []string
+
+			for i, pair := range [][2]string{{"alice", "bob"}, {"bob", "alice"}, {"alice", "bob"}} {
+				time.Sleep(time.Millisecond)
+
+				message, err := s.sendDirect(&utils.AuthorizedUserInfo{ID: pair[0], Username: pair[0]}, pair[1], "hello")
+
+				if err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+
+				ids = append(ids, message.ID)
+			}
+
+			var before string
+
+			if tt.before != nil {
+				first, _ := s.listDirectMessages("alice", "bob", "", tt.limit)
+				before = tt.before(first)
+			}
+
+			page, err := s.listDirectMessages("alice", tt.otherID, before, tt.limit)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			got := []string{}
+
+			for _, message := range page.Messages {
+				got = append(got, message.ID)
+			}
+
+			want := []string{}
+
+			for _, i := range tt.want {
+				want = append(want, ids[i])
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got messages %v, want %v", got, want)
+			}
+
+			if page.HasMore != tt.wantMore {
+				t.Errorf("got has_more %v, want %v", page.HasMore, tt.wantMore)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package chat
+
+// Authors edit and delete their own messages through these, from the socket
+// or the REST API. message may come from a hub's recent messages, so changes
+// to messages not yet persisted work too.
+
+func (m *hubManager) editMessage(message *ChatMessage, userID string, content string) (*ChatMessage, error) {
+	edited, err := m.chatService.editMessage(message, userID, content)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.fanOutRoom(edited.RoomID, newEnvelope(TypeMessageEdited, MessageEditedEvent{
+		ID: edited.ID,
+		RoomID: edited.RoomID,
+		Content: edited.Content,
+		EditedAt: *edited.EditedAt,
+	}))
+
+	return edited, nil
+}
+
+func (m *hubManager) deleteOwnMessage(message *ChatMessage, userID string) error {
+	if err := m.chatService.deleteOwnMessage(message, userID); err != nil {
+		return err
+	}
+
+	m.fanOutRoom(message.RoomID, newEnvelope(TypeMessageDeleted, MessageDeletedEvent{ID: message.ID, RoomID: message.RoomID}))
+
+	return nil
+}
+
+// fanOutRoom sends an event to every client of roomID, on every instance.
+func (m *hubManager) fanOutRoom(roomID string, event Envelope) {
+	// The hub passes it on to the other instances itself
+	for _, hub := range m.runningHubs(roomID) {
+		select {
+			case hub.roomEvents <- event:
+				return
+			case <-hub.done:
+		}
+	}
+
+	m.publishRoom(roomID, roomEvent{Kind: roomEventFanOut, Envelope: &event})
+}
@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAuthorEdits(t *testing.T) {
+	// Older than the edit window of the test config
+	const oldMessageID = "77777777-7777-7777-7777-777777777777"
+
+	const (
+		opEdit		= "edit"
+		opDelete	= "delete"
+	)
+
+	type step struct {
+		userID	string
+		op		string
+		old		bool
+		content	string
+		wantErr	error
+	}
+
+	tests := []struct {
+		name			string
+		steps			[]step
+		wantEvents		[]string
+		wantContent		string
+		wantHistory		[]string
+		wantDeleted		bool
+	}{
+		{
+			name: "author edits",
+			steps: []step{{userID: "alice", op: opEdit, content: "hello!"}},
+			wantEvents: []string{TypeMessageEdited},
+			wantContent: "hello!",
+			wantHistory: []string{"hello"},
+		},
+		{
+			name: "history keeps every version",
+			steps: []step{{userID: "alice", op: opEdit, content: "hello!"}, {userID: "alice", op: opEdit, content: "hello!!"}},
+			wantEvents: []string{TypeMessageEdited, TypeMessageEdited},
+			wantContent: "hello!!",
+			wantHistory: []string{"hello", "hello!"},
+		},
+		{
+			name: "someone else edits",
+			steps: []step{{userID: "bob", op: opEdit, content: "mine now", wantErr: ErrNotAuthor}},
+			wantEvents: []string{},
+			wantContent: "hello",
+			wantHistory: []string{},
+		},
+		{
+			name: "empty content",
+			steps: []step{{userID: "alice", op: opEdit, content: "  ", wantErr: ErrContentRequired}},
+			wantEvents: []string{},
+			wantContent: "hello",
+			wantHistory: []string{},
+		},
+		{
+			name: "edit window expired",
+			steps: []step{{userID: "alice", op: opEdit, old: true, content: "too late", wantErr: ErrEditWindowExpired}},
+			wantEvents: []string{},
+			wantContent: "hello",
+			wantHistory: []string{},
+		},
+		{
+			name: "author deletes",
+			steps: []step{{userID: "alice", op: opDelete}},
+			wantEvents: []string{TypeMessageDeleted},
+			wantDeleted: true,
+		},
+		{
+			name: "someone else deletes",
+			steps: []step{{userID: "bob", op: opDelete, wantErr: ErrNotAuthor}},
+			wantEvents: []string{},
+			wantContent: "hello",
+			wantHistory: []string{},
+		},
+		{
+			name: "delete after the edit window",
+			steps: []step{{userID: "alice", op: opDelete, old: true, wantErr: ErrEditWindowExpired}},
+			wantEvents: []string{},
+			wantContent: "hello",
+			wantHistory: []string{},
+		},
+		{
+			name: "edit after delete",
+			steps: []step{{userID: "alice", op: opDelete}, {userID: "alice", op: opEdit, content: "back", wantErr: ErrMessageNotFound}},
+			wantEvents: []string{TypeMessageDeleted},
+			wantDeleted: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			messages := onMessages(db)
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+
+			messages.add(ChatMessage{ID: oldMessageID, RoomID: testRoomID, UserID: "alice", Content: "hello", CreatedAt: time.Now().Add(-2 * time.Minute)})
+
+			clients := map[string]*ChatClient{
+				"alice": joinStalled(t, m, testRoomID, "alice"),
+				"bob": joinStalled(t, m, testRoomID, "bob"),
+			}
+
+			fresh := send(t, clients["alice"], "hello")
+			observer := joinStalled(t, m, testRoomID, "observer")
+			hub := runningHub(t, m, testRoomID)
+
+			target := fresh
+
+			for i, st := range tt.steps {
+				messageID := fresh
+
+				if st.old {
+					messageID = oldMessageID
+				}
+
+				target = messageID
+				frameType := TypeMessageEdit
+
+				if st.op == opDelete {
+					frameType = TypeMessageDelete
+				}
+
+				err := clients[st.userID].handle(frame(t, frameType, "change", MessageEditPayload{MessageID: messageID, Content: st.content}))
+
+				if !errors.Is(err, st.wantErr) {
+					t.Fatalf("step %d: got %v, want %v", i, err, st.wantErr)
+				}
+
+				settle(t, hub)
+			}
+
+			events := []string{}
+			var content string
+
+			for len(observer.message) > 0 {
+				event := <-observer.message
+
+				switch event.Type {
+					case TypeMessageEdited:
+						var payload MessageEditedEvent
+						json.Unmarshal(event.Payload, &payload)
+
+						if payload.ID != target || payload.EditedAt.IsZero() {
+							t.Errorf("got edit event %+v for %q", payload, target)
+						}
+
+						content = payload.Content
+
+					case TypeMessageDeleted:
+						var payload MessageDeletedEvent
+						json.Unmarshal(event.Payload, &payload)
+
+						if payload.ID != target || payload.RoomID != testRoomID {
+							t.Errorf("got delete event %+v for %q", payload, target)
+						}
+
+					default:
+						continue
+				}
+
+				events = append(events, event.Type)
+			}
+
+			if !reflect.DeepEqual(events, tt.wantEvents) {
+				t.Errorf("got events %v, want %v", events, tt.wantEvents)
+			}
+
+			if len(events) > 0 && events[len(events) - 1] == TypeMessageEdited && content != tt.wantContent {
+				t.Errorf("got broadcast content %q, want %q", content, tt.wantContent)
+			}
+
+			if got := messages.isDeleted(target); got != tt.wantDeleted {
+				t.Errorf("got deleted %v, want %v", got, tt.wantDeleted)
+			}
+
+			if tt.wantDeleted {
+				return
+			}
+
+			stored, err := m.chatService.getRoomMessage(target, testRoomID)
+
+			if err == nil && stored.Content != tt.wantContent {
+				t.Errorf("got stored content %q, want %q", stored.Content, tt.wantContent)
+			}
+
+			edits, err := m.chatService.listMessageEdits(target)
+
+			if err != nil && !errors.Is(err, ErrMessageNotFound) {
+				t.Fatalf("failed to list edits: %v", err)
+			}
+
+			history := []string{}
+
+			for _, edit := range edits {
+				if edit.EditedBy != "alice" {
+					t.Errorf("got edit by %q, want alice", edit.EditedBy)
+				}
+
+				history = append(history, edit.PreviousContent)
+			}
+
+			if !reflect.DeepEqual(history, tt.wantHistory) {
+				t.Errorf("got history %v, want %v", history, tt.wantHistory)
+			}
+		})
+	}
+}
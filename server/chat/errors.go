@@ -0,0 +1,46 @@
+package chat
+
+import (
+	"errors"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+var (
+	ErrRoomNotFound			= utils.NotFound("room_not_found", "room not found")
+	ErrRoomNameExists		= utils.Conflict("room_name_exists", "room name exists")
+	ErrRoomNameRequired		= utils.Validation("room_name_required", "room name is required")
+	ErrRoomHasClients		= utils.Conflict("room_has_clients", "room has connected clients")
+	ErrDefaultRoomDelete	= utils.Validation("default_room_undeletable", "default room cannot be deleted")
+	ErrInvalidCursor		= utils.Validation("invalid_cursor", "invalid cursor")
+	ErrCursorDirection		= utils.Validation("invalid_cursor_direction", "before and after cannot be used together")
+	ErrSessionRevoked		= utils.Unauthorized("session_revoked", "session revoked")
+	ErrMissingToken			= utils.Unauthorized("missing_token", "missing token")
+	ErrInvalidTicket		= utils.Unauthorized("invalid_ticket", "ticket is invalid, expired or already used")
+	ErrMessageNotFound		= utils.NotFound("message_not_found", "message not found")
+	ErrSanctionNotFound		= utils.NotFound("sanction_not_found", "no such mute or ban")
+	ErrBannedFromRoom		= utils.Forbidden("banned_from_room", "you are banned from this room")
+	ErrMuted				= utils.Forbidden("muted", "you are muted in this room")
+	ErrNotModerator			= utils.Forbidden("insufficient_role", "requires role moderator")
+	ErrTargetOutranks		= utils.Forbidden("target_outranks", "cannot moderate a user with an equal or higher role")
+	ErrInvalidMuteDuration	= utils.Validation("invalid_duration", "minutes must be between 1 and 10080")
+	ErrInvalidBanDuration	= utils.Validation("invalid_duration", "minutes must be between 0 and 525600")
+	ErrMessageIDRequired	= utils.Validation("message_id_required", "message_id is required")
+	ErrUserIDRequired		= utils.Validation("user_id_required", "user_id is required")
+	ErrUserNotFound			= utils.NotFound("user_not_found", "user not found")
+	ErrDirectToSelf			= utils.Validation("direct_to_self", "cannot send a direct message to yourself")
+	ErrConversationNotFound	= utils.NotFound("conversation_not_found", "conversation not found")
+	ErrUnknownType			= utils.Validation("unknown_type", "unknown message type")
+	ErrInvalidFrame			= utils.Validation("invalid_frame", "invalid frame")
+	ErrUnsupportedVersion	= utils.Validation("unsupported_version", "unsupported protocol version")
+	ErrContentRequired		= utils.Validation("content_required", "content is required")
+	ErrNotAuthor			= utils.Forbidden("not_author", "only the author can change this message")
+	ErrEditWindowExpired	= utils.Forbidden("edit_window_expired", "message can no longer be changed")
+	ErrInvalidEmoji			= utils.Validation("invalid_emoji", "emoji must be 1 to 32 bytes without spaces")
+	ErrMessageTooLong		= utils.Validation("message_too_long", "message exceeds 4000 characters")
+	ErrDuplicateMessage		= utils.Conflict("duplicate_message", "same message sent again too soon")
+	ErrRateLimited			= utils.TooManyRequests("rate_limited", "too many messages, slow down")
+)
+
+// ErrShuttingDown is returned when a client joins while the server stops.
+var ErrShuttingDown = errors.New("server is shutting down")
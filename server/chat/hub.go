@@ -3,73 +3,375 @@ package chat
 import (
 	"log"
 	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	actionDelete	= "delete"
+	actionMute		= "mute"
+	actionUnmute	= "unmute"
+	actionKick		= "kick"
+	actionBan		= "ban"
 )
 
+// moderationAction is applied by the hub after it has been persisted. It is
+// also sent to the other instances, hence the exported fields.
+type moderationAction struct {
+	Kind		string		`json:"kind"`
+	UserID		string		`json:"user_id,omitempty"`
+	MessageID	string		`json:"message_id,omitempty"`
+	Until		*time.Time	`json:"until,omitempty"`
+}
+
+// directEvent is delivered to a single client through the hub, which owns
+// closing client channels.
+type directEvent struct {
+	client	*ChatClient
+	event	Envelope
+}
+
+// inboundMessage is a chat.send accepted by a client's readPump. Key is the
+// client frame id used to drop retried sends.
+type inboundMessage struct {
+	client	*ChatClient
+	key		string
+	message	ChatMessage
+}
+
+// How long and how many chat.send ids each hub remembers for deduplication
+const (
+	idempotencyWindow	= 5 * time.Minute
+	idempotencyMaxKeys	= 4096
+)
+
+type sentKey struct {
+	messageID	string
+	at			time.Time
+}
+
+// recentMessages is how many message creation times each hub remembers.
+const recentMessages = 512
+
+// hubTimings are the presence and typing delays of a hub, taken from its hub
+// manager so tests can shorten them.
+type hubTimings struct {
+	presenceDebounce	time.Duration
+	typingInterval		time.Duration
+	typingTimeout		time.Duration
+}
+
+var defaultHubTimings = hubTimings{
+	presenceDebounce: presenceDebounce,
+	typingInterval: typingInterval,
+	typingTimeout: typingTimeout,
+}
+
+type messageLookup struct {
+	messageID	string
+	reply		chan *ChatMessage
+}
+
 type ChatHub struct {
+	roomID			string
+	manager			*hubManager
+	policy			SlowConsumerPolicy
+
+	// Number of clients holding this hub, guarded by manager.mu
+	refs			int
+
+	// Stops broker delivery, guarded by manager.mu
+	unsubscribe		func()
+
+	// Events from the same room on other instances
+	remote			chan roomEvent
+
 	clients    		map[*ChatClient]bool
 	register   		chan *ChatClient
 	unregister 		chan *ChatClient
 
-	broadcast  		chan IncomingMessage
+	broadcast  		chan inboundMessage
+	revoke			chan string
+	moderation		chan moderationAction
+	direct			chan directEvent
+
+	// Events for everyone in the room
+	roomEvents		chan Envelope
 
-	// Worker queues (separate channels)
-	dbQueue   		chan IncomingMessage
+	// Events for the connections of some users, such as direct messages
+	users			chan userEvent
+
+	typing			map[string]*typingEntry
+	typingSignals	chan typingSignal
+	typingExpired	chan *typingEntry
+
+	// The latest messages, so replies, reactions, reads and edits of
+	// messages not yet persisted can be resolved. Owned by run.
+	recent			map[string]ChatMessage
+	recentIDs		[]string
+	recentLookup	chan messageLookup
+
+	// Muted user ids and when their mute ends, owned by run
+	mutes			map[string]time.Time
+
+	// Recently accepted chat.send ids by user, owned by run
+	sent			map[string]sentKey
+
+	// Online users, owned by run. remoteOnline holds the users online on
+	// other instances, by instance id.
+	online			map[string]*presenceEntry
+	remoteOnline	map[string]map[string]string
+	offline			chan string
+	presenceQuery	chan chan []PresenceUser
+
+	// Closes every client when the server shuts down
+	shutdown		chan struct{}
+
+	done			chan struct{}
 }
 
-func newHub(dbWorkers int) *ChatHub {
-	h := &ChatHub{
+func newHub(roomID string, manager *hubManager) *ChatHub {
+	return &ChatHub{
+		roomID:			roomID,
+		manager:		manager,
+		policy:			manager.chatService.Config.SlowConsumerPolicy,
 		clients:    	make(map[*ChatClient]bool),
 		register:   	make(chan *ChatClient),
 		unregister: 	make(chan *ChatClient),
-		broadcast:  	make(chan IncomingMessage),
-		dbQueue:    	make(chan IncomingMessage),
-	}
-
-	// Start separate worker pools
-	for i := 0; i < dbWorkers; i++ {
-		go h.dbWorker(i)
+		broadcast:  	make(chan inboundMessage),
+		remote:			make(chan roomEvent),
+		revoke:			make(chan string),
+		moderation:		make(chan moderationAction),
+		direct:			make(chan directEvent),
+		roomEvents:		make(chan Envelope),
+		users:			make(chan userEvent),
+		typing:			make(map[string]*typingEntry),
+		typingSignals:	make(chan typingSignal),
+		typingExpired:	make(chan *typingEntry),
+		recent:			make(map[string]ChatMessage),
+		recentLookup:	make(chan messageLookup),
+		mutes:			make(map[string]time.Time),
+		sent:			make(map[string]sentKey),
+		online:			make(map[string]*presenceEntry),
+		remoteOnline:	make(map[string]map[string]string),
+		offline:		make(chan string),
+		presenceQuery:	make(chan chan []PresenceUser),
+		shutdown:		make(chan struct{}),
+		done:			make(chan struct{}),
 	}
-
-	return h
 }
 
 func (h *ChatHub) run() {
+	mutes, err := h.manager.chatService.activeMutes(h.roomID)
+
+	if err != nil {
+		log.Printf("failed to load mutes for room %s: %v", h.roomID, err)
+	} else {
+		h.mutes = mutes
+	}
+
 	for {
 		select {
+			case <-h.done:
+				h.leaveAll()
+				return
+
+			case event := <-h.remote:
+				h.receive(event)
+
 			case client := <-h.register:
 				h.clients[client] = true
+				h.userJoined(client)
 
 			case client := <-h.unregister:
 				if _, ok := h.clients[client]; ok {
-					delete(h.clients, client)
-					close(client.message)
-					client.conn.Close()
+					h.remove(client, websocket.CloseNormalClosure, "")
+				}
+
+			case <-h.shutdown:
+				for client := range h.clients {
+					h.remove(client, websocket.CloseGoingAway, "server shutting down")
 				}
 
-			case message := <-h.broadcast:
+			case userID := <-h.offline:
+				h.userOffline(userID)
+
+			case reply := <-h.presenceQuery:
+				reply <- h.onlineUsers()
+
+			case sessionID := <-h.revoke:
 				for client := range h.clients {
-					select {
-						case client.message <- message:
-						default:
-							close(client.message)
-							delete(h.clients, client)
+					if client.user.SessionID == sessionID {
+						h.disconnect(client, "session revoked")
 					}
 				}
 
-				// // Send to each specialized worker pool
-				// select {
-				// 	case h.dbQueue <- message:
-				// 	default:
-				// 		log.Println("⚠️ DB queue full, dropping message")
-				// }
+			case action := <-h.moderation:
+				h.applyModeration(action)
+
+			case d := <-h.direct:
+				h.reply(d.client, d.event)
+
+			case event := <-h.roomEvents:
+				h.fanOutRoom(event, "")
+
+			case event := <-h.users:
+				h.deliverToUsers(event)
+
+			case signal := <-h.typingSignals:
+				if h.clients[signal.client] {
+					h.handleTyping(signal)
+				}
+
+			case entry := <-h.typingExpired:
+				h.typingTimedOut(entry)
+
+			case lookup := <-h.recentLookup:
+				if message, ok := h.recent[lookup.messageID]; ok {
+					lookup.reply <- &message
+				} else {
+					lookup.reply <- nil
+				}
+
+			case in := <-h.broadcast:
+				h.accept(in)
 		}
 	}
 }
 
-func (h *ChatHub) dbWorker(id int) {
-	for msg := range h.dbQueue {
-		// Simulate DB insert
-		log.Printf("[DB Worker %d] Saving to DB: %s\n", id, msg)
-		time.Sleep(500 * time.Millisecond)
+func (h *ChatHub) accept(in inboundMessage) {
+	message := in.message
+
+	// Mutes are enforced here so every path into the room is covered
+	if until, ok := h.mutes[message.UserID]; ok {
+		if time.Now().Before(until) {
+			h.reply(in.client, errorEnvelope(in.key, ErrMuted))
+			return
+		}
+		delete(h.mutes, message.UserID)
+	}
+
+	key := message.UserID + "|" + in.key
+
+	// Retries are acked again before rate limiting, so they neither spend
+	// tokens nor count as duplicate content
+	if in.key != "" {
+		if sent, ok := h.sent[key]; ok && time.Since(sent.at) < idempotencyWindow {
+			h.reply(in.client, ackEnvelope(AckPayload{Ref: in.key, MessageID: sent.messageID, Duplicate: true}))
+			return
+		}
+	}
+
+	if err := h.manager.limits.get(message.UserID).allow(message.Content); err != nil {
+		h.reply(in.client, errorEnvelope(in.key, err))
+		return
+	}
+
+	if in.key != "" {
+		h.rememberSent(key, message.ID)
+	}
+
+	h.stopTyping(message.UserID)
+	h.rememberRecent(message)
+	event := newEnvelope(TypeChatMessage, message)
+	h.fanOut(event)
+	h.manager.publishRoom(h.roomID, roomEvent{Kind: roomEventMessage, Message: &message})
+	h.reply(in.client, ackEnvelope(AckPayload{Ref: in.key, MessageID: message.ID}))
+
+	// Send to each specialized worker pool
+	h.manager.persister.enqueue(message)
+}
+
+func (h *ChatHub) rememberRecent(message ChatMessage) {
+	if len(h.recentIDs) >= recentMessages {
+		delete(h.recent, h.recentIDs[0])
+		h.recentIDs = h.recentIDs[1:]
+	}
+
+	h.recent[message.ID] = message
+	h.recentIDs = append(h.recentIDs, message.ID)
+}
+
+func (h *ChatHub) rememberSent(key string, messageID string) {
+	if len(h.sent) >= idempotencyMaxKeys {
+		for k, sent := range h.sent {
+			if time.Since(sent.at) >= idempotencyWindow {
+				delete(h.sent, k)
+			}
+		}
 	}
+
+	// Still full of live keys, forget an arbitrary one
+	if len(h.sent) >= idempotencyMaxKeys {
+		for k := range h.sent {
+			delete(h.sent, k)
+			break
+		}
+	}
+
+	h.sent[key] = sentKey{messageID: messageID, at: time.Now()}
+}
+
+func (h *ChatHub) applyModeration(action moderationAction) {
+	switch action.Kind {
+		case actionDelete:
+			h.fanOut(newEnvelope(TypeMessageDeleted, MessageDeletedEvent{ID: action.MessageID, RoomID: h.roomID}))
+
+		case actionMute:
+			if action.Until == nil {
+				return
+			}
+			h.mutes[action.UserID] = *action.Until
+			h.fanOut(systemEnvelope(SystemPayload{Event: "user.muted", RoomID: h.roomID, UserID: action.UserID, Until: action.Until}))
+
+		case actionUnmute:
+			delete(h.mutes, action.UserID)
+			h.fanOut(systemEnvelope(SystemPayload{Event: "user.unmuted", RoomID: h.roomID, UserID: action.UserID}))
+
+		case actionKick, actionBan:
+			eventType, reason := "user.kicked", "kicked"
+
+			if action.Kind == actionBan {
+				eventType, reason = "user.banned", "banned"
+			}
+
+			for client := range h.clients {
+				if client.user.ID == action.UserID {
+					h.disconnect(client, reason)
+				}
+			}
+
+			h.fanOut(systemEnvelope(SystemPayload{Event: eventType, RoomID: h.roomID, UserID: action.UserID, Until: action.Until}))
+	}
+}
+
+func (h *ChatHub) fanOut(event Envelope) {
+	for client := range h.clients {
+		h.deliver(client, event)
+	}
+}
+
+// reply delivers an event to a client that may have left in the meantime.
+func (h *ChatHub) reply(client *ChatClient, event Envelope) {
+	if h.clients[client] {
+		h.deliver(client, event)
+	}
+}
+
+// remove forgets a client and closes its message channel. Its writePump
+// then flushes what is queued, sends a close frame with code and reason and
+// closes the connection. Only called for clients still in h.clients, so the
+// channel is closed once.
+func (h *ChatHub) remove(client *ChatClient, code int, reason string) {
+	delete(h.clients, client)
+	client.closeCode = code
+	client.closeReason = reason
+	close(client.message)
+	h.userLeft(client)
+}
+
+// disconnect removes a client with a policy violation close frame carrying
+// reason.
+func (h *ChatHub) disconnect(client *ChatClient, reason string) {
+	h.remove(client, websocket.ClosePolicyViolation, reason)
 }
@@ -0,0 +1,243 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// hubManager owns one ChatHub per room. Hubs are created when the first
+// client joins a room and stopped once the last one leaves.
+type hubManager struct {
+	mu			sync.Mutex
+	hubs		map[string]*ChatHub
+	chatService	*ChatService
+	persister	*messagePersister
+	stats		fanOutStats
+	limits		*userLimits
+	timeouts	clientTimeouts
+	timings		hubTimings
+
+	// Events from other instances are told apart by instanceID
+	broker		Broker
+	instanceID	string
+	unsubscribe	func()
+
+	// Set once shutdown starts; no new hubs or clients are accepted
+	closing		bool
+
+	// Rooms being deleted, or deleted, which no client may join
+	deleting	map[string]bool
+
+	// Running hubs, waited on by shutdown
+	running		sync.WaitGroup
+}
+
+func newHubManager(chatService *ChatService, persister *messagePersister, broker Broker) *hubManager {
+	m := &hubManager{
+		hubs: make(map[string]*ChatHub),
+		deleting: make(map[string]bool),
+		chatService: chatService,
+		persister: persister,
+		broker: broker,
+		limits: newUserLimits(),
+		timeouts: defaultClientTimeouts,
+		timings: defaultHubTimings,
+		instanceID: uuid.New().String(),
+	}
+
+	unsubscribeSessions := m.subscribeSessions()
+	unsubscribeUsers := m.subscribeUsers()
+
+	m.unsubscribe = func() {
+		unsubscribeSessions()
+		unsubscribeUsers()
+	}
+
+	return m
+}
+
+// acquire returns the running hub for roomID, starting it if needed. Every
+// successful call must be paired with release.
+func (m *hubManager) acquire(roomID string) (*ChatHub, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return nil, ErrShuttingDown
+	}
+
+	if m.deleting[roomID] {
+		return nil, ErrRoomNotFound
+	}
+
+	hub, ok := m.hubs[roomID]
+
+	if !ok {
+		hub = newHub(roomID, m)
+		hub.unsubscribe = m.subscribeRoom(hub)
+		m.hubs[roomID] = hub
+		m.running.Add(1)
+		go hub.run()
+	}
+
+	hub.refs++
+
+	return hub, nil
+}
+
+func (m *hubManager) release(hub *ChatHub) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hub.refs--
+
+	if hub.refs > 0 {
+		return
+	}
+
+	delete(m.hubs, hub.roomID)
+	hub.unsubscribe()
+	close(hub.done)
+	m.running.Done()
+}
+
+// deleteRoom deletes a room without connected clients, once its queued
+// messages are written so their batches do not fail on the deleted room. The
+// room is marked first, so no client joins between the check and the delete;
+// the mark stays once the room is gone, for joins that looked it up before.
+func (m *hubManager) deleteRoom(ctx context.Context, roomID string) error {
+	m.mu.Lock()
+
+	if _, ok := m.hubs[roomID]; ok {
+		m.mu.Unlock()
+		return ErrRoomHasClients
+	}
+
+	if m.deleting[roomID] {
+		m.mu.Unlock()
+		return ErrRoomNotFound
+	}
+
+	m.deleting[roomID] = true
+	m.mu.Unlock()
+
+	err := m.persister.sync(ctx)
+
+	if err == nil {
+		err = m.chatService.deleteRoom(roomID)
+	}
+
+	if err != nil {
+		m.mu.Lock()
+		delete(m.deleting, roomID)
+		m.mu.Unlock()
+	}
+
+	return err
+}
+
+// runningHubs returns the hubs of every room, or only roomID's when it is set.
+// Sending to a hub while holding m.mu would stall every acquire and release
+// behind one busy hub, so callers send after this returns. A hub may stop by
+// then, so each send must also select on the hub's done channel.
+func (m *hubManager) runningHubs(roomID string) []*ChatHub {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if roomID != "" {
+		if hub, ok := m.hubs[roomID]; ok {
+			return []*ChatHub{hub}
+		}
+		return nil
+	}
+
+	hubs := make([]*ChatHub, 0, len(m.hubs))
+
+	for _, hub := range m.hubs {
+		hubs = append(hubs, hub)
+	}
+
+	return hubs
+}
+
+func (m *hubManager) clientCount(roomID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hub, ok := m.hubs[roomID]
+
+	if !ok {
+		return 0
+	}
+
+	return hub.refs
+}
+
+// revokeSession asks every running hub, on every instance, to close the
+// connections opened with the given session.
+func (m *hubManager) revokeSession(sessionID string) {
+	m.revokeLocalSession(sessionID)
+	m.publish(sessionsTopic, sessionEvent{Origin: m.instanceID, SessionID: sessionID})
+}
+
+func (m *hubManager) revokeLocalSession(sessionID string) {
+	// A hub that stopped has no clients left to close
+	for _, hub := range m.runningHubs("") {
+		select {
+			case hub.revoke <- sessionID:
+			case <-hub.done:
+		}
+	}
+}
+
+// shutdown closes every client with a going away frame, waits for the hubs to
+// stop and then flushes the persister. It gives up when ctx expires.
+func (m *hubManager) shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	// No hub starts once closing is set
+	for _, hub := range m.runningHubs("") {
+		select {
+			case hub.shutdown <- struct{}{}:
+			case <-hub.done:
+			case <-ctx.Done():
+				return ctx.Err()
+		}
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		m.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+		case <-stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+
+	m.unsubscribe()
+
+	if err := m.broker.Close(); err != nil {
+		log.Printf("failed to close chat broker: %v", err)
+	}
+
+	return m.persister.close(ctx)
+}
+
+func (m *hubManager) metrics() HubMetrics {
+	metrics := m.persister.metrics()
+	metrics.SlowConsumerPolicy = m.chatService.Config.SlowConsumerPolicy
+	metrics.SlowConsumerDropped = m.stats.dropped.Load()
+	metrics.SlowConsumerDisconnects = m.stats.disconnects.Load()
+	metrics.SlowConsumerWarnings = m.stats.warnings.Load()
+
+	return metrics
+}
@@ -0,0 +1,616 @@
+package chat
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// Run with go test -race: these tests exercise the ownership rules of
+// ChatClient and ChatHub.
+
+const testRoomID = "11111111-1111-1111-1111-111111111111"
+
+// testTimeout bounds every wait so a deadlock fails the test instead of
+// hanging it.
+const testTimeout = 5 * time.Second
+
+// nopSessions never reports a session as revoked.
+type nopSessions struct{}
+
+func (nopSessions) IsSessionRevoked(string) (bool, error) { return false, nil }
+func (nopSessions) OnSessionRevoked(func(string)) {}
+
+func newTestManager(t *testing.T, policy SlowConsumerPolicy, broker Broker) *hubManager {
+	t.Helper()
+
+	return newTestManagerWithDB(t, newFakeDB(t), policy, broker)
+}
+
+func newTestManagerWithDB(t *testing.T, db *fakeDB, policy SlowConsumerPolicy, broker Broker) *hubManager {
+	t.Helper()
+
+	repository := NewChatRepository(db.db)
+	service := NewChatService(repository, nil, nopSessions{}, Config{SlowConsumerPolicy: policy, EditWindow: time.Minute})
+	manager := newHubManager(service, newMessagePersister(repository, 1), broker)
+
+	t.Cleanup(func() {
+		manager.mu.Lock()
+		closing := manager.closing
+		manager.mu.Unlock()
+
+		if closing {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+		defer cancel()
+
+		if err := manager.shutdown(ctx); err != nil {
+			t.Errorf("failed to shut down: %v", err)
+		}
+	})
+
+	return manager
+}
+
+// joinStalled adds a client without pumps to roomID, like a peer that stopped
+// reading. Tests read its message channel in place of writePump.
+func joinStalled(t *testing.T, m *hubManager, roomID string, userID string) *ChatClient {
+	t.Helper()
+
+	return joinStalledAs(t, m, roomID, &utils.AuthorizedUserInfo{ID: userID, Username: userID, SessionID: "session-" + userID})
+}
+
+func joinStalledAs(t *testing.T, m *hubManager, roomID string, user *utils.AuthorizedUserInfo) *ChatClient {
+	t.Helper()
+
+	hub, err := m.acquire(roomID)
+
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+
+	client := newChatClient(hub, nil, user)
+	hub.register <- client
+
+	// Does what readPump does when the peer goes away
+	t.Cleanup(func() {
+		client.cancel()
+		hub.unregister <- client
+		m.release(hub)
+	})
+
+	return client
+}
+
+// settle returns once the hub has handled everything sent to it before.
+func settle(t *testing.T, hub *ChatHub) {
+	t.Helper()
+
+	reply := make(chan []PresenceUser, 1)
+
+	select {
+		case hub.presenceQuery <- reply:
+			<-reply
+		case <-time.After(testTimeout):
+			t.Fatal("hub is not running")
+	}
+}
+
+// nextEvent reads the client's queue up to the next event of eventType.
+func nextEvent(t *testing.T, client *ChatClient, eventType string) Envelope {
+	t.Helper()
+
+	timeout := time.After(testTimeout)
+
+	for {
+		select {
+			case event, ok := <-client.message:
+				if !ok {
+					t.Fatalf("client closed before %s", eventType)
+				}
+
+				if event.Type == eventType {
+					return event
+				}
+
+			case <-timeout:
+				t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+func eventually(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func eventIndex(t *testing.T, event Envelope) int {
+	t.Helper()
+
+	var index int
+
+	if err := json.Unmarshal(event.Payload, &index); err != nil {
+		t.Fatalf("invalid test event: %v", err)
+	}
+
+	return index
+}
+
+// newTestServer serves /?room=<id>&user=<id> like serveWs, without tokens.
+func newTestServer(t *testing.T, m *hubManager) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := r.URL.Query().Get("user")
+		user := &utils.AuthorizedUserInfo{ID: userID, Username: userID, SessionID: "session-" + userID}
+		serveClient(m, r.URL.Query().Get("room"), user, nil, w, r)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func dial(t *testing.T, server *httptest.Server, roomID string, userID string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?room=" + roomID + "&user=" + userID
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func runningHub(t *testing.T, m *hubManager, roomID string) *ChatHub {
+	t.Helper()
+
+	var hub *ChatHub
+
+	eventually(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		hub = m.hubs[roomID]
+		return hub != nil
+	}, "room has no hub")
+
+	return hub
+}
+
+// broadcastUntilStopped fans test events out to the room until stop is
+// closed or the hub stops.
+func broadcastUntilStopped(hub *ChatHub, payload any, stop chan struct{}) *sync.WaitGroup {
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+				case hub.roomEvents <- newEnvelope("test.event", payload):
+				case <-stop:
+					return
+				case <-hub.done:
+					return
+			}
+		}
+	}()
+
+	return &wg
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	const sent = clientBufferSize * 2
+
+	for _, policy := range []SlowConsumerPolicy{PolicyDisconnect, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce} {
+		t.Run(string(policy), func(t *testing.T) {
+			m := newTestManager(t, policy, NewMemoryBroker())
+			stalled := joinStalled(t, m, testRoomID, "stalled")
+			healthy := joinStalled(t, m, testRoomID, "healthy")
+			hub := stalled.hub
+
+			// A client that keeps reading must not be slowed down by the other.
+			// Each event waits for the healthy client, so only the stalled one lags
+			received := make(chan struct{}, 1)
+
+			go func() {
+				for event := range healthy.message {
+					if event.Type == "test.event" {
+						select {
+							case received <- struct{}{}:
+							default:
+						}
+					}
+				}
+			}()
+
+			for i := 0; i < sent; i++ {
+				hub.roomEvents <- newEnvelope("test.event", i)
+
+				select {
+					case <-received:
+					case <-time.After(testTimeout):
+						t.Fatalf("healthy client missed event %d", i)
+				}
+			}
+
+			settle(t, hub)
+
+			if warnings := m.stats.warnings.Load(); warnings != 1 {
+				t.Errorf("expected 1 lag warning, got %d", warnings)
+			}
+
+			switch policy {
+				case PolicyDisconnect:
+					for range stalled.message {
+					}
+
+					if stalled.closeCode != websocket.CloseTryAgainLater {
+						t.Errorf("expected close code %d, got %d", websocket.CloseTryAgainLater, stalled.closeCode)
+					}
+
+					if disconnects := m.stats.disconnects.Load(); disconnects != 1 {
+						t.Errorf("expected 1 disconnect, got %d", disconnects)
+					}
+
+				case PolicyDropOldest, PolicyDropNewest:
+					if len(stalled.message) != clientBufferSize {
+						t.Fatalf("expected a full buffer, got %d", len(stalled.message))
+					}
+
+					if m.stats.dropped.Load() == 0 {
+						t.Error("expected dropped frames")
+					}
+
+					first, last := -1, -1
+
+					for len(stalled.message) > 0 {
+						if event := <-stalled.message; event.Type == "test.event" {
+							if first < 0 {
+								first = eventIndex(t, event)
+							}
+							last = eventIndex(t, event)
+						}
+					}
+
+					if policy == PolicyDropOldest && (first == 0 || last != sent - 1) {
+						t.Errorf("expected the newest events to be kept, got %d to %d", first, last)
+					}
+
+					if policy == PolicyDropNewest && (first != 0 || last == sent - 1) {
+						t.Errorf("expected the oldest events to be kept, got %d to %d", first, last)
+					}
+
+				case PolicyCoalesce:
+					// The client catches up, then gets one resync notice
+					for len(stalled.message) > 0 {
+						<-stalled.message
+					}
+
+					hub.roomEvents <- newEnvelope("test.event", sent)
+
+					var resync SystemPayload
+					json.Unmarshal(nextEvent(t, stalled, TypeSystem).Payload, &resync)
+
+					if resync.Event != "resync" || resync.Missed == 0 {
+						t.Errorf("expected a resync notice counting missed frames, got %+v", resync)
+					}
+
+					if index := eventIndex(t, nextEvent(t, stalled, "test.event")); index != sent {
+						t.Errorf("expected event %d after the resync, got %d", sent, index)
+					}
+			}
+		})
+	}
+}
+
+func TestPeerDisconnectsDuringWrite(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+	server := newTestServer(t, m)
+	conn := dial(t, server, testRoomID, "leaver")
+	hub := runningHub(t, m, testRoomID)
+
+	stop := make(chan struct{})
+	broadcasting := broadcastUntilStopped(hub, strings.Repeat("x", 4096), stop)
+
+	// writePump is busy writing once events arrive
+	for i := 0; i < 3; i++ {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	}
+
+	conn.UnderlyingConn().Close()
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 0 }, "disconnected client was not released")
+
+	close(stop)
+	broadcasting.Wait()
+}
+
+func TestShutdownDuringBroadcast(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+	server := newTestServer(t, m)
+
+	closeCodes := make(chan int, 3)
+
+	for _, userID := range []string{"a", "b", "c"} {
+		conn := dial(t, server, testRoomID, userID)
+
+		go func() {
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					var closeErr *websocket.CloseError
+
+					if errors.As(err, &closeErr) {
+						closeCodes <- closeErr.Code
+					} else {
+						closeCodes <- -1
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	eventually(t, func() bool { return m.clientCount(testRoomID) == 3 }, "clients did not join")
+
+	hub := runningHub(t, m, testRoomID)
+	stop := make(chan struct{})
+	broadcasting := broadcastUntilStopped(hub, "payload", stop)
+	defer func() {
+		close(stop)
+		broadcasting.Wait()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if err := m.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+			case code := <-closeCodes:
+				if code != websocket.CloseGoingAway {
+					t.Errorf("expected close code %d, got %d", websocket.CloseGoingAway, code)
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("client was not closed")
+		}
+	}
+
+	if _, err := m.acquire(testRoomID); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected %v after shutdown, got %v", ErrShuttingDown, err)
+	}
+}
+
+func TestReleaseRacesAcquire(t *testing.T) {
+	m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				hub, err := m.acquire(testRoomID)
+
+				if err != nil {
+					t.Errorf("failed to acquire: %v", err)
+					return
+				}
+
+				// A held hub must be running, never one being stopped
+				select {
+					case <-hub.done:
+						t.Error("acquired a stopped hub")
+					default:
+				}
+
+				reply := make(chan []PresenceUser, 1)
+
+				select {
+					case hub.presenceQuery <- reply:
+						<-reply
+					case <-time.After(testTimeout):
+						t.Error("acquired hub is not running")
+				}
+
+				m.release(hub)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.hubs) != 0 {
+		t.Errorf("expected no running hubs, got %d", len(m.hubs))
+	}
+}
+
+func TestDeleteRoomRefusesJoins(t *testing.T) {
+	const deletedRoomID = "22222222-2222-2222-2222-222222222222"
+
+	db := newFakeDB(t)
+	deleting := make(chan struct{})
+	proceed := make(chan struct{})
+
+	db.on(`DELETE FROM rooms`, func(args []driver.Value) fakeResult {
+		if args[0] != deletedRoomID {
+			return fakeResult{}
+		}
+
+		close(deleting)
+		<-proceed
+
+		return fakeResult{affected: 1}
+	})
+
+	m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+	ctx := context.Background()
+
+	joinStalled(t, m, testRoomID, "alice")
+
+	if err := m.deleteRoom(ctx, testRoomID); !errors.Is(err, ErrRoomHasClients) {
+		t.Fatalf("expected %v, got %v", ErrRoomHasClients, err)
+	}
+
+	deleted := make(chan error, 1)
+
+	go func() {
+		deleted <- m.deleteRoom(ctx, deletedRoomID)
+	}()
+
+	<-deleting
+
+	if _, err := m.acquire(deletedRoomID); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected %v while deleting, got %v", ErrRoomNotFound, err)
+	}
+
+	close(proceed)
+
+	if err := <-deleted; err != nil {
+		t.Fatalf("failed to delete room: %v", err)
+	}
+
+	if _, err := m.acquire(deletedRoomID); !errors.Is(err, ErrRoomNotFound) {
+		t.Errorf("expected %v once deleted, got %v", ErrRoomNotFound, err)
+	}
+
+	// A failed delete leaves the room open
+	const missingRoomID = "33333333-3333-3333-3333-333333333333"
+
+	if err := m.deleteRoom(ctx, missingRoomID); !errors.Is(err, ErrRoomNotFound) {
+		t.Fatalf("expected %v, got %v", ErrRoomNotFound, err)
+	}
+
+	hub, err := m.acquire(missingRoomID)
+
+	if err != nil {
+		t.Fatalf("expected the room to stay open after a failed delete, got %v", err)
+	}
+
+	m.release(hub)
+}
+
+func TestBusyHubDoesNotBlockManager(t *testing.T) {
+	const otherRoomID = "66666666-6666-6666-6666-666666666666"
+
+	db := newFakeDB(t)
+	loading := make(chan struct{})
+	proceed := make(chan struct{})
+
+	// Keeps the hub of testRoomID from reaching its run loop
+	db.on(`FROM room_sanctions\s+WHERE room_id = \$1 AND kind = \$2`, func(args []driver.Value) fakeResult {
+		if args[0] == testRoomID {
+			close(loading)
+			<-proceed
+		}
+
+		return fakeResult{}
+	})
+
+	m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+	hub, err := m.acquire(testRoomID)
+
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+
+	<-loading
+	defer close(proceed)
+
+	sends := map[string]func(){
+		"moderation": func() { m.dispatch(testRoomID, moderationAction{Kind: actionUnmute, UserID: "alice"}) },
+		"fan out": func() { m.fanOutRoom(testRoomID, newEnvelope("test.event", 1)) },
+		"session revocation": func() { m.revokeLocalSession("session-alice") },
+		"presence": func() { m.presence("") },
+		"direct delivery": func() { m.deliverToLocalUsers([]string{"alice"}, newEnvelope("test.event", 1)) },
+	}
+
+	var returned sync.WaitGroup
+
+	for _, send := range sends {
+		returned.Add(1)
+
+		go func() {
+			defer returned.Done()
+			send()
+		}()
+	}
+
+	joined := make(chan error, 1)
+
+	go func() {
+		other, err := m.acquire(otherRoomID)
+
+		if err == nil {
+			m.release(other)
+		}
+
+		joined <- err
+	}()
+
+	select {
+		case err := <-joined:
+			if err != nil {
+				t.Fatalf("failed to join another room: %v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("a busy hub blocked joining another room")
+	}
+
+	// Sends give up once the hub stops
+	m.release(hub)
+
+	stopped := make(chan struct{})
+
+	go func() {
+		returned.Wait()
+		close(stopped)
+	}()
+
+	select {
+		case <-stopped:
+		case <-time.After(testTimeout):
+			t.Fatal("sends to a stopped hub did not return")
+	}
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+func editMessage(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload EditMessagePayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		message, err := m.chatService.ChatRepository.selectMessageByID(chi.URLParam(r, "messageID"))
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to edit message", utils.StatusCode(err), err)
+			return
+		}
+
+		edited, err := m.editMessage(message, claims.ID, payload.Content)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to edit message", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Edit message successfully",
+			"data": *edited,
+		})
+
+		w.Write(resp)
+	})
+}
+
+// deleteMessage lets moderators delete any message and authors their own
+// within the edit window.
+func deleteMessage(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		messageID := chi.URLParam(r, "messageID")
+
+		message, err := m.chatService.ChatRepository.selectMessageByID(messageID)
+
+		if err == nil {
+			if utils.HasRole(claims.Role, utils.RoleModerator) {
+				err = m.deleteMessage(message, claims.ID)
+			} else {
+				err = m.deleteOwnMessage(message, claims.ID)
+			}
+		}
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to delete message", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Delete message successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listMessageEdits(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		edits, err := s.listMessageEdits(chi.URLParam(r, "messageID"))
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get message edits", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get message edits successfully",
+			"data": edits,
+		})
+
+		w.Write(resp)
+	})
+}
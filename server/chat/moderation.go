@@ -0,0 +1,86 @@
+package chat
+
+import (
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// Moderation is persisted through the ChatService first, then applied to the
+// running hub of the room, if any. REST handlers and WebSocket commands share
+// these entry points. Mutes, kicks and bans only apply to users with a lower
+// role than the moderator's.
+
+func (m *hubManager) dispatch(roomID string, action moderationAction) {
+	// A hub that stopped has no clients, and the next one loads mutes itself
+	for _, hub := range m.runningHubs(roomID) {
+		select {
+			case hub.moderation <- action:
+			case <-hub.done:
+		}
+	}
+
+	// Other instances may have clients in the room too
+	m.publishRoom(roomID, roomEvent{Kind: roomEventModeration, Action: &action})
+}
+
+// deleteMessage removes any message of its room. Like deleteOwnMessage it
+// takes the message from a hub's recent messages or the database, so queued
+// messages can be deleted too.
+func (m *hubManager) deleteMessage(message *ChatMessage, moderatorID string) error {
+	if err := m.chatService.deleteMessage(message, moderatorID); err != nil {
+		return err
+	}
+
+	m.dispatch(message.RoomID, moderationAction{Kind: actionDelete, MessageID: message.ID})
+
+	return nil
+}
+
+func (m *hubManager) muteUser(roomID string, payload ModerationPayload, moderator *utils.AuthorizedUserInfo) (*RoomSanction, error) {
+	sanction, err := m.chatService.sanctionUser(roomID, SanctionMute, payload, moderator)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.dispatch(roomID, moderationAction{Kind: actionMute, UserID: sanction.UserID, Until: sanction.ExpiresAt})
+
+	return sanction, nil
+}
+
+func (m *hubManager) unmuteUser(roomID string, userID string) error {
+	if err := m.chatService.liftSanction(roomID, userID, SanctionMute); err != nil {
+		return err
+	}
+
+	m.dispatch(roomID, moderationAction{Kind: actionUnmute, UserID: userID})
+
+	return nil
+}
+
+// kickUser disconnects the user from the room without stopping them from
+// joining again.
+func (m *hubManager) kickUser(roomID string, userID string, moderator *utils.AuthorizedUserInfo) error {
+	if err := m.chatService.checkOutranks(moderator, userID); err != nil {
+		return err
+	}
+
+	m.dispatch(roomID, moderationAction{Kind: actionKick, UserID: userID})
+
+	return nil
+}
+
+func (m *hubManager) banUser(roomID string, payload ModerationPayload, moderator *utils.AuthorizedUserInfo) (*RoomSanction, error) {
+	sanction, err := m.chatService.sanctionUser(roomID, SanctionBan, payload, moderator)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.dispatch(roomID, moderationAction{Kind: actionBan, UserID: sanction.UserID, Until: sanction.ExpiresAt})
+
+	return sanction, nil
+}
+
+func (m *hubManager) unbanUser(roomID string, userID string) error {
+	return m.chatService.liftSanction(roomID, userID, SanctionBan)
+}
@@ -0,0 +1,115 @@
+package chat
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+func muteUser(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload ModerationPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		sanction, err := m.muteUser(chi.URLParam(r, "roomID"), payload, claims)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to mute user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Mute user successfully",
+			"data": *sanction,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func unmuteUser(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.unmuteUser(chi.URLParam(r, "roomID"), chi.URLParam(r, "userID")); err != nil {
+			utils.ResponseError(w, "Failed to unmute user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Unmute user successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func kickUser(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload ModerationPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+
+		if err := m.kickUser(chi.URLParam(r, "roomID"), payload.UserID, claims); err != nil {
+			utils.ResponseError(w, "Failed to kick user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Kick user successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func banUser(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload ModerationPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		sanction, err := m.banUser(chi.URLParam(r, "roomID"), payload, claims)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to ban user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Ban user successfully",
+			"data": *sanction,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func unbanUser(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := m.unbanUser(chi.URLParam(r, "roomID"), chi.URLParam(r, "userID")); err != nil {
+			utils.ResponseError(w, "Failed to unban user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Unban user successfully",
+		})
+
+		w.Write(resp)
+	})
+}
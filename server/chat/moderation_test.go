@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// frame builds a client frame with a JSON payload.
+func frame(t *testing.T, frameType string, id string, payload any) Envelope {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+
+	return Envelope{Type: frameType, ID: id, Payload: data}
+}
+
+// send posts content as client and returns the new message id.
+func send(t *testing.T, client *ChatClient, content string) string {
+	t.Helper()
+
+	if err := client.handle(frame(t, TypeChatSend, "send-" + content, ChatSendPayload{Content: content})); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	var ack AckPayload
+
+	if err := json.Unmarshal(nextEvent(t, client, TypeAck).Payload, &ack); err != nil {
+		t.Fatalf("invalid ack: %v", err)
+	}
+
+	return ack.MessageID
+}
+
+func TestModeratorDeleteOverSocket(t *testing.T) {
+	const otherRoomID = "44444444-4444-4444-4444-444444444444"
+
+	tests := []struct {
+		name		string
+		roomID		string
+		role		string
+		messageID	func(sent string) string
+		wantErr		error
+	}{
+		{name: "queued message of the room", roomID: testRoomID, role: utils.RoleModerator},
+		{name: "admin", roomID: testRoomID, role: utils.RoleAdmin},
+		{name: "message of another room", roomID: otherRoomID, role: utils.RoleModerator, wantErr: ErrMessageNotFound},
+		{name: "not a moderator", roomID: testRoomID, role: utils.RoleUser, wantErr: ErrNotModerator},
+		{
+			name: "missing message id",
+			roomID: testRoomID,
+			role: utils.RoleModerator,
+			messageID: func(string) string { return "" },
+			wantErr: ErrMessageIDRequired,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			messages := onMessages(db)
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+
+			author := joinStalled(t, m, testRoomID, "alice")
+			moderator := joinStalledAs(t, m, tt.roomID, &utils.AuthorizedUserInfo{ID: "mod", Username: "mod", SessionID: "session-mod", Role: tt.role})
+
+			sent := send(t, author, "hello")
+			messageID := sent
+
+			if tt.messageID != nil {
+				messageID = tt.messageID(sent)
+			}
+
+			err := moderator.handle(frame(t, TypeModDelete, "delete", ModerationCommand{MessageID: messageID}))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if messages.isDeleted(sent) != (tt.wantErr == nil) {
+				t.Errorf("got deleted %v, want %v", messages.isDeleted(sent), tt.wantErr == nil)
+			}
+
+			if tt.wantErr == nil {
+				nextEvent(t, author, TypeMessageDeleted)
+			}
+		})
+	}
+}
+
+func TestBansBlockRoomHistory(t *testing.T) {
+	const messageID = "55555555-5555-5555-5555-555555555555"
+
+	paths := map[string]string{
+		"history": "/messages?room=" + testRoomID,
+		"thread": "/messages/" + messageID + "/thread",
+		"read cursors": "/rooms/" + testRoomID + "/reads",
+	}
+
+	tests := []struct {
+		name		string
+		banned		bool
+		wantStatus	int
+	}{
+		{name: "not banned", wantStatus: http.StatusOK},
+		{name: "banned", banned: true, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		for endpoint, path := range paths {
+			t.Run(tt.name + "/" + endpoint, func(t *testing.T) {
+				server, keySet, db := newAuthTestServer(t)
+				messages := onMessages(db)
+				messages.messages[messageID] = ChatMessage{ID: messageID, RoomID: testRoomID, UserID: "bob", Content: "hi", CreatedAt: time.Now()}
+
+				db.on(`FROM room_sanctions`, func(args []driver.Value) fakeResult {
+					return row([]string{"exists"}, tt.banned && args[0] == testRoomID && args[1] == testUserInfo.ID)
+				})
+
+				req, _ := http.NewRequest(http.MethodGet, server.URL + path, nil)
+				req.Header.Set("Authorization", "Bearer " + signTestToken(t, keySet, utils.RoleUser))
+
+				resp, err := http.DefaultClient.Do(req)
+
+				if err != nil {
+					t.Fatalf("request failed: %v", err)
+				}
+
+				resp.Body.Close()
+
+				if resp.StatusCode != tt.wantStatus {
+					t.Errorf("got status %d, want %d", resp.StatusCode, tt.wantStatus)
+				}
+			})
+		}
+	}
+}
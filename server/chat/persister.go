@@ -0,0 +1,208 @@
+package chat
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dbQueueSize		= 1024
+	dbBatchSize		= 50
+	dbFlushInterval	= time.Second
+)
+
+// messagePersister is shared by every room hub so the db worker pool does not
+// grow with the number of rooms.
+type messagePersister struct {
+	dbQueue			chan ChatMessage
+	chatRepository	*ChatRepository
+	workers			sync.WaitGroup
+
+	// One channel per worker; see sync
+	flushes			[]chan chan struct{}
+
+	// Backpressure metrics for the db queue
+	enqueued		atomic.Int64
+	dropped			atomic.Int64
+	persisted		atomic.Int64
+	failed			atomic.Int64
+}
+
+func newMessagePersister(chatRepository *ChatRepository, dbWorkers int) *messagePersister {
+	p := &messagePersister{
+		dbQueue: make(chan ChatMessage, dbQueueSize),
+		chatRepository: chatRepository,
+	}
+
+	// Every flush channel exists before the first worker reads the slice
+	for i := 0; i < dbWorkers; i++ {
+		p.flushes = append(p.flushes, make(chan chan struct{}))
+	}
+
+	for i := 0; i < dbWorkers; i++ {
+		p.workers.Add(1)
+		go p.dbWorker(i)
+	}
+
+	return p
+}
+
+// enqueue never blocks the hub; when the queue is full the message is dropped
+// and counted.
+func (p *messagePersister) enqueue(message ChatMessage) {
+	select {
+		case p.dbQueue <- message:
+			p.enqueued.Add(1)
+		default:
+			p.dropped.Add(1)
+			log.Println("⚠️ DB queue full, dropping message")
+	}
+}
+
+func (p *messagePersister) metrics() HubMetrics {
+	return HubMetrics{
+		QueueDepth: len(p.dbQueue),
+		QueueCapacity: cap(p.dbQueue),
+		Enqueued: p.enqueued.Load(),
+		Dropped: p.dropped.Load(),
+		Persisted: p.persisted.Load(),
+		Failed: p.failed.Load(),
+	}
+}
+
+// dbWorker writes queued messages in batches, flushing when the batch is full or the flush interval elapses.
+func (p *messagePersister) dbWorker(id int) {
+	batch := make([]ChatMessage, 0, dbBatchSize)
+	ticker := time.NewTicker(dbFlushInterval)
+	defer ticker.Stop()
+	defer p.workers.Done()
+
+	for {
+		select {
+			case msg, ok := <-p.dbQueue:
+				if !ok {
+					p.flush(id, batch)
+					return
+				}
+
+				batch = append(batch, msg)
+
+				if len(batch) >= dbBatchSize {
+					p.flush(id, batch)
+					batch = batch[:0]
+				}
+
+			case <-ticker.C:
+				if len(batch) > 0 {
+					p.flush(id, batch)
+					batch = batch[:0]
+				}
+
+			case done := <-p.flushes[id]:
+				batch = p.drain(id, batch)
+				p.flush(id, batch)
+				batch = batch[:0]
+				close(done)
+		}
+	}
+}
+
+// drain moves what is queued right now into batch, flushing full batches.
+func (p *messagePersister) drain(id int, batch []ChatMessage) []ChatMessage {
+	for {
+		select {
+			case msg, ok := <-p.dbQueue:
+				if !ok {
+					return batch
+				}
+
+				batch = append(batch, msg)
+
+				if len(batch) >= dbBatchSize {
+					p.flush(id, batch)
+					batch = batch[:0]
+				}
+
+			default:
+				return batch
+		}
+	}
+}
+
+// flush writes a batch. When the batch insert fails, for instance because
+// one message's room was deleted, rows are retried one by one so the other
+// messages are still saved.
+func (p *messagePersister) flush(id int, batch []ChatMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := p.chatRepository.insertMessages(batch)
+
+	if err == nil {
+		p.persisted.Add(int64(len(batch)))
+		return
+	}
+
+	if len(batch) == 1 {
+		p.failed.Add(1)
+		log.Printf("[DB Worker %d] failed to save message %s: %v", id, batch[0].ID, err)
+		return
+	}
+
+	log.Printf("[DB Worker %d] failed to save %d messages, retrying one by one: %v", id, len(batch), err)
+
+	for i := range batch {
+		p.flush(id, batch[i:i + 1])
+	}
+}
+
+// sync returns once every message queued before the call has been written,
+// or ctx expires. It must not be called after close.
+func (p *messagePersister) sync(ctx context.Context) error {
+	pending := make([]chan struct{}, 0, len(p.flushes))
+
+	for _, flushes := range p.flushes {
+		done := make(chan struct{})
+
+		select {
+			case flushes <- done:
+				pending = append(pending, done)
+			case <-ctx.Done():
+				return ctx.Err()
+		}
+	}
+
+	for _, done := range pending {
+		select {
+			case <-done:
+			case <-ctx.Done():
+				return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// close stops accepting messages and waits for the workers to flush what is
+// queued. No hub may enqueue after close is called.
+func (p *messagePersister) close(ctx context.Context) error {
+	close(p.dbQueue)
+
+	flushed := make(chan struct{})
+
+	go func() {
+		p.workers.Wait()
+		close(flushed)
+	}()
+
+	select {
+		case <-flushed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+}
@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// presenceDebounce is how long a user stays online after their last
+// connection to a room closes, so reconnects and page reloads do not flap.
+const presenceDebounce = 5 * time.Second
+
+const (
+	PresenceOnline	= "online"
+	PresenceOffline	= "offline"
+)
+
+// presenceEntry tracks one user in a hub. A user with several tabs open has
+// one entry with several connections.
+type presenceEntry struct {
+	username	string
+	connections	int
+	leaving		*time.Timer
+}
+
+// userJoined counts a new connection and announces the user if they were
+// not already online, here or on another instance.
+func (h *ChatHub) userJoined(client *ChatClient) {
+	entry, ok := h.online[client.user.ID]
+
+	if !ok {
+		wasOnline := h.isOnline(client.user.ID)
+		entry = &presenceEntry{username: client.user.Username}
+		h.online[client.user.ID] = entry
+		h.announcePresence(client.user.ID, entry.username, PresenceOnline, !wasOnline)
+	}
+
+	if entry.leaving != nil {
+		entry.leaving.Stop()
+		entry.leaving = nil
+	}
+
+	entry.connections++
+}
+
+// userLeft drops a connection. The offline event is only sent once the
+// debounce expires without the user coming back.
+func (h *ChatHub) userLeft(client *ChatClient) {
+	entry, ok := h.online[client.user.ID]
+
+	if !ok {
+		return
+	}
+
+	entry.connections--
+
+	if entry.connections > 0 || entry.leaving != nil {
+		return
+	}
+
+	h.stopTyping(client.user.ID)
+
+	userID := client.user.ID
+
+	entry.leaving = time.AfterFunc(h.manager.timings.presenceDebounce, func() {
+		select {
+			case h.offline <- userID:
+			case <-h.done:
+		}
+	})
+}
+
+func (h *ChatHub) userOffline(userID string) {
+	entry, ok := h.online[userID]
+
+	if !ok || entry.connections > 0 {
+		return
+	}
+
+	delete(h.online, userID)
+	h.announcePresence(userID, entry.username, PresenceOffline, !h.isOnline(userID))
+}
+
+// announcePresence tells the other instances about a local presence change,
+// and the local clients too when the user's overall status changed.
+func (h *ChatHub) announcePresence(userID string, username string, status string, changed bool) {
+	event := h.presenceEnvelope(userID, username, status)
+
+	if changed {
+		h.fanOut(event)
+	}
+
+	var payload PresencePayload
+	json.Unmarshal(event.Payload, &payload)
+	h.manager.publishRoom(h.roomID, roomEvent{Kind: roomEventPresence, Presence: &payload})
+}
+
+// remotePresence records a presence change from another instance and passes
+// it on only when the user's overall status changed.
+func (h *ChatHub) remotePresence(origin string, payload PresencePayload) {
+	wasOnline := h.isOnline(payload.UserID)
+
+	if payload.Status == PresenceOnline {
+		if h.remoteOnline[payload.UserID] == nil {
+			h.remoteOnline[payload.UserID] = make(map[string]string)
+		}
+		h.remoteOnline[payload.UserID][origin] = payload.Username
+	} else {
+		delete(h.remoteOnline[payload.UserID], origin)
+
+		if len(h.remoteOnline[payload.UserID]) == 0 {
+			delete(h.remoteOnline, payload.UserID)
+		}
+	}
+
+	if wasOnline != h.isOnline(payload.UserID) {
+		h.fanOut(h.presenceEnvelope(payload.UserID, payload.Username, payload.Status))
+	}
+}
+
+func (h *ChatHub) isOnline(userID string) bool {
+	_, local := h.online[userID]
+	return local || len(h.remoteOnline[userID]) > 0
+}
+
+// leaveAll tells the other instances that this hub's users are gone. Called
+// when the hub stops, which skips the offline debounce.
+func (h *ChatHub) leaveAll() {
+	for userID, entry := range h.online {
+		payload := PresencePayload{RoomID: h.roomID, UserID: userID, Username: entry.username, Status: PresenceOffline}
+		h.manager.publishRoom(h.roomID, roomEvent{Kind: roomEventPresence, Presence: &payload})
+	}
+}
+
+func (h *ChatHub) presenceEnvelope(userID string, username string, status string) Envelope {
+	return newEnvelope(TypePresence, PresencePayload{
+		RoomID: h.roomID,
+		UserID: userID,
+		Username: username,
+		Status: status,
+	})
+}
+
+func (h *ChatHub) onlineUsers() []PresenceUser {
+	users := make([]PresenceUser, 0, len(h.online) + len(h.remoteOnline))
+
+	for userID, entry := range h.online {
+		users = append(users, PresenceUser{UserID: userID, Username: entry.username})
+	}
+
+	for userID, origins := range h.remoteOnline {
+		if _, ok := h.online[userID]; ok {
+			continue
+		}
+
+		for _, username := range origins {
+			users = append(users, PresenceUser{UserID: userID, Username: username})
+			break
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].Username < users[j].Username })
+
+	return users
+}
+
+// presence lists the online users of roomID, or of every active room when
+// roomID is empty.
+func (m *hubManager) presence(roomID string) []RoomPresence {
+	rooms := []RoomPresence{}
+
+	// A hub that stopped has nobody online
+	for _, hub := range m.runningHubs(roomID) {
+		reply := make(chan []PresenceUser, 1)
+
+		select {
+			case hub.presenceQuery <- reply:
+				rooms = append(rooms, RoomPresence{RoomID: hub.roomID, Users: <-reply})
+			case <-hub.done:
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].RoomID < rooms[j].RoomID })
+
+	return rooms
+}
@@ -0,0 +1,169 @@
+package chat
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+const testDebounce = 50 * time.Millisecond
+
+// joinTab connects one more tab of user to roomID. leave closes it like
+// readPump does; it is also called on cleanup and only runs once.
+func joinTab(t *testing.T, m *hubManager, roomID string, user *utils.AuthorizedUserInfo) (*ChatClient, func()) {
+	t.Helper()
+
+	hub, err := m.acquire(roomID)
+
+	if err != nil {
+		t.Fatalf("failed to join: %v", err)
+	}
+
+	client := newChatClient(hub, nil, user)
+	hub.register <- client
+
+	var once sync.Once
+
+	leave := func() {
+		once.Do(func() {
+			client.cancel()
+			hub.unregister <- client
+			m.release(hub)
+		})
+	}
+
+	t.Cleanup(leave)
+
+	return client, leave
+}
+
+// presenceOf drains client's queue and returns the presence statuses of userID.
+func presenceOf(t *testing.T, client *ChatClient, userID string) []string {
+	t.Helper()
+
+	statuses := []string{}
+
+	for len(client.message) > 0 {
+		event := <-client.message
+
+		if event.Type != TypePresence {
+			continue
+		}
+
+		var payload PresencePayload
+
+		if err := json.Unmarshal(event.Payload, &payload); err != nil {
+			t.Fatalf("invalid presence event: %v", err)
+		}
+
+		if payload.UserID == userID {
+			statuses = append(statuses, payload.Status)
+		}
+	}
+
+	return statuses
+}
+
+func TestPresenceDebounce(t *testing.T) {
+	const (
+		opJoin	= "join"
+		opLeave	= "leave"
+		opWait	= "wait"
+	)
+
+	type step struct {
+		op	string
+		tab	int
+	}
+
+	tests := []struct {
+		name		string
+		steps		[]step
+		wantEvents	[]string
+		wantOnline	[]string
+	}{
+		{
+			name: "single tab",
+			steps: []step{{op: opJoin, tab: 0}, {op: opLeave, tab: 0}, {op: opWait}},
+			wantEvents: []string{PresenceOnline, PresenceOffline},
+			wantOnline: []string{"observer"},
+		},
+		{
+			name: "second tab is not announced",
+			steps: []step{{op: opJoin, tab: 0}, {op: opJoin, tab: 1}, {op: opLeave, tab: 0}, {op: opWait}},
+			wantEvents: []string{PresenceOnline},
+			wantOnline: []string{"alice", "observer"},
+		},
+		{
+			name: "reconnect within the debounce",
+			steps: []step{{op: opJoin, tab: 0}, {op: opLeave, tab: 0}, {op: opJoin, tab: 1}, {op: opWait}},
+			wantEvents: []string{PresenceOnline},
+			wantOnline: []string{"alice", "observer"},
+		},
+		{
+			name: "online during the debounce",
+			steps: []step{{op: opJoin, tab: 0}, {op: opLeave, tab: 0}},
+			wantEvents: []string{PresenceOnline},
+			wantOnline: []string{"alice", "observer"},
+		},
+		{
+			name: "every tab closed",
+			steps: []step{{op: opJoin, tab: 0}, {op: opJoin, tab: 1}, {op: opLeave, tab: 1}, {op: opLeave, tab: 0}, {op: opWait}},
+			wantEvents: []string{PresenceOnline, PresenceOffline},
+			wantOnline: []string{"observer"},
+		},
+		{
+			name: "back after going offline",
+			steps: []step{{op: opJoin, tab: 0}, {op: opLeave, tab: 0}, {op: opWait}, {op: opJoin, tab: 1}},
+			wantEvents: []string{PresenceOnline, PresenceOffline, PresenceOnline},
+			wantOnline: []string{"alice", "observer"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+			m.timings.presenceDebounce = testDebounce
+
+			observer := joinStalled(t, m, testRoomID, "observer")
+			hub := runningHub(t, m, testRoomID)
+			tabs := map[int]func(){}
+
+			for _, st := range tt.steps {
+				switch st.op {
+					case opJoin:
+						tab := &utils.AuthorizedUserInfo{ID: "alice", Username: "alice", SessionID: "session-" + string(rune('a' + st.tab))}
+						_, tabs[st.tab] = joinTab(t, m, testRoomID, tab)
+
+					case opLeave:
+						tabs[st.tab]()
+
+					case opWait:
+						time.Sleep(4 * testDebounce)
+				}
+
+				settle(t, hub)
+			}
+
+			if got := presenceOf(t, observer, "alice"); !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("got presence %v, want %v", got, tt.wantEvents)
+			}
+
+			online := []string{}
+
+			for _, room := range m.presence(testRoomID) {
+				for _, user := range room.Users {
+					online = append(online, user.Username)
+				}
+			}
+
+			if !reflect.DeepEqual(online, tt.wantOnline) {
+				t.Errorf("got online %v, want %v", online, tt.wantOnline)
+			}
+		})
+	}
+}
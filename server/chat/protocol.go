@@ -0,0 +1,194 @@
+package chat
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// ProtocolVersion is the envelope version spoken by the server. Frames with
+// any other version are rejected.
+const ProtocolVersion = 1
+
+// Frame types. Clients send chat.send, message.edit, message.delete,
+// typing.*, read, reaction.*, direct.send, direct.read and mod.* frames;
+// everything else is sent by the server. direct.read is also sent back to
+// both participants.
+const (
+	TypeChatSend		= "chat.send"
+	TypeChatMessage		= "chat.message"
+	TypeMessageEdit		= "message.edit"
+	TypeMessageEdited	= "message.edited"
+	TypeMessageDelete	= "message.delete"
+	TypeMessageDeleted	= "message.deleted"
+	TypeTypingStart		= "typing.start"
+	TypeTypingStop		= "typing.stop"
+	TypeRead			= "read"
+	TypePresence		= "presence"
+	TypeReaction		= "reaction"
+	TypeReactionAdd		= "reaction.add"
+	TypeReactionRemove	= "reaction.remove"
+	TypeDirectSend		= "direct.send"
+	TypeDirectMessage	= "direct.message"
+	TypeDirectRead		= "direct.read"
+	TypeError			= "error"
+	TypeAck				= "ack"
+	TypeSystem			= "system"
+
+	TypeModDelete		= "mod.delete"
+	TypeModMute			= "mod.mute"
+	TypeModUnmute		= "mod.unmute"
+	TypeModKick			= "mod.kick"
+	TypeModBan			= "mod.ban"
+)
+
+// Envelope is every frame exchanged over the chat WebSocket. On client frames
+// ID is chosen by the client and doubles as the idempotency key of chat.send;
+// on server frames it is assigned by the server.
+type Envelope struct {
+	Version		int				`json:"v"`
+	Type		string			`json:"type"`
+	ID			string			`json:"id,omitempty"`
+	Timestamp	time.Time		`json:"ts"`
+	Payload		json.RawMessage	`json:"payload,omitempty"`
+}
+
+// ChatSendPayload is a new message. ReplyTo is the id of the message it
+// answers, which puts it in that message's thread.
+type ChatSendPayload struct {
+	Content		string	`json:"content"`
+	ReplyTo		string	`json:"reply_to,omitempty"`
+}
+
+// MessageEditPayload changes the content of the sender's own message. Content
+// is ignored by message.delete.
+type MessageEditPayload struct {
+	MessageID	string	`json:"message_id"`
+	Content		string	`json:"content"`
+}
+
+type MessageEditedEvent struct {
+	ID			string		`json:"id"`
+	RoomID		string		`json:"room_id"`
+	Content		string		`json:"content"`
+	EditedAt	time.Time	`json:"edited_at"`
+}
+
+type MessageDeletedEvent struct {
+	ID			string	`json:"id"`
+	RoomID		string	`json:"room_id"`
+}
+
+// ReactionPayload adds or removes the sender's reaction to a message.
+type ReactionPayload struct {
+	MessageID	string	`json:"message_id"`
+	Emoji		string	`json:"emoji"`
+}
+
+// ReactionEvent tells the room about a reaction change. Count is the number
+// of users reacting with Emoji afterwards.
+type ReactionEvent struct {
+	RoomID		string	`json:"room_id"`
+	MessageID	string	`json:"message_id"`
+	UserID		string	`json:"user_id"`
+	Emoji		string	`json:"emoji"`
+	Action		string	`json:"action"`
+	Count		int		`json:"count"`
+}
+
+// ModerationCommand is the payload of the mod.* frames.
+type ModerationCommand struct {
+	ModerationPayload
+	MessageID	string	`json:"message_id"`
+}
+
+// ReadPayload marks every message up to MessageID as read.
+type ReadPayload struct {
+	MessageID	string	`json:"message_id"`
+}
+
+// DirectSendPayload is a direct message to the user To.
+type DirectSendPayload struct {
+	To			string	`json:"to"`
+	Content		string	`json:"content"`
+}
+
+// DirectReadPayload marks the conversation with UserID read up to MessageID.
+type DirectReadPayload struct {
+	UserID		string	`json:"user_id"`
+	MessageID	string	`json:"message_id"`
+}
+
+type TypingPayload struct {
+	RoomID		string	`json:"room_id"`
+	UserID		string	`json:"user_id"`
+	Username	string	`json:"username"`
+}
+
+// PresencePayload announces a user coming online or going offline in a room.
+type PresencePayload struct {
+	RoomID		string	`json:"room_id"`
+	UserID		string	`json:"user_id"`
+	Username	string	`json:"username"`
+	Status		string	`json:"status"`
+}
+
+// AckPayload confirms a client frame. Ref is the client frame id and
+// Duplicate is set when a chat.send was already accepted under that id.
+type AckPayload struct {
+	Ref			string	`json:"ref"`
+	MessageID	string	`json:"message_id,omitempty"`
+	Duplicate	bool	`json:"duplicate,omitempty"`
+}
+
+// ErrorPayload reports a rejected frame. RetryAfterMs is set when the client
+// was throttled.
+type ErrorPayload struct {
+	Ref				string	`json:"ref,omitempty"`
+	Code			string	`json:"code"`
+	Message			string	`json:"message"`
+	RetryAfterMs	int64	`json:"retry_after_ms,omitempty"`
+}
+
+// SystemPayload describes a room event such as a user being muted. Event
+// names the event and the remaining fields depend on it.
+type SystemPayload struct {
+	Event		string		`json:"event"`
+	RoomID		string		`json:"room_id"`
+	UserID		string		`json:"user_id,omitempty"`
+	Until		*time.Time	`json:"until,omitempty"`
+	Missed		int			`json:"missed,omitempty"`
+}
+
+// newEnvelope builds a server frame. The payload is marshalled once so a
+// frame fanned out to a whole room is not encoded per client.
+func newEnvelope(frameType string, payload any) Envelope {
+	data, _ := json.Marshal(payload)
+
+	return Envelope{
+		Version: ProtocolVersion,
+		Type: frameType,
+		ID: uuid.New().String(),
+		Timestamp: time.Now(),
+		Payload: data,
+	}
+}
+
+func ackEnvelope(ack AckPayload) Envelope {
+	return newEnvelope(TypeAck, ack)
+}
+
+func errorEnvelope(ref string, err error) Envelope {
+	return newEnvelope(TypeError, ErrorPayload{
+		Ref: ref,
+		Code: utils.ErrorCode(err, utils.StatusCode(err)),
+		Message: err.Error(),
+		RetryAfterMs: retryAfter(err).Milliseconds(),
+	})
+}
+
+func systemEnvelope(payload SystemPayload) Envelope {
+	return newEnvelope(TypeSystem, payload)
+}
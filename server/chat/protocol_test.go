@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readFrame reads conn up to the next frame of frameType.
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string) Envelope {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+
+	for {
+		var frame Envelope
+
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("no %s frame: %v", frameType, err)
+		}
+
+		if frame.Type == frameType {
+			return frame
+		}
+	}
+}
+
+func TestProtocolFrames(t *testing.T) {
+	tests := []struct {
+		name		string
+		frame		string
+		wantType	string
+		wantRef		string
+		wantCode	string
+	}{
+		{name: "unknown type", frame: `{"v":1,"type":"bogus","id":"f1"}`, wantType: TypeError, wantRef: "f1", wantCode: "unknown_type"},
+		{name: "other version", frame: `{"v":2,"type":"chat.send","id":"f2","payload":{"content":"hi"}}`, wantType: TypeError, wantRef: "f2", wantCode: "unsupported_version"},
+		{name: "missing version", frame: `{"type":"chat.send","id":"f3","payload":{"content":"hi"}}`, wantType: TypeError, wantRef: "f3", wantCode: "unsupported_version"},
+		{name: "not json", frame: `hello`, wantType: TypeError, wantCode: "invalid_frame"},
+		{name: "malformed payload", frame: `{"v":1,"type":"chat.send","id":"f5","payload":"hi"}`, wantType: TypeError, wantRef: "f5", wantCode: "invalid_frame"},
+		{name: "empty content", frame: `{"v":1,"type":"chat.send","id":"f6","payload":{"content":"  "}}`, wantType: TypeError, wantRef: "f6", wantCode: "content_required"},
+		{name: "chat.send", frame: `{"v":1,"type":"chat.send","id":"f7","payload":{"content":"hi"}}`, wantType: TypeAck, wantRef: "f7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+			conn := dial(t, newTestServer(t, m), testRoomID, "alice")
+
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.frame)); err != nil {
+				t.Fatalf("failed to write: %v", err)
+			}
+
+			// The room gets the message before the sender gets the ack
+			var broadcast Envelope
+
+			if tt.wantType == TypeAck {
+				broadcast = readFrame(t, conn, TypeChatMessage)
+			}
+
+			reply := readFrame(t, conn, tt.wantType)
+
+			if reply.Version != ProtocolVersion || reply.ID == "" || reply.Timestamp.IsZero() {
+				t.Errorf("incomplete envelope %+v", reply)
+			}
+
+			if tt.wantType == TypeError {
+				var payload ErrorPayload
+
+				if err := json.Unmarshal(reply.Payload, &payload); err != nil {
+					t.Fatalf("invalid error payload: %v", err)
+				}
+
+				if payload.Ref != tt.wantRef || payload.Code != tt.wantCode {
+					t.Errorf("got error %+v, want ref %q and code %q", payload, tt.wantRef, tt.wantCode)
+				}
+
+				return
+			}
+
+			var ack AckPayload
+
+			if err := json.Unmarshal(reply.Payload, &ack); err != nil {
+				t.Fatalf("invalid ack: %v", err)
+			}
+
+			if ack.Ref != tt.wantRef || ack.MessageID == "" {
+				t.Errorf("got ack %+v, want ref %q and a message id", ack, tt.wantRef)
+			}
+
+			var message ChatMessage
+
+			if err := json.Unmarshal(broadcast.Payload, &message); err != nil {
+				t.Fatalf("invalid message: %v", err)
+			}
+
+			if message.ID != ack.MessageID || message.UserID != "alice" || message.RoomID != testRoomID {
+				t.Errorf("got message %+v, want id %q from alice", message, ack.MessageID)
+			}
+		})
+	}
+}
+
+func TestChatSendIdempotency(t *testing.T) {
+	tests := []struct {
+		name			string
+		keys			[]string
+		wantDuplicate	[]bool
+		wantMessages	int
+	}{
+		{name: "retry with the same key", keys: []string{"k1", "k1"}, wantDuplicate: []bool{false, true}, wantMessages: 1},
+		{name: "different keys", keys: []string{"k1", "k2"}, wantDuplicate: []bool{false, false}, wantMessages: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+			sender := joinStalled(t, m, testRoomID, "alice")
+			reader := joinStalled(t, m, testRoomID, "bob")
+
+			var first string
+
+			for i, key := range tt.keys {
+				// Distinct content so different keys are not duplicate content
+				content := "hello " + key
+
+				if err := sender.handle(frame(t, TypeChatSend, key, ChatSendPayload{Content: content})); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+
+				var ack AckPayload
+
+				if err := json.Unmarshal(nextEvent(t, sender, TypeAck).Payload, &ack); err != nil {
+					t.Fatalf("invalid ack: %v", err)
+				}
+
+				if ack.Ref != key || ack.Duplicate != tt.wantDuplicate[i] {
+					t.Errorf("send %d: got ack %+v, want ref %q and duplicate %v", i, ack, key, tt.wantDuplicate[i])
+				}
+
+				if i == 0 {
+					first = ack.MessageID
+				} else if ack.Duplicate && ack.MessageID != first {
+					t.Errorf("send %d: duplicate acked %q, want %q", i, ack.MessageID, first)
+				}
+			}
+
+			settle(t, runningHub(t, m, testRoomID))
+
+			received := 0
+
+			for len(reader.message) > 0 {
+				if event := <-reader.message; event.Type == TypeChatMessage {
+					received++
+				}
+			}
+
+			if received != tt.wantMessages {
+				t.Errorf("got %d messages, want %d", received, tt.wantMessages)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package chat
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Every frame of a connection counts against these
+	connFrameRate		= 10
+	connFrameBurst		= 20
+	connByteRate		= 32 * 1024
+	connByteBurst		= maxFrameSize
+
+	// chat.send frames of a user count against these, across every connection
+	// to this instance
+	userMessageRate		= 3
+	userMessageBurst	= 8
+	userByteRate		= 8 * 1024
+	userByteBurst		= 16 * 1024
+
+	maxMessageLength	= 4000
+
+	// Sending the same content again within this window is suppressed
+	duplicateWindow		= 10 * time.Second
+
+	// Idle user limiters are forgotten after this long
+	userLimiterIdle		= 10 * time.Minute
+	userLimiterSweepAt	= 1024
+)
+
+// tokenBucket holds up to burst tokens, refilled at rate tokens per second.
+// It is not safe for concurrent use.
+type tokenBucket struct {
+	rate	float64
+	burst	float64
+	tokens	float64
+	last	time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens + now.Sub(b.last).Seconds() * b.rate)
+	b.last = now
+}
+
+// wait is how long until n tokens are available, 0 if they are now.
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// takeAll takes a cost from each bucket, or from none of them when one is
+// short, and then reports how long to wait.
+func takeAll(now time.Time, buckets []*tokenBucket, costs []float64) time.Duration {
+	var wait time.Duration
+
+	for i, bucket := range buckets {
+		bucket.refill(now)
+		wait = max(wait, bucket.wait(costs[i]))
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	for i, bucket := range buckets {
+		bucket.tokens -= costs[i]
+	}
+
+	return 0
+}
+
+// throttledError is ErrRateLimited along with when the client may retry.
+type throttledError struct {
+	retryAfter	time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return ErrRateLimited.Error()
+}
+
+func (e *throttledError) Unwrap() error {
+	return ErrRateLimited
+}
+
+func retryAfter(err error) time.Duration {
+	var throttled *throttledError
+
+	if errors.As(err, &throttled) {
+		return throttled.retryAfter
+	}
+
+	return 0
+}
+
+// connLimiter limits one connection. Only its readPump uses it.
+type connLimiter struct {
+	frames	*tokenBucket
+	bytes	*tokenBucket
+}
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{
+		frames: newTokenBucket(connFrameRate, connFrameBurst),
+		bytes: newTokenBucket(connByteRate, connByteBurst),
+	}
+}
+
+func (l *connLimiter) allow(size int) error {
+	wait := takeAll(time.Now(), []*tokenBucket{l.frames, l.bytes}, []float64{1, float64(size)})
+
+	if wait > 0 {
+		return &throttledError{retryAfter: wait}
+	}
+
+	return nil
+}
+
+// userLimiter limits the chat messages of one user and remembers their last
+// message for duplicate suppression.
+type userLimiter struct {
+	mu			sync.Mutex
+	messages	*tokenBucket
+	bytes		*tokenBucket
+	lastContent	string
+	lastAt		time.Time
+}
+
+// allow checks a chat message against the user's limits and records it.
+func (l *userLimiter) allow(content string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if content == l.lastContent && now.Sub(l.lastAt) < duplicateWindow {
+		return ErrDuplicateMessage
+	}
+
+	wait := takeAll(now, []*tokenBucket{l.messages, l.bytes}, []float64{1, float64(len(content))})
+
+	if wait > 0 {
+		return &throttledError{retryAfter: wait}
+	}
+
+	l.lastContent = content
+	l.lastAt = now
+
+	return nil
+}
+
+// userLimits holds a userLimiter per user on this instance.
+type userLimits struct {
+	mu			sync.Mutex
+	limiters	map[string]*userLimiter
+}
+
+func newUserLimits() *userLimits {
+	return &userLimits{limiters: make(map[string]*userLimiter)}
+}
+
+func (u *userLimits) get(userID string) *userLimiter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	limiter, ok := u.limiters[userID]
+
+	if ok {
+		return limiter
+	}
+
+	if len(u.limiters) >= userLimiterSweepAt {
+		u.sweep()
+	}
+
+	limiter = &userLimiter{
+		messages: newTokenBucket(userMessageRate, userMessageBurst),
+		bytes: newTokenBucket(userByteRate, userByteBurst),
+	}
+	u.limiters[userID] = limiter
+
+	return limiter
+}
+
+// sweep forgets limiters idle long enough to have refilled completely.
+func (u *userLimits) sweep() {
+	for userID, limiter := range u.limiters {
+		limiter.mu.Lock()
+		idle := time.Since(limiter.messages.last) > userLimiterIdle
+		limiter.mu.Unlock()
+
+		if idle {
+			delete(u.limiters, userID)
+		}
+	}
+}
+
+// validateContent checks a chat message before it is rate limited.
+func validateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return ErrContentRequired
+	}
+
+	if utf8.RuneCountInString(content) > maxMessageLength {
+		return ErrMessageTooLong
+	}
+
+	return nil
+}
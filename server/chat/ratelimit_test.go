@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTakeAll(t *testing.T) {
+	start := time.Now()
+
+	type take struct {
+		after		time.Duration
+		costs		[]float64
+		wantWait	bool
+	}
+
+	tests := []struct {
+		name	string
+		takes	[]take
+	}{
+		{
+			name: "burst then empty",
+			takes: []take{{costs: []float64{2, 0}}, {costs: []float64{2, 0}}, {costs: []float64{1, 0}, wantWait: true}},
+		},
+		{
+			name: "refills over time",
+			takes: []take{{costs: []float64{4, 0}}, {after: 500 * time.Millisecond, costs: []float64{1, 0}}, {after: 500 * time.Millisecond, costs: []float64{2, 0}, wantWait: true}},
+		},
+		{
+			name: "never above the burst",
+			takes: []take{{after: time.Hour, costs: []float64{5, 0}, wantWait: true}, {after: time.Hour, costs: []float64{4, 0}}},
+		},
+		{
+			name: "short bucket takes from none",
+			takes: []take{{costs: []float64{1, 200}, wantWait: true}, {costs: []float64{4, 100}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 2 tokens per second up to 4, and 100 bytes with no refill
+			buckets := []*tokenBucket{
+				{rate: 2, burst: 4, tokens: 4, last: start},
+				{rate: 0.000001, burst: 100, tokens: 100, last: start},
+			}
+
+			now := start
+
+			for i, tk := range tt.takes {
+				now = now.Add(tk.after)
+
+				if wait := takeAll(now, buckets, tk.costs); (wait > 0) != tk.wantWait {
+					t.Fatalf("take %d: got wait %v, want wait %v", i, wait, tk.wantWait)
+				}
+			}
+		})
+	}
+}
+
+// distinct returns n different messages of about size bytes.
+func distinct(n int, size int) []string {
+	contents := make([]string, n)
+
+	for i := range contents {
+		contents[i] = fmt.Sprintf("%d", i) + strings.Repeat("x", size)
+	}
+
+	return contents
+}
+
+func TestUserLimiter(t *testing.T) {
+	tests := []struct {
+		name		string
+		contents	[]string
+		wantErr		error
+	}{
+		{name: "within the burst", contents: distinct(userMessageBurst, 10)},
+		{name: "message burst exceeded", contents: distinct(userMessageBurst + 1, 10), wantErr: ErrRateLimited},
+		{name: "byte burst exceeded", contents: distinct(3, userByteBurst / 2), wantErr: ErrRateLimited},
+		{name: "same content again", contents: []string{"hello", "hello"}, wantErr: ErrDuplicateMessage},
+		{name: "same content after another message", contents: []string{"hello", "world", "hello"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newUserLimits().get("alice")
+
+			var err error
+
+			for _, content := range tt.contents {
+				if err = limiter.allow(content); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if errors.Is(err, ErrRateLimited) && retryAfter(err) <= 0 {
+				t.Errorf("got retry after %v, want a positive delay", retryAfter(err))
+			}
+		})
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	tests := []struct {
+		name	string
+		content	string
+		wantErr	error
+	}{
+		{name: "empty", content: "", wantErr: ErrContentRequired},
+		{name: "whitespace", content: " \n\t", wantErr: ErrContentRequired},
+		{name: "longest", content: strings.Repeat("a", maxMessageLength)},
+		{name: "too long", content: strings.Repeat("a", maxMessageLength + 1), wantErr: ErrMessageTooLong},
+		{name: "multibyte counted in characters", content: strings.Repeat("é", maxMessageLength)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateContent(tt.content); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestThrottledSendsGetErrorFrames(t *testing.T) {
+	tests := []struct {
+		name		string
+		contents	[]string
+		wantCode	string
+		wantRetry	bool
+	}{
+		{name: "flood", contents: distinct(userMessageBurst + 1, 10), wantCode: "rate_limited", wantRetry: true},
+		{name: "duplicate", contents: []string{"hello", "hello"}, wantCode: "duplicate_message"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+			client := joinStalled(t, m, testRoomID, "alice")
+
+			for i, content := range tt.contents {
+				if err := client.handle(frame(t, TypeChatSend, fmt.Sprintf("send-%d", i), ChatSendPayload{Content: content})); err != nil {
+					t.Fatalf("send %d: %v", i, err)
+				}
+
+				settle(t, runningHub(t, m, testRoomID))
+			}
+
+			var last Envelope
+
+			for len(client.message) > 0 {
+				if event := <-client.message; event.Type == TypeError {
+					last = event
+				}
+			}
+
+			var payload ErrorPayload
+
+			if err := json.Unmarshal(last.Payload, &payload); err != nil {
+				t.Fatalf("no error frame: %v", err)
+			}
+
+			if payload.Code != tt.wantCode || (payload.RetryAfterMs > 0) != tt.wantRetry {
+				t.Errorf("got error %+v, want code %q and retry %v", payload, tt.wantCode, tt.wantRetry)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReactions(t *testing.T) {
+	type reaction struct {
+		userID		string
+		remove		bool
+		emoji		string
+		messageID	func(sent string) string
+
+		// wantCount is the count broadcast, or -1 when nothing changed
+		wantCount	int
+		wantErr		error
+	}
+
+	tests := []struct {
+		name		string
+		reactions	[]reaction
+	}{
+		{
+			name: "counts add up across users",
+			reactions: []reaction{{userID: "alice", emoji: "👍", wantCount: 1}, {userID: "bob", emoji: "👍", wantCount: 2}, {userID: "bob", emoji: "🎉", wantCount: 1}},
+		},
+		{
+			name: "same reaction twice changes nothing",
+			reactions: []reaction{{userID: "bob", emoji: "👍", wantCount: 1}, {userID: "bob", emoji: "👍", wantCount: -1}},
+		},
+		{
+			name: "remove",
+			reactions: []reaction{{userID: "alice", emoji: "👍", wantCount: 1}, {userID: "bob", emoji: "👍", wantCount: 2}, {userID: "alice", remove: true, emoji: "👍", wantCount: 1}},
+		},
+		{
+			name: "remove a missing reaction",
+			reactions: []reaction{{userID: "bob", remove: true, emoji: "👍", wantCount: -1}},
+		},
+		{
+			name: "emoji sequence",
+			reactions: []reaction{{userID: "bob", emoji: "👩‍💻", wantCount: 1}},
+		},
+		{name: "empty emoji", reactions: []reaction{{userID: "bob", emoji: "", wantErr: ErrInvalidEmoji}}},
+		{name: "emoji with spaces", reactions: []reaction{{userID: "bob", emoji: "👍 👍", wantErr: ErrInvalidEmoji}}},
+		{
+			name: "missing message id",
+			reactions: []reaction{{userID: "bob", emoji: "👍", messageID: func(string) string { return "" }, wantErr: ErrMessageIDRequired}},
+		},
+		{
+			name: "unknown message",
+			reactions: []reaction{{userID: "bob", emoji: "👍", messageID: func(string) string { return "66666666-6666-6666-6666-666666666666" }, wantErr: ErrMessageNotFound}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onMessages(db)
+			onReactions(db)
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+
+			clients := map[string]*ChatClient{
+				"alice": joinStalled(t, m, testRoomID, "alice"),
+				"bob": joinStalled(t, m, testRoomID, "bob"),
+			}
+
+			messageID := send(t, clients["alice"], "hello")
+			observer := joinStalled(t, m, testRoomID, "observer")
+
+			for i, r := range tt.reactions {
+				frameType := TypeReactionAdd
+
+				if r.remove {
+					frameType = TypeReactionRemove
+				}
+
+				target := messageID
+
+				if r.messageID != nil {
+					target = r.messageID(messageID)
+				}
+
+				err := clients[r.userID].handle(frame(t, frameType, "react", ReactionPayload{MessageID: target, Emoji: r.emoji}))
+
+				if !errors.Is(err, r.wantErr) {
+					t.Fatalf("reaction %d: got %v, want %v", i, err, r.wantErr)
+				}
+
+				settle(t, runningHub(t, m, testRoomID))
+
+				var events []ReactionEvent
+
+				for len(observer.message) > 0 {
+					if event := <-observer.message; event.Type == TypeReaction {
+						var payload ReactionEvent
+						json.Unmarshal(event.Payload, &payload)
+						events = append(events, payload)
+					}
+				}
+
+				if err != nil || r.wantCount < 0 {
+					if len(events) != 0 {
+						t.Errorf("reaction %d: got events %+v, want none", i, events)
+					}
+					continue
+				}
+
+				want := ReactionEvent{RoomID: testRoomID, MessageID: messageID, UserID: r.userID, Emoji: r.emoji, Action: "add", Count: r.wantCount}
+
+				if r.remove {
+					want.Action = "remove"
+				}
+
+				if len(events) != 1 || events[0] != want {
+					t.Errorf("reaction %d: got events %+v, want %+v", i, events, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRepliesJoinThreads(t *testing.T) {
+	const otherRoomID = "44444444-4444-4444-4444-444444444444"
+
+	tests := []struct {
+		name		string
+		replyTo		func(ids map[string]string) string
+		wantThread	string
+		wantErr		error
+	}{
+		{name: "reply to a message starts its thread", replyTo: func(ids map[string]string) string { return ids["root"] }, wantThread: "root"},
+		{name: "reply to a reply stays in the thread", replyTo: func(ids map[string]string) string { return ids["reply"] }, wantThread: "root"},
+		{name: "unknown message", replyTo: func(map[string]string) string { return "66666666-6666-6666-6666-666666666666" }, wantErr: ErrMessageNotFound},
+		{name: "message of another room", replyTo: func(ids map[string]string) string { return ids["elsewhere"] }, wantErr: ErrMessageNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onMessages(db)
+			m := newTestManagerWithDB(t, db, PolicyDropOldest, NewMemoryBroker())
+
+			alice := joinStalled(t, m, testRoomID, "alice")
+			stranger := joinStalled(t, m, otherRoomID, "stranger")
+
+			ids := map[string]string{
+				"root": send(t, alice, "root"),
+				"elsewhere": send(t, stranger, "elsewhere"),
+			}
+
+			if err := alice.handle(frame(t, TypeChatSend, "reply", ChatSendPayload{Content: "reply", ReplyTo: ids["root"]})); err != nil {
+				t.Fatalf("failed to reply: %v", err)
+			}
+
+			var ack AckPayload
+
+			if err := json.Unmarshal(nextEvent(t, alice, TypeAck).Payload, &ack); err != nil {
+				t.Fatalf("invalid ack: %v", err)
+			}
+
+			ids["reply"] = ack.MessageID
+
+			replyTo := tt.replyTo(ids)
+			err := alice.handle(frame(t, TypeChatSend, "answer", ChatSendPayload{Content: "answer", ReplyTo: replyTo}))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			var message ChatMessage
+
+			if err := json.Unmarshal(nextEvent(t, alice, TypeChatMessage).Payload, &message); err != nil {
+				t.Fatalf("invalid message: %v", err)
+			}
+
+			if message.ReplyToID != replyTo || message.ThreadID != ids[tt.wantThread] {
+				t.Errorf("got reply to %q in thread %q, want %q in %q", message.ReplyToID, message.ThreadID, replyTo, ids[tt.wantThread])
+			}
+		})
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	history := []ChatMessage{
+		{ID: "root", RoomID: testRoomID, UserID: "alice", Content: "root", CreatedAt: base},
+		{ID: "r1", RoomID: testRoomID, UserID: "bob", Content: "1", ReplyToID: "root", ThreadID: "root", CreatedAt: base.Add(time.Second)},
+		{ID: "r2", RoomID: testRoomID, UserID: "alice", Content: "2", ReplyToID: "r1", ThreadID: "root", CreatedAt: base.Add(2 * time.Second)},
+		{ID: "r3", RoomID: testRoomID, UserID: "bob", Content: "3", ReplyToID: "root", ThreadID: "root", CreatedAt: base.Add(3 * time.Second)},
+		{ID: "other", RoomID: testRoomID, UserID: "bob", Content: "x", CreatedAt: base.Add(4 * time.Second)},
+	}
+
+	cursor := func(i int) string { return newMessageCursor(history[i]).encode() }
+
+	tests := []struct {
+		name		string
+		messageID	string
+		after		string
+		limit		int
+		wantRoot	string
+		wantReplies	[]string
+		wantMore	bool
+		wantErr		error
+	}{
+		{name: "from the root", messageID: "root", wantRoot: "root", wantReplies: []string{"r1", "r2", "r3"}},
+		{name: "from a reply", messageID: "r2", wantRoot: "root", wantReplies: []string{"r1", "r2", "r3"}},
+		{name: "first page", messageID: "root", limit: 2, wantRoot: "root", wantReplies: []string{"r1", "r2"}, wantMore: true},
+		{name: "next page", messageID: "root", after: cursor(2), limit: 2, wantRoot: "root", wantReplies: []string{"r3"}},
+		{name: "message without replies", messageID: "other", wantRoot: "other", wantReplies: []string{}},
+		{name: "unknown message", messageID: "missing", wantErr: ErrMessageNotFound},
+		{name: "invalid cursor", messageID: "root", after: "nope", wantErr: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			onMessages(db).add(history...)
+			reactions := onReactions(db)
+			reactions.reactions[[3]string{"r1", "alice", "👍"}] = true
+
+			page, err := s.getThread(tt.messageID, "alice", tt.after, tt.limit)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if page.Root.ID != tt.wantRoot {
+				t.Errorf("got root %q, want %q", page.Root.ID, tt.wantRoot)
+			}
+
+			if got := messageIDs(page.Replies); !reflect.DeepEqual(got, tt.wantReplies) {
+				t.Errorf("got replies %v, want %v", got, tt.wantReplies)
+			}
+
+			if page.HasMore != tt.wantMore {
+				t.Errorf("got has_more %v, want %v", page.HasMore, tt.wantMore)
+			}
+
+			for _, reply := range page.Replies {
+				if reply.ID == "r1" && (len(reply.Reactions) != 1 || reply.Reactions[0] != (ReactionCount{Emoji: "👍", Count: 1})) {
+					t.Errorf("got reactions %+v on r1", reply.Reactions)
+				}
+			}
+		})
+	}
+}
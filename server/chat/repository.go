@@ -0,0 +1,1085 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+type ChatRepository struct {
+	DB	*sql.DB
+}
+
+func NewChatRepository(db *sql.DB) *ChatRepository {
+	return &ChatRepository{
+		DB: db,
+	}
+}
+
+// insertMessages writes a batch of messages with a single multi-row INSERT.
+// Messages already written by an early edit or delete are skipped.
+func (r *ChatRepository) insertMessages(messages []ChatMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	var query strings.Builder
+	args := make([]any, 0, len(messages) * 7)
+
+	query.WriteString("INSERT INTO messages(id, room_id, user_id, content, reply_to_id, thread_id, created_at) VALUES ")
+
+	for i, message := range messages {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+
+		n := i * 7
+		fmt.Fprintf(&query, "($%d, $%d, $%d, $%d, NULLIF($%d, ''), NULLIF($%d, ''), $%d)", n + 1, n + 2, n + 3, n + 4, n + 5, n + 6, n + 7)
+		args = append(args, message.ID, message.RoomID, message.UserID, message.Content, message.ReplyToID, message.ThreadID, message.CreatedAt)
+	}
+
+	query.WriteString(" ON CONFLICT (id) DO NOTHING")
+
+	_, err := r.DB.Exec(query.String(), args...)
+
+	return err
+}
+
+// selectMessages returns messages of a room strictly past the cursor. When forward is
+// false rows are ordered newest-first (older than the cursor), otherwise
+// oldest-first (newer than the cursor).
+func (r *ChatRepository) selectMessages(roomID string, cursor *messageCursor, forward bool, limit int) ([]ChatMessage, error) {
+	var messages = []ChatMessage{}
+
+	query := `SELECT ` + messageColumns + `
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.room_id = $1 AND m.deleted_at IS NULL`
+	args := []any{roomID}
+
+	if cursor != nil {
+		if forward {
+			query += " AND (m.created_at, m.id) > ($2, $3)"
+		} else {
+			query += " AND (m.created_at, m.id) < ($2, $3)"
+		}
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+
+	if forward {
+		query += " ORDER BY m.created_at ASC, m.id ASC"
+	} else {
+		query += " ORDER BY m.created_at DESC, m.id DESC"
+	}
+
+	query += fmt.Sprintf(" LIMIT $%d", len(args) + 1)
+	args = append(args, limit)
+
+	rows, err := r.DB.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		message, err := scanMessage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// messageColumns is read by scanMessage, from messages m joined with users u.
+const messageColumns = `m.id, m.room_id, m.user_id, u.username, m.content,
+	COALESCE(m.reply_to_id, ''), COALESCE(m.thread_id, ''), m.edited_at, m.created_at`
+
+func scanMessage(row interface{ Scan(dest ...any) error }) (*ChatMessage, error) {
+	var message ChatMessage
+
+	err := row.Scan(&message.ID, &message.RoomID, &message.UserID, &message.Username, &message.Content, &message.ReplyToID, &message.ThreadID, &message.EditedAt, &message.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func (r *ChatRepository) selectRooms(limit int, offset int) ([]Room, error) {
+	var rooms = []Room{}
+
+	rows, err := r.DB.Query(
+		"SELECT id, name, created_at, updated_at FROM rooms ORDER BY created_at ASC LIMIT $1 OFFSET $2",
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var room Room
+
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return rooms, nil
+}
+
+func (r *ChatRepository) selectRoomByID(id string) (*Room, error) {
+	var room Room
+
+	row := r.DB.QueryRow(
+		"SELECT id, name, created_at, updated_at FROM rooms WHERE id = $1",
+		id,
+	)
+
+	if err := row.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoomNotFound
+		}
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+func (r *ChatRepository) selectRoomByName(name string) (*Room, error) {
+	var room Room
+
+	row := r.DB.QueryRow(
+		"SELECT id, name, created_at, updated_at FROM rooms WHERE name = $1",
+		name,
+	)
+
+	if err := row.Scan(&room.ID, &room.Name, &room.CreatedAt, &room.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoomNotFound
+		}
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+func (r *ChatRepository) insertRoom(room *Room) (*Room, error) {
+	var insertedRoom Room
+
+	err := r.DB.QueryRow(
+		`INSERT INTO rooms(id, name)
+		VALUES($1, $2)
+		RETURNING id, name, created_at, updated_at
+		`,
+		room.ID,
+		room.Name,
+	).Scan(&insertedRoom.ID, &insertedRoom.Name, &insertedRoom.CreatedAt, &insertedRoom.UpdatedAt)
+
+	if err != nil {
+		if utils.IsUniqueViolation(err) {
+			return nil, ErrRoomNameExists
+		}
+		return nil, err
+	}
+
+	return &insertedRoom, nil
+}
+
+func (r *ChatRepository) updateRoom(room *Room) (*Room, error) {
+	var updatedRoom Room
+
+	err := r.DB.QueryRow(
+		`UPDATE rooms SET name = $2
+		WHERE id = $1
+		RETURNING id, name, created_at, updated_at
+		`,
+		room.ID,
+		room.Name,
+	).Scan(&updatedRoom.ID, &updatedRoom.Name, &updatedRoom.CreatedAt, &updatedRoom.UpdatedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRoomNotFound
+		}
+		if utils.IsUniqueViolation(err) {
+			return nil, ErrRoomNameExists
+		}
+		return nil, err
+	}
+
+	return &updatedRoom, nil
+}
+
+func (r *ChatRepository) deleteRoom(id string) error {
+	result, err := r.DB.Exec("DELETE FROM rooms WHERE id = $1", id)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrRoomNotFound
+	}
+
+	return nil
+}
+
+func (r *ChatRepository) upsertRoomSanction(sanction *RoomSanction) (*RoomSanction, error) {
+	var inserted RoomSanction
+
+	err := r.DB.QueryRow(
+		`INSERT INTO room_sanctions(room_id, user_id, kind, reason, expires_at, created_by)
+		VALUES($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room_id, user_id, kind) DO UPDATE SET
+			reason = EXCLUDED.reason,
+			expires_at = EXCLUDED.expires_at,
+			created_by = EXCLUDED.created_by,
+			created_at = NOW()
+		RETURNING room_id, user_id, kind, reason, expires_at, created_by, created_at
+		`,
+		sanction.RoomID,
+		sanction.UserID,
+		sanction.Kind,
+		sanction.Reason,
+		sanction.ExpiresAt,
+		sanction.CreatedBy,
+	).Scan(&inserted.RoomID, &inserted.UserID, &inserted.Kind, &inserted.Reason, &inserted.ExpiresAt, &inserted.CreatedBy, &inserted.CreatedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &inserted, nil
+}
+
+func (r *ChatRepository) deleteRoomSanction(roomID string, userID string, kind string) error {
+	result, err := r.DB.Exec(
+		"DELETE FROM room_sanctions WHERE room_id = $1 AND user_id = $2 AND kind = $3",
+		roomID,
+		userID,
+		kind,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrSanctionNotFound
+	}
+
+	return nil
+}
+
+func (r *ChatRepository) selectActiveRoomSanctions(roomID string, kind string) ([]RoomSanction, error) {
+	var sanctions = []RoomSanction{}
+
+	rows, err := r.DB.Query(
+		`SELECT room_id, user_id, kind, reason, expires_at, created_by, created_at
+		FROM room_sanctions
+		WHERE room_id = $1 AND kind = $2 AND (expires_at IS NULL OR expires_at > NOW())`,
+		roomID,
+		kind,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var sanction RoomSanction
+
+		if err := rows.Scan(&sanction.RoomID, &sanction.UserID, &sanction.Kind, &sanction.Reason, &sanction.ExpiresAt, &sanction.CreatedBy, &sanction.CreatedAt); err != nil {
+			return nil, err
+		}
+		sanctions = append(sanctions, sanction)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sanctions, nil
+}
+
+func (r *ChatRepository) selectActiveRoomSanction(roomID string, userID string, kind string) (bool, error) {
+	var active bool
+
+	err := r.DB.QueryRow(
+		`SELECT EXISTS(
+			SELECT 1 FROM room_sanctions
+			WHERE room_id = $1 AND user_id = $2 AND kind = $3 AND (expires_at IS NULL OR expires_at > NOW())
+		)`,
+		roomID,
+		userID,
+		kind,
+	).Scan(&active)
+
+	return active, err
+}
+
+// upsertReadCursor moves a read cursor forward. Cursors never move back, so
+// when the stored one is newer it is returned unchanged.
+func (r *ChatRepository) upsertReadCursor(cursor *ReadCursor) (*ReadCursor, error) {
+	var updated ReadCursor
+
+	err := r.DB.QueryRow(
+		`INSERT INTO read_cursors(user_id, room_id, message_id, last_read_at)
+		VALUES($1, $2, $3, $4)
+		ON CONFLICT (user_id, room_id) DO UPDATE SET
+			message_id = EXCLUDED.message_id,
+			last_read_at = EXCLUDED.last_read_at,
+			updated_at = NOW()
+		WHERE read_cursors.last_read_at < EXCLUDED.last_read_at
+		RETURNING user_id, room_id, message_id, last_read_at
+		`,
+		cursor.UserID,
+		cursor.RoomID,
+		cursor.MessageID,
+		cursor.LastReadAt,
+	).Scan(&updated.UserID, &updated.RoomID, &updated.MessageID, &updated.LastReadAt)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.selectReadCursor(cursor.UserID, cursor.RoomID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+func (r *ChatRepository) selectReadCursor(userID string, roomID string) (*ReadCursor, error) {
+	var cursor ReadCursor
+
+	err := r.DB.QueryRow(
+		"SELECT user_id, room_id, message_id, last_read_at FROM read_cursors WHERE user_id = $1 AND room_id = $2",
+		userID,
+		roomID,
+	).Scan(&cursor.UserID, &cursor.RoomID, &cursor.MessageID, &cursor.LastReadAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor, nil
+}
+
+func (r *ChatRepository) selectReadCursors(roomID string) ([]ReadCursor, error) {
+	var cursors = []ReadCursor{}
+
+	rows, err := r.DB.Query(
+		`SELECT c.user_id, u.username, c.room_id, c.message_id, c.last_read_at
+		FROM read_cursors c
+		JOIN users u ON u.id = c.user_id AND u.deleted_at IS NULL
+		WHERE c.room_id = $1
+		ORDER BY c.last_read_at DESC`,
+		roomID,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var cursor ReadCursor
+
+		if err := rows.Scan(&cursor.UserID, &cursor.Username, &cursor.RoomID, &cursor.MessageID, &cursor.LastReadAt); err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, cursor)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
+
+// selectUnreadCounts counts, per room, the messages from other users newer
+// than the user's read cursor. Rooms never read count every message.
+func (r *ChatRepository) selectUnreadCounts(userID string) ([]UnreadCount, error) {
+	var counts = []UnreadCount{}
+
+	rows, err := r.DB.Query(
+		`SELECT r.id, COUNT(m.id)
+		FROM rooms r
+		LEFT JOIN read_cursors c ON c.room_id = r.id AND c.user_id = $1
+		LEFT JOIN messages m ON m.room_id = r.id
+			AND m.deleted_at IS NULL
+			AND m.user_id <> $1
+			AND m.created_at > COALESCE(c.last_read_at, '-infinity')
+		GROUP BY r.id
+		ORDER BY r.id`,
+		userID,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var count UnreadCount
+
+		if err := rows.Scan(&count.RoomID, &count.Unread); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (r *ChatRepository) selectMessageByID(id string) (*ChatMessage, error) {
+	message, err := scanMessage(r.DB.QueryRow(
+		`SELECT `+ messageColumns + `
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.id = $1 AND m.deleted_at IS NULL`,
+		id,
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// selectThreadReplies returns the replies of a thread oldest-first, strictly
+// after the cursor.
+func (r *ChatRepository) selectThreadReplies(threadID string, cursor *messageCursor, limit int) ([]ChatMessage, error) {
+	var messages = []ChatMessage{}
+
+	query := `SELECT ` + messageColumns + `
+		FROM messages m JOIN users u ON u.id = m.user_id
+		WHERE m.thread_id = $1 AND m.deleted_at IS NULL`
+	args := []any{threadID}
+
+	if cursor != nil {
+		query += " AND (m.created_at, m.id) > ($2, $3)"
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+
+	query += fmt.Sprintf(" ORDER BY m.created_at ASC, m.id ASC LIMIT $%d", len(args) + 1)
+	args = append(args, limit)
+
+	rows, err := r.DB.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		message, err := scanMessage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// insertReaction reports whether the reaction is new.
+func (r *ChatRepository) insertReaction(messageID string, userID string, emoji string) (bool, error) {
+	result, err := r.DB.Exec(
+		`INSERT INTO message_reactions(message_id, user_id, emoji) VALUES($1, $2, $3)
+		ON CONFLICT DO NOTHING`,
+		messageID,
+		userID,
+		emoji,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+// deleteReaction reports whether the reaction existed.
+func (r *ChatRepository) deleteReaction(messageID string, userID string, emoji string) (bool, error) {
+	result, err := r.DB.Exec(
+		"DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND emoji = $3",
+		messageID,
+		userID,
+		emoji,
+	)
+
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
+}
+
+func (r *ChatRepository) countReactions(messageID string, emoji string) (int, error) {
+	var count int
+
+	err := r.DB.QueryRow(
+		"SELECT COUNT(*) FROM message_reactions WHERE message_id = $1 AND emoji = $2",
+		messageID,
+		emoji,
+	).Scan(&count)
+
+	return count, err
+}
+
+// selectReactionCounts aggregates the reactions of several messages, most
+// used emoji first.
+func (r *ChatRepository) selectReactionCounts(messageIDs []string) (map[string][]ReactionCount, error) {
+	counts := make(map[string][]ReactionCount)
+
+	if len(messageIDs) == 0 {
+		return counts, nil
+	}
+
+	rows, err := r.DB.Query(
+		`SELECT message_id, emoji, COUNT(*) AS count
+		FROM message_reactions
+		WHERE message_id = ANY($1)
+		GROUP BY message_id, emoji
+		ORDER BY count DESC, MIN(created_at) ASC`,
+		pq.Array(messageIDs),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var messageID string
+		var count ReactionCount
+
+		if err := rows.Scan(&messageID, &count.Emoji, &count.Count); err != nil {
+			return nil, err
+		}
+		counts[messageID] = append(counts[messageID], count)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// ensureMessage writes a message still waiting in the persister queue, so it
+// can be edited or deleted right away.
+func ensureMessage(tx *sql.Tx, message *ChatMessage) error {
+	_, err := tx.Exec(
+		`INSERT INTO messages(id, room_id, user_id, content, reply_to_id, thread_id, created_at)
+		VALUES($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, ''), $7)
+		ON CONFLICT (id) DO NOTHING`,
+		message.ID,
+		message.RoomID,
+		message.UserID,
+		message.Content,
+		message.ReplyToID,
+		message.ThreadID,
+		message.CreatedAt,
+	)
+
+	return err
+}
+
+// updateMessageContent records the previous content in message_edits and
+// replaces it.
+func (r *ChatRepository) updateMessageContent(message *ChatMessage, content string, editedBy string) (*time.Time, error) {
+	tx, err := r.DB.Begin()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if err := ensureMessage(tx, message); err != nil {
+		return nil, err
+	}
+
+	var previous string
+
+	err = tx.QueryRow(
+		"SELECT content FROM messages WHERE id = $1 AND deleted_at IS NULL FOR UPDATE",
+		message.ID,
+	).Scan(&previous)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO message_edits(id, message_id, previous_content, edited_by) VALUES($1, $2, $3, $4)",
+		uuid.New().String(),
+		message.ID,
+		previous,
+		editedBy,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var editedAt time.Time
+
+	err = tx.QueryRow(
+		"UPDATE messages SET content = $2, edited_at = NOW() WHERE id = $1 RETURNING edited_at",
+		message.ID,
+		content,
+	).Scan(&editedAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &editedAt, nil
+}
+
+// softDeleteMessage hides a message of its room from history, writing it
+// first when it is still queued.
+func (r *ChatRepository) softDeleteMessage(message *ChatMessage, deletedBy string) error {
+	tx, err := r.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	if err := ensureMessage(tx, message); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		"UPDATE messages SET deleted_at = NOW(), deleted_by = $2 WHERE id = $1 AND room_id = $3 AND deleted_at IS NULL",
+		message.ID,
+		deletedBy,
+		message.RoomID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return tx.Commit()
+}
+
+func (r *ChatRepository) selectMessageEdits(messageID string) ([]MessageEdit, error) {
+	var edits = []MessageEdit{}
+
+	rows, err := r.DB.Query(
+		`SELECT id, message_id, previous_content, edited_by, edited_at
+		FROM message_edits
+		WHERE message_id = $1
+		ORDER BY edited_at ASC`,
+		messageID,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var edit MessageEdit
+
+		if err := rows.Scan(&edit.ID, &edit.MessageID, &edit.PreviousContent, &edit.EditedBy, &edit.EditedAt); err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return edits, nil
+}
+
+func (r *ChatRepository) selectUsername(userID string) (string, error) {
+	var username string
+
+	err := r.DB.QueryRow("SELECT username FROM users WHERE id = $1 AND deleted_at IS NULL", userID).Scan(&username)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+
+	return username, nil
+}
+
+func (r *ChatRepository) selectUserRole(userID string) (string, error) {
+	var role string
+
+	err := r.DB.QueryRow("SELECT role FROM users WHERE id = $1", userID).Scan(&role)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrUserNotFound
+		}
+		return "", err
+	}
+
+	return role, nil
+}
+
+// insertWsTicket stores a ticket hash, dropping expired tickets on the way.
+func (r *ChatRepository) insertWsTicket(ticketHash string, user *utils.AuthorizedUserInfo, expiresAt time.Time) error {
+	if _, err := r.DB.Exec("DELETE FROM ws_tickets WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+
+	_, err := r.DB.Exec(
+		`INSERT INTO ws_tickets (ticket_hash, user_id, username, session_id, role, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		ticketHash,
+		user.ID,
+		user.Username,
+		user.SessionID,
+		user.Role,
+		expiresAt,
+	)
+
+	return err
+}
+
+// consumeWsTicket deletes an unexpired ticket and returns who it was issued
+// to, so each ticket is redeemed once across every instance.
+func (r *ChatRepository) consumeWsTicket(ticketHash string) (*utils.AuthorizedUserInfo, error) {
+	var user utils.AuthorizedUserInfo
+
+	err := r.DB.QueryRow(
+		`DELETE FROM ws_tickets WHERE ticket_hash = $1 AND expires_at > NOW()
+		RETURNING user_id, username, session_id, role`,
+		ticketHash,
+	).Scan(&user.ID, &user.Username, &user.SessionID, &user.Role)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrInvalidTicket
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// directMessageColumns is read by scanDirectMessage, from direct_messages d
+// joined with direct_conversations c and the sender u.
+const directMessageColumns = `d.id, d.conversation_id, d.sender_id, u.username,
+	CASE WHEN d.sender_id = c.user_a_id THEN c.user_b_id ELSE c.user_a_id END,
+	d.content, d.created_at`
+
+func scanDirectMessage(row interface{ Scan(dest ...any) error }, extra ...any) (*DirectMessage, error) {
+	var message DirectMessage
+
+	dest := []any{&message.ID, &message.ConversationID, &message.SenderID, &message.SenderUsername, &message.RecipientID, &message.Content, &message.CreatedAt}
+
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// insertDirectMessage writes a direct message, starting the conversation of
+// userA and userB (userA < userB) on their first one.
+func (r *ChatRepository) insertDirectMessage(userA string, userB string, message *DirectMessage) error {
+	tx, err := r.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// The no-op update makes RETURNING work for existing conversations too
+	err = tx.QueryRow(
+		`INSERT INTO direct_conversations(id, user_a_id, user_b_id) VALUES($1, $2, $3)
+		ON CONFLICT (user_a_id, user_b_id) DO UPDATE SET user_a_id = EXCLUDED.user_a_id
+		RETURNING id`,
+		uuid.New().String(),
+		userA,
+		userB,
+	).Scan(&message.ConversationID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO direct_messages(id, conversation_id, sender_id, content, created_at) VALUES($1, $2, $3, $4, $5)",
+		message.ID,
+		message.ConversationID,
+		message.SenderID,
+		message.Content,
+		message.CreatedAt,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *ChatRepository) selectConversationID(userA string, userB string) (string, error) {
+	var id string
+
+	err := r.DB.QueryRow(
+		"SELECT id FROM direct_conversations WHERE user_a_id = $1 AND user_b_id = $2",
+		userA,
+		userB,
+	).Scan(&id)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrConversationNotFound
+		}
+		return "", err
+	}
+
+	return id, nil
+}
+
+// selectDirectMessages reads a conversation newest-first, starting before
+// cursor when given.
+func (r *ChatRepository) selectDirectMessages(conversationID string, cursor *messageCursor, limit int) ([]DirectMessage, error) {
+	var messages = []DirectMessage{}
+
+	query := `SELECT ` + directMessageColumns + `
+		FROM direct_messages d
+		JOIN direct_conversations c ON c.id = d.conversation_id
+		JOIN users u ON u.id = d.sender_id
+		WHERE d.conversation_id = $1`
+	args := []any{conversationID}
+
+	if cursor != nil {
+		query += " AND (d.created_at, d.id) < ($2, $3)"
+		args = append(args, cursor.CreatedAt, cursor.ID)
+	}
+
+	query += fmt.Sprintf(" ORDER BY d.created_at DESC, d.id DESC LIMIT $%d", len(args) + 1)
+	args = append(args, limit)
+
+	rows, err := r.DB.Query(query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		message, err := scanDirectMessage(rows)
+
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *message)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+func (r *ChatRepository) selectDirectMessage(conversationID string, messageID string) (*DirectMessage, error) {
+	row := r.DB.QueryRow(
+		`SELECT `+ directMessageColumns + `
+		FROM direct_messages d
+		JOIN direct_conversations c ON c.id = d.conversation_id
+		JOIN users u ON u.id = d.sender_id
+		WHERE d.conversation_id = $1 AND d.id = $2`,
+		conversationID,
+		messageID,
+	)
+
+	message, err := scanDirectMessage(row)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// upsertDirectReadCursor moves a conversation read cursor forward only.
+func (r *ChatRepository) upsertDirectReadCursor(cursor *DirectReadCursor) (*DirectReadCursor, error) {
+	var updated DirectReadCursor
+
+	err := r.DB.QueryRow(
+		`INSERT INTO direct_read_cursors(conversation_id, user_id, last_read_at)
+		VALUES($1, $2, $3)
+		ON CONFLICT (conversation_id, user_id) DO UPDATE SET
+			last_read_at = GREATEST(direct_read_cursors.last_read_at, EXCLUDED.last_read_at),
+			updated_at = NOW()
+		RETURNING conversation_id, user_id, last_read_at
+		`,
+		cursor.ConversationID,
+		cursor.UserID,
+		cursor.LastReadAt,
+	).Scan(&updated.ConversationID, &updated.UserID, &updated.LastReadAt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// selectConversations lists the conversations of userID, most recently
+// active first, with their last message and how many messages from the other
+// participant are unread.
+func (r *ChatRepository) selectConversations(userID string, limit int, offset int) ([]Conversation, error) {
+	var conversations = []Conversation{}
+
+	rows, err := r.DB.Query(
+		`SELECT `+ directMessageColumns + `, o.id, o.username,
+			(SELECT COUNT(*) FROM direct_messages n
+			WHERE n.conversation_id = c.id
+				AND n.sender_id <> $1
+				AND n.created_at > COALESCE(rc.last_read_at, '-infinity'))
+		FROM direct_conversations c
+		JOIN users o ON o.id = CASE WHEN c.user_a_id = $1 THEN c.user_b_id ELSE c.user_a_id END
+		JOIN LATERAL (
+			SELECT * FROM direct_messages
+			WHERE conversation_id = c.id
+			ORDER BY created_at DESC, id DESC
+			LIMIT 1
+		) d ON true
+		JOIN users u ON u.id = d.sender_id
+		LEFT JOIN direct_read_cursors rc ON rc.conversation_id = c.id AND rc.user_id = $1
+		WHERE c.user_a_id = $1 OR c.user_b_id = $1
+		ORDER BY d.created_at DESC, d.id DESC
+		LIMIT $2 OFFSET $3`,
+		userID,
+		limit,
+		offset,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var conversation Conversation
+
+		message, err := scanDirectMessage(rows, &conversation.UserID, &conversation.Username, &conversation.Unread)
+
+		if err != nil {
+			return nil, err
+		}
+
+		conversation.ID = message.ConversationID
+		conversation.LastMessage = *message
+		conversations = append(conversations, conversation)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return conversations, nil
+}
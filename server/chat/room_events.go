@@ -0,0 +1,136 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// Kinds of roomEvent
+const (
+	roomEventMessage	= "message"
+	roomEventFanOut		= "fanout"
+	roomEventModeration	= "moderation"
+	roomEventPresence	= "presence"
+)
+
+// roomEvent is what the hubs of one room on different instances exchange
+// through the broker. Each instance applies its own events directly and
+// ignores them when they come back. Message events carry only the message;
+// receivers build the envelope, so the content is not sent twice.
+type roomEvent struct {
+	Origin		string				`json:"origin"`
+	Kind		string				`json:"kind"`
+	Envelope	*Envelope			`json:"envelope,omitempty"`
+	Message		*ChatMessage		`json:"message,omitempty"`
+	SkipUser	string				`json:"skip_user,omitempty"`
+	Action		*moderationAction	`json:"action,omitempty"`
+	Presence	*PresencePayload	`json:"presence,omitempty"`
+}
+
+// sessionEvent asks every instance to close the connections of a session.
+type sessionEvent struct {
+	Origin		string	`json:"origin"`
+	SessionID	string	`json:"session_id"`
+}
+
+const sessionsTopic = "sessions"
+
+func roomTopic(roomID string) string {
+	return "room:" + roomID
+}
+
+func (m *hubManager) publish(topic string, event any) {
+	data, err := json.Marshal(event)
+
+	if err != nil {
+		log.Printf("failed to encode broker event: %v", err)
+		return
+	}
+
+	if err := m.broker.Publish(topic, data); err != nil {
+		log.Printf("failed to publish to %s: %v", topic, err)
+	}
+}
+
+func (m *hubManager) publishRoom(roomID string, event roomEvent) {
+	event.Origin = m.instanceID
+	m.publish(roomTopic(roomID), event)
+}
+
+// subscribeRoom feeds the broker events of the hub's room into its run loop.
+func (m *hubManager) subscribeRoom(hub *ChatHub) func() {
+	return m.broker.Subscribe(roomTopic(hub.roomID), func(payload []byte) {
+		var event roomEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			log.Printf("invalid room event: %v", err)
+			return
+		}
+
+		if event.Origin == m.instanceID {
+			return
+		}
+
+		select {
+			case hub.remote <- event:
+			case <-hub.done:
+		}
+	})
+}
+
+func (m *hubManager) subscribeSessions() func() {
+	return m.broker.Subscribe(sessionsTopic, func(payload []byte) {
+		var event sessionEvent
+
+		if err := json.Unmarshal(payload, &event); err != nil {
+			log.Printf("invalid session event: %v", err)
+			return
+		}
+
+		if event.Origin != m.instanceID {
+			m.revokeLocalSession(event.SessionID)
+		}
+	})
+}
+
+// fanOutRoom sends an event to the local clients, except skipUser's, and to
+// the other instances.
+func (h *ChatHub) fanOutRoom(event Envelope, skipUser string) {
+	h.fanOutExcept(event, skipUser)
+	h.manager.publishRoom(h.roomID, roomEvent{Kind: roomEventFanOut, Envelope: &event, SkipUser: skipUser})
+}
+
+func (h *ChatHub) fanOutExcept(event Envelope, skipUser string) {
+	for client := range h.clients {
+		if client.user.ID != skipUser {
+			h.deliver(client, event)
+		}
+	}
+}
+
+// receive applies an event published by another instance.
+func (h *ChatHub) receive(event roomEvent) {
+	switch event.Kind {
+		case roomEventMessage:
+			if event.Message == nil {
+				return
+			}
+			h.rememberRecent(*event.Message)
+			h.fanOut(newEnvelope(TypeChatMessage, *event.Message))
+
+		case roomEventFanOut:
+			if event.Envelope != nil {
+				h.fanOutExcept(*event.Envelope, event.SkipUser)
+			}
+
+		case roomEventModeration:
+			if event.Action != nil {
+				h.applyModeration(*event.Action)
+			}
+
+		case roomEventPresence:
+			if event.Presence != nil {
+				h.remotePresence(event.Origin, *event.Presence)
+			}
+	}
+}
@@ -3,6 +3,7 @@ package chat
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -16,43 +17,409 @@ var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-func NewChatRouter() http.Handler {
-	hub := newHub(3)
-	go hub.run()
+// NewChatRouter serves the chat API. The broker carries room events between
+// server instances; use a MemoryBroker for a single instance.
+func NewChatRouter(chatService *ChatService, broker Broker) http.Handler {
+	persister := newMessagePersister(chatService.ChatRepository, 3)
+	manager := newHubManager(chatService, persister, broker)
+	chatService.Sessions.OnSessionRevoked(manager.revokeSession)
+	chatService.shutdown = manager.shutdown
 
 	r := chi.NewRouter()
 
 	r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
-		serveWs(hub, w, r)
+		serveWs(chatService, manager, w, r)
 	})
 
-	r.Post("/media", triggerMedia())
 	r.Post("/webrtc/offer", webrtcOfferHandler)
 
+	r.Group(func(r chi.Router) {
+		r.Use(utils.Authenticate(chatService.KeySet, chatService.Sessions))
+
+		r.Post("/ws-tickets", createWsTicket(chatService))
+
+		r.Get("/rooms", listRooms(chatService))
+		r.Get("/rooms/{roomID}", getRoomByID(chatService))
+		r.Post("/rooms", createRoom(chatService))
+
+		r.Get("/rooms/{roomID}/reads", listReadCursors(chatService))
+		r.Get("/unread", listUnreadCounts(chatService))
+
+		r.Get("/messages", listMessages(chatService))
+		r.Get("/messages/{messageID}/thread", getThread(chatService))
+		r.Patch("/messages/{messageID}", editMessage(manager))
+		r.Delete("/messages/{messageID}", deleteMessage(manager))
+		r.Get("/direct", listConversations(chatService))
+		r.Get("/direct/{userID}/messages", listDirectMessages(chatService))
+		r.Post("/direct/{userID}/messages", sendDirectMessage(manager))
+		r.Post("/direct/{userID}/reads", markDirectRead(manager))
+
+		r.With(utils.RequireRole(utils.RoleAdmin)).Get("/metrics", getHubMetrics(manager))
+		r.Get("/presence", listPresence(manager))
+
+		r.Group(func(r chi.Router) {
+			r.Use(utils.RequireRole(utils.RoleModerator))
+
+			r.Put("/rooms/{roomID}", updateRoom(chatService))
+			r.Delete("/rooms/{roomID}", deleteRoom(manager))
+
+			r.Get("/messages/{messageID}/edits", listMessageEdits(chatService))
+			r.Post("/rooms/{roomID}/mutes", muteUser(manager))
+			r.Delete("/rooms/{roomID}/mutes/{userID}", unmuteUser(manager))
+			r.Post("/rooms/{roomID}/kicks", kickUser(manager))
+			r.Post("/rooms/{roomID}/bans", banUser(manager))
+			r.Delete("/rooms/{roomID}/bans/{userID}", unbanUser(manager))
+
+			r.Post("/media", triggerMedia())
+			r.Post("/media/stop", stopMedia())
+		})
+	})
+
 	return r
 }
 
-func serveWs(hub *ChatHub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+func serveWs(s *ChatService, manager *hubManager, w http.ResponseWriter, r *http.Request) {
+	user, subprotocol, err := authenticateUpgrade(s, r)
+
+	if err != nil {
+		utils.ResponseError(w, "Unauthorized", utils.StatusCode(err), err)
+		return
+	}
+
+	roomID := r.URL.Query().Get("room")
+
+	if roomID == "" {
+		roomID = DefaultRoomID
+	}
+
+	if _, err := s.getRoomByID(roomID); err != nil {
+		utils.ResponseError(w, "Failed to join room", utils.StatusCode(err), err)
+		return
+	}
+
+	if err := s.checkNotBanned(roomID, user.ID); err != nil {
+		utils.ResponseError(w, "Failed to join room", utils.StatusCode(err), err)
+		return
+	}
+
+	responseHeader := http.Header{}
+
+	if subprotocol != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+
+	serveClient(manager, roomID, user, responseHeader, w, r)
+}
+
+// serveClient upgrades an authenticated request and joins the client to the
+// room's hub.
+func serveClient(manager *hubManager, roomID string, user *utils.AuthorizedUserInfo, responseHeader http.Header, w http.ResponseWriter, r *http.Request) {
+	hub, err := manager.acquire(roomID)
+
+	if err != nil {
+		status := utils.StatusCode(err)
+
+		if errors.Is(err, ErrShuttingDown) {
+			status = http.StatusServiceUnavailable
+		}
+
+		utils.ResponseError(w, "Failed to join room", status, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, responseHeader)
 
 	if err != nil {
 		log.Println("Upgrade error:", err)
+		manager.release(hub)
 		return
 	}
 
-	client := &ChatClient{hub: hub, conn: conn, message: make(chan IncomingMessage, 256)}
-	client.hub.register <- client
+	client := newChatClient(hub, conn, user)
+	hub.register <- client
 
 	go client.writePump()
 	go client.readPump()
 }
 
+// createWsTicket issues a one-time ticket for clients that can only pass
+// credentials to /ws in the URL.
+func createWsTicket(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		ticket, err := s.issueWsTicket(claims)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to create ticket", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Create ticket successfully",
+			"data": *ticket,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listRooms(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := utils.GetQueryInt(r, "limit", 10)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid limit", 400, err)
+			return
+		}
+
+		offset, err := utils.GetQueryInt(r, "offset", 0)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid offset", 400, err)
+			return
+		}
+
+		rooms, err := s.listRooms(limit, offset)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get all rooms", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get all rooms successfully",
+			"data": rooms,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func getRoomByID(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID := chi.URLParam(r, "roomID")
+		room, err := s.getRoomByID(roomID)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get room by id", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get room by id successfully",
+			"data": *room,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func createRoom(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload CreateRoomPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		room, err := s.createRoom(payload.Name)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to create new room", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Create new room successfully",
+			"data": *room,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func updateRoom(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload UpdateRoomPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		roomID := chi.URLParam(r, "roomID")
+		room, err := s.updateRoom(roomID, payload.Name)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to update room", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Update room successfully",
+			"data": *room,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func deleteRoom(manager *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID := chi.URLParam(r, "roomID")
+
+		if err := manager.deleteRoom(r.Context(), roomID); err != nil {
+			utils.ResponseError(w, "Failed to delete room", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Delete room successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listMessages(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomID := r.URL.Query().Get("room")
+
+		if roomID == "" {
+			roomID = DefaultRoomID
+		}
+
+		before := r.URL.Query().Get("before")
+		after := r.URL.Query().Get("after")
+		limit, err := utils.GetQueryInt(r, "limit", defaultMessagesLimit)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid limit", 400, err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		page, err := s.listMessages(roomID, claims.ID, before, after, limit)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get messages", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get messages successfully",
+			"data": page,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func getThread(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, err := utils.GetQueryInt(r, "limit", defaultMessagesLimit)
+
+		if err != nil {
+			utils.ResponseError(w, "Invalid limit", 400, err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		page, err := s.getThread(chi.URLParam(r, "messageID"), claims.ID, r.URL.Query().Get("after"), limit)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get thread", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get thread successfully",
+			"data": page,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listReadCursors(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		cursors, err := s.listReadCursors(chi.URLParam(r, "roomID"), claims.ID)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get read cursors", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get read cursors successfully",
+			"data": cursors,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listUnreadCounts(s *ChatService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		counts, err := s.listUnreadCounts(claims.ID)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get unread counts", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get unread counts successfully",
+			"data": counts,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func getHubMetrics(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get hub metrics successfully",
+			"data": m.metrics(),
+		})
+
+		w.Write(resp)
+	})
+}
+
+func listPresence(m *hubManager) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get presence successfully",
+			"data": m.presence(r.URL.Query().Get("room")),
+		})
+
+		w.Write(resp)
+	})
+}
+
+func stopMedia() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancelBroadcastState()
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Stop media successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
 func triggerMedia() http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var payload TriggerMediaPayload
 
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			utils.ResponseError(w, "Failed to decode body payload", 400, err)
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
 			return
 		}
 
@@ -0,0 +1,672 @@
+package chat
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+const (
+	defaultMessagesLimit	= 50
+	maxMessagesLimit		= 100
+
+	// Matches message_reactions.emoji
+	maxEmojiBytes	= 32
+
+	maxMuteMinutes	= 7 * 24 * 60
+	maxBanMinutes	= 365 * 24 * 60
+)
+
+// SessionChecker is implemented by the users service so chat can refuse and
+// close connections whose session was revoked, without importing users.
+type SessionChecker interface {
+	utils.SessionChecker
+	OnSessionRevoked(listener func(sessionID string))
+}
+
+// Config holds the chat settings loaded from the environment.
+type Config struct {
+	// What hubs do when a client cannot keep up
+	SlowConsumerPolicy	SlowConsumerPolicy
+
+	// How long authors may edit or delete their messages
+	EditWindow			time.Duration
+}
+
+type ChatService struct {
+	ChatRepository	*ChatRepository
+	KeySet			*utils.KeySet
+	Sessions		SessionChecker
+	Config			Config
+
+	// Set by NewChatRouter, which owns the running hubs
+	shutdown		func(ctx context.Context) error
+}
+
+func NewChatService(chatRepository *ChatRepository, keySet *utils.KeySet, sessions SessionChecker, config Config) *ChatService {
+	return &ChatService{
+		ChatRepository: chatRepository,
+		KeySet: keySet,
+		Sessions: sessions,
+		Config: config,
+	}
+}
+
+// Shutdown closes every chat connection and flushes pending messages to the
+// database. Call it after the HTTP server has stopped accepting requests.
+func (s *ChatService) Shutdown(ctx context.Context) error {
+	if s.shutdown == nil {
+		return nil
+	}
+
+	return s.shutdown(ctx)
+}
+
+// listMessages returns a page of messages newest-first. Without a cursor it
+// starts from the latest message; "before" pages towards older messages and
+// "after" towards newer ones. Users banned from the room cannot read it.
+func (s *ChatService) listMessages(roomID string, userID string, before string, after string, limit int) (*MessagePage, error) {
+	if before != "" && after != "" {
+		return nil, ErrCursorDirection
+	}
+
+	if err := s.checkNotBanned(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+
+	if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	var cursor *messageCursor
+	var err error
+
+	if before != "" {
+		cursor, err = decodeMessageCursor(before)
+	} else if after != "" {
+		cursor, err = decodeMessageCursor(after)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := s.ChatRepository.selectRoomByID(roomID); err != nil {
+		return nil, err
+	}
+
+	forward := after != ""
+
+	// Fetch one extra row to know whether another page exists
+	messages, err := s.ChatRepository.selectMessages(roomID, cursor, forward, limit + 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(messages) > limit
+
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	page := &MessagePage{
+		Messages: messages,
+		HasMore: hasMore,
+	}
+
+	if len(messages) > 0 {
+		// Next page continues from the last row in query order
+		page.NextCursor = newMessageCursor(messages[len(messages) - 1]).encode()
+	}
+
+	if forward {
+		slices.Reverse(page.Messages)
+	}
+
+	if err := s.attachReactions(page.Messages); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+func (s *ChatService) attachReactions(messages []ChatMessage) error {
+	ids := make([]string, len(messages))
+
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	counts, err := s.ChatRepository.selectReactionCounts(ids)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+
+	return nil
+}
+
+// getThread returns the first message of the thread messageID belongs to and
+// a page of its replies, oldest-first.
+func (s *ChatService) getThread(messageID string, userID string, after string, limit int) (*ThreadPage, error) {
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+
+	if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	var cursor *messageCursor
+	var err error
+
+	if after != "" {
+		cursor, err = decodeMessageCursor(after)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	root, err := s.ChatRepository.selectMessageByID(messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkNotBanned(root.RoomID, userID); err != nil {
+		return nil, err
+	}
+
+	if root.ThreadID != "" {
+		root, err = s.ChatRepository.selectMessageByID(root.ThreadID)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replies, err := s.ChatRepository.selectThreadReplies(root.ID, cursor, limit + 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(replies) > limit
+
+	if hasMore {
+		replies = replies[:limit]
+	}
+
+	all := append([]ChatMessage{*root}, replies...)
+
+	if err := s.attachReactions(all); err != nil {
+		return nil, err
+	}
+
+	page := &ThreadPage{
+		Root: all[0],
+		Replies: all[1:],
+		HasMore: hasMore,
+	}
+
+	if len(replies) > 0 {
+		page.NextCursor = newMessageCursor(replies[len(replies) - 1]).encode()
+	}
+
+	return page, nil
+}
+
+func (s *ChatService) listRooms(limit int, offset int) ([]Room, error) {
+	return s.ChatRepository.selectRooms(limit, offset)
+}
+
+func (s *ChatService) getRoomByID(id string) (*Room, error) {
+	return s.ChatRepository.selectRoomByID(id)
+}
+
+func (s *ChatService) createRoom(name string) (*Room, error) {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return nil, ErrRoomNameRequired
+	}
+
+	room, err := s.ChatRepository.selectRoomByName(name)
+
+	if err != nil && !errors.Is(err, ErrRoomNotFound) {
+		return nil, err
+	}
+
+	if room != nil {
+		return nil, ErrRoomNameExists
+	}
+
+	newRoom := &Room{
+		ID: uuid.New().String(),
+		Name: name,
+	}
+
+	return s.ChatRepository.insertRoom(newRoom)
+}
+
+func (s *ChatService) updateRoom(id string, name string) (*Room, error) {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return nil, ErrRoomNameRequired
+	}
+
+	room, err := s.ChatRepository.selectRoomByName(name)
+
+	if err != nil && !errors.Is(err, ErrRoomNotFound) {
+		return nil, err
+	}
+
+	if room != nil && room.ID != id {
+		return nil, ErrRoomNameExists
+	}
+
+	return s.ChatRepository.updateRoom(&Room{ID: id, Name: name})
+}
+
+func (s *ChatService) deleteRoom(id string) error {
+	if id == DefaultRoomID {
+		return ErrDefaultRoomDelete
+	}
+
+	return s.ChatRepository.deleteRoom(id)
+}
+
+func (s *ChatService) deleteMessage(message *ChatMessage, moderatorID string) error {
+	return s.ChatRepository.softDeleteMessage(message, moderatorID)
+}
+
+// checkOutranks only lets moderators act on users holding a lower role.
+func (s *ChatService) checkOutranks(moderator *utils.AuthorizedUserInfo, userID string) error {
+	if userID == "" {
+		return ErrUserIDRequired
+	}
+
+	role, err := s.ChatRepository.selectUserRole(userID)
+
+	if err != nil {
+		return err
+	}
+
+	if utils.HasRole(role, moderator.Role) {
+		return ErrTargetOutranks
+	}
+
+	return nil
+}
+
+// sanctionUser mutes or bans userID in a room. Mutes need a duration, bans
+// without one are permanent.
+func (s *ChatService) sanctionUser(roomID string, kind string, payload ModerationPayload, moderator *utils.AuthorizedUserInfo) (*RoomSanction, error) {
+	if payload.UserID == "" {
+		return nil, ErrUserIDRequired
+	}
+
+	if kind == SanctionMute && (payload.Minutes < 1 || payload.Minutes > maxMuteMinutes) {
+		return nil, ErrInvalidMuteDuration
+	}
+
+	if kind == SanctionBan && (payload.Minutes < 0 || payload.Minutes > maxBanMinutes) {
+		return nil, ErrInvalidBanDuration
+	}
+
+	if _, err := s.ChatRepository.selectRoomByID(roomID); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkOutranks(moderator, payload.UserID); err != nil {
+		return nil, err
+	}
+
+	sanction := &RoomSanction{
+		RoomID: roomID,
+		UserID: payload.UserID,
+		Kind: kind,
+		Reason: payload.Reason,
+		CreatedBy: moderator.ID,
+	}
+
+	if payload.Minutes > 0 {
+		expiresAt := time.Now().Add(time.Duration(payload.Minutes) * time.Minute)
+		sanction.ExpiresAt = &expiresAt
+	}
+
+	return s.ChatRepository.upsertRoomSanction(sanction)
+}
+
+func (s *ChatService) liftSanction(roomID string, userID string, kind string) error {
+	return s.ChatRepository.deleteRoomSanction(roomID, userID, kind)
+}
+
+func (s *ChatService) isBanned(roomID string, userID string) (bool, error) {
+	return s.ChatRepository.selectActiveRoomSanction(roomID, userID, SanctionBan)
+}
+
+// checkNotBanned keeps banned users out of a room's history as well as its
+// socket.
+func (s *ChatService) checkNotBanned(roomID string, userID string) error {
+	banned, err := s.isBanned(roomID, userID)
+
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return ErrBannedFromRoom
+	}
+
+	return nil
+}
+
+// activeMutes returns the muted users of a room and when their mute ends.
+func (s *ChatService) activeMutes(roomID string) (map[string]time.Time, error) {
+	sanctions, err := s.ChatRepository.selectActiveRoomSanctions(roomID, SanctionMute)
+
+	if err != nil {
+		return nil, err
+	}
+
+	mutes := make(map[string]time.Time, len(sanctions))
+
+	for _, sanction := range sanctions {
+		if sanction.ExpiresAt != nil {
+			mutes[sanction.UserID] = *sanction.ExpiresAt
+		}
+	}
+
+	return mutes, nil
+}
+
+// markRead moves the user's read cursor in roomID to a message created at
+// createdAt and returns the resulting cursor.
+func (s *ChatService) markRead(roomID string, userID string, messageID string, createdAt time.Time) (*ReadCursor, error) {
+	return s.ChatRepository.upsertReadCursor(&ReadCursor{
+		UserID: userID,
+		RoomID: roomID,
+		MessageID: messageID,
+		LastReadAt: createdAt,
+	})
+}
+
+// getRoomMessage finds a message of roomID. Messages of other rooms are
+// reported as not found.
+func (s *ChatService) getRoomMessage(messageID string, roomID string) (*ChatMessage, error) {
+	message, err := s.ChatRepository.selectMessageByID(messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if message.RoomID != roomID {
+		return nil, ErrMessageNotFound
+	}
+
+	return message, nil
+}
+
+func (s *ChatService) listReadCursors(roomID string, userID string) ([]ReadCursor, error) {
+	if _, err := s.ChatRepository.selectRoomByID(roomID); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkNotBanned(roomID, userID); err != nil {
+		return nil, err
+	}
+
+	return s.ChatRepository.selectReadCursors(roomID)
+}
+
+func (s *ChatService) listUnreadCounts(userID string) ([]UnreadCount, error) {
+	return s.ChatRepository.selectUnreadCounts(userID)
+}
+
+// react adds or removes a reaction and returns how many users now react to
+// the message with that emoji. changed is false when nothing was done.
+func (s *ChatService) react(messageID string, userID string, emoji string, add bool) (count int, changed bool, err error) {
+	if err := validateEmoji(emoji); err != nil {
+		return 0, false, err
+	}
+
+	if add {
+		changed, err = s.ChatRepository.insertReaction(messageID, userID, emoji)
+	} else {
+		changed, err = s.ChatRepository.deleteReaction(messageID, userID, emoji)
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	count, err = s.ChatRepository.countReactions(messageID, emoji)
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return count, changed, nil
+}
+
+// validateEmoji accepts a short run of printable, non-space characters, which
+// covers emoji sequences with modifiers and joiners.
+func validateEmoji(emoji string) error {
+	if emoji == "" || len(emoji) > maxEmojiBytes {
+		return ErrInvalidEmoji
+	}
+
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return ErrInvalidEmoji
+		}
+	}
+
+	return nil
+}
+
+// checkAuthor allows changes by the author only, within the edit window.
+func (s *ChatService) checkAuthor(message *ChatMessage, userID string) error {
+	if message.UserID != userID {
+		return ErrNotAuthor
+	}
+
+	if time.Since(message.CreatedAt) > s.Config.EditWindow {
+		return ErrEditWindowExpired
+	}
+
+	return nil
+}
+
+func (s *ChatService) editMessage(message *ChatMessage, userID string, content string) (*ChatMessage, error) {
+	if err := s.checkAuthor(message, userID); err != nil {
+		return nil, err
+	}
+
+	if err := validateContent(content); err != nil {
+		return nil, err
+	}
+
+	editedAt, err := s.ChatRepository.updateMessageContent(message, content, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	edited := *message
+	edited.Content = content
+	edited.EditedAt = editedAt
+
+	return &edited, nil
+}
+
+func (s *ChatService) deleteOwnMessage(message *ChatMessage, userID string) error {
+	if err := s.checkAuthor(message, userID); err != nil {
+		return err
+	}
+
+	return s.ChatRepository.softDeleteMessage(message, userID)
+}
+
+func (s *ChatService) listMessageEdits(messageID string) ([]MessageEdit, error) {
+	if _, err := s.ChatRepository.selectMessageByID(messageID); err != nil {
+		return nil, err
+	}
+
+	return s.ChatRepository.selectMessageEdits(messageID)
+}
+
+// conversationPair orders two user ids the way direct_conversations stores
+// them.
+func conversationPair(userID string, otherID string) (string, string) {
+	if userID < otherID {
+		return userID, otherID
+	}
+
+	return otherID, userID
+}
+
+func (s *ChatService) sendDirect(sender *utils.AuthorizedUserInfo, recipientID string, content string) (*DirectMessage, error) {
+	if recipientID == "" {
+		return nil, ErrUserIDRequired
+	}
+
+	if recipientID == sender.ID {
+		return nil, ErrDirectToSelf
+	}
+
+	if _, err := s.ChatRepository.selectUsername(recipientID); err != nil {
+		return nil, err
+	}
+
+	message := &DirectMessage{
+		ID: uuid.New().String(),
+		SenderID: sender.ID,
+		SenderUsername: sender.Username,
+		RecipientID: recipientID,
+		Content: content,
+		CreatedAt: time.Now(),
+	}
+
+	userA, userB := conversationPair(sender.ID, recipientID)
+
+	if err := s.ChatRepository.insertDirectMessage(userA, userB, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+// listDirectMessages pages through the conversation of userID and otherID,
+// newest first.
+func (s *ChatService) listDirectMessages(userID string, otherID string, before string, limit int) (*DirectMessagePage, error) {
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+
+	if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	var cursor *messageCursor
+
+	if before != "" {
+		var err error
+		cursor, err = decodeMessageCursor(before)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conversationID, err := s.ChatRepository.selectConversationID(conversationPair(userID, otherID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetch one extra row to know whether another page exists
+	messages, err := s.ChatRepository.selectDirectMessages(conversationID, cursor, limit + 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	hasMore := len(messages) > limit
+
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	page := &DirectMessagePage{
+		Messages: messages,
+		HasMore: hasMore,
+	}
+
+	if len(messages) > 0 {
+		last := messages[len(messages) - 1]
+		page.NextCursor = messageCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+
+	return page, nil
+}
+
+// markDirectRead marks the conversation of userID and otherID read up to
+// messageID.
+func (s *ChatService) markDirectRead(userID string, otherID string, messageID string) (*DirectReadCursor, error) {
+	if messageID == "" {
+		return nil, ErrMessageIDRequired
+	}
+
+	conversationID, err := s.ChatRepository.selectConversationID(conversationPair(userID, otherID))
+
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := s.ChatRepository.selectDirectMessage(conversationID, messageID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ChatRepository.upsertDirectReadCursor(&DirectReadCursor{
+		ConversationID: conversationID,
+		UserID: userID,
+		LastReadAt: message.CreatedAt,
+	})
+}
+
+func (s *ChatService) listConversations(userID string, limit int, offset int) ([]Conversation, error) {
+	if limit <= 0 {
+		limit = defaultMessagesLimit
+	}
+
+	if limit > maxMessagesLimit {
+		limit = maxMessagesLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	return s.ChatRepository.selectConversations(userID, limit, offset)
+}
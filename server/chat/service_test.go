@@ -0,0 +1,137 @@
+package chat
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestService(t *testing.T) (*ChatService, *fakeDB) {
+	t.Helper()
+
+	db := newFakeDB(t)
+
+	// Nobody is banned or muted
+	db.on(`SELECT EXISTS`, func(args []driver.Value) fakeResult {
+		return row([]string{"exists"}, false)
+	})
+
+	return NewChatService(NewChatRepository(db.db), nil, nopSessions{}, Config{SlowConsumerPolicy: PolicyDropOldest, EditWindow: time.Minute}), db
+}
+
+func messageIDs(messages []ChatMessage) []string {
+	ids := []string{}
+
+	for _, m := range messages {
+		ids = append(ids, m.ID)
+	}
+
+	return ids
+}
+
+func TestListMessagesPagination(t *testing.T) {
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// m1 and m2 share a timestamp, so only the id tells them apart
+	history := []ChatMessage{
+		{ID: "m0", RoomID: testRoomID, UserID: "alice", Content: "0", CreatedAt: base},
+		{ID: "m1", RoomID: testRoomID, UserID: "alice", Content: "1", CreatedAt: base.Add(time.Second)},
+		{ID: "m2", RoomID: testRoomID, UserID: "alice", Content: "2", CreatedAt: base.Add(time.Second)},
+		{ID: "m3", RoomID: testRoomID, UserID: "alice", Content: "3", CreatedAt: base.Add(2 * time.Second)},
+		{ID: "m4", RoomID: testRoomID, UserID: "alice", Content: "4", CreatedAt: base.Add(3 * time.Second)},
+		{ID: "other", RoomID: "77777777-7777-7777-7777-777777777777", UserID: "alice", Content: "x", CreatedAt: base},
+	}
+
+	cursor := func(i int) string { return newMessageCursor(history[i]).encode() }
+
+	tests := []struct {
+		name		string
+		roomID		string
+		before		string
+		after		string
+		limit		int
+		wantIDs		[]string
+		wantMore	bool
+		wantNext	string
+		wantLimit	int64
+		wantErr		error
+	}{
+		{name: "latest page", limit: 2, wantIDs: []string{"m4", "m3"}, wantMore: true, wantNext: cursor(3), wantLimit: 3},
+		{name: "before splits a shared timestamp", before: cursor(3), limit: 2, wantIDs: []string{"m2", "m1"}, wantMore: true, wantNext: cursor(1), wantLimit: 3},
+		{name: "oldest page", before: cursor(1), limit: 2, wantIDs: []string{"m0"}, wantNext: cursor(0), wantLimit: 3},
+		{name: "after pages towards newer messages", after: cursor(1), limit: 2, wantIDs: []string{"m3", "m2"}, wantMore: true, wantNext: cursor(3), wantLimit: 3},
+		{name: "nothing newer", after: cursor(4), limit: 2, wantIDs: []string{}, wantLimit: 3},
+		{name: "default limit", wantIDs: []string{"m4", "m3", "m2", "m1", "m0"}, wantNext: cursor(0), wantLimit: defaultMessagesLimit + 1},
+		{name: "limit is capped", limit: maxMessagesLimit + 50, wantIDs: []string{"m4", "m3", "m2", "m1", "m0"}, wantNext: cursor(0), wantLimit: maxMessagesLimit + 1},
+		{name: "both directions", before: cursor(3), after: cursor(1), wantErr: ErrCursorDirection},
+		{name: "invalid cursor", before: "not-a-cursor", wantErr: ErrInvalidCursor},
+		{name: "unknown room", roomID: "88888888-8888-8888-8888-888888888888", wantErr: ErrRoomNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, db := newTestService(t)
+			onRoom(db, testRoomID)
+			messages := onMessages(db)
+			messages.add(history...)
+
+			roomID := tt.roomID
+
+			if roomID == "" {
+				roomID = testRoomID
+			}
+
+			page, err := s.listMessages(roomID, "alice", tt.before, tt.after, tt.limit)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if got := messageIDs(page.Messages); !reflect.DeepEqual(got, tt.wantIDs) {
+				t.Errorf("got messages %v, want %v", got, tt.wantIDs)
+			}
+
+			if page.HasMore != tt.wantMore {
+				t.Errorf("got has_more %v, want %v", page.HasMore, tt.wantMore)
+			}
+
+			if page.NextCursor != tt.wantNext {
+				t.Errorf("got next cursor %q, want %q", page.NextCursor, tt.wantNext)
+			}
+
+			if got := messages.limits; len(got) != 1 || got[0] != tt.wantLimit {
+				t.Errorf("got query limits %v, want [%d]", got, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestMessageCursorRoundTrip(t *testing.T) {
+	tests := []struct {
+		name	string
+		cursor	messageCursor
+	}{
+		{name: "utc", cursor: messageCursor{CreatedAt: time.Date(2026, 1, 1, 12, 0, 0, 123456789, time.UTC), ID: "a"}},
+		{name: "other zone", cursor: messageCursor{CreatedAt: time.Date(2026, 1, 1, 12, 0, 0, 1000, time.FixedZone("x", 7 * 3600)), ID: "b|c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeMessageCursor(tt.cursor.encode())
+
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+
+			if !decoded.CreatedAt.Equal(tt.cursor.CreatedAt) || decoded.ID != tt.cursor.ID {
+				t.Errorf("got %+v, want %+v", decoded, tt.cursor)
+			}
+		})
+	}
+}
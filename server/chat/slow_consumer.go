@@ -0,0 +1,107 @@
+package chat
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy decides what a hub does when a client's buffer is full.
+type SlowConsumerPolicy string
+
+const (
+	// PolicyDisconnect closes the lagging client
+	PolicyDisconnect	SlowConsumerPolicy = "disconnect"
+
+	// PolicyDropOldest discards the oldest queued frame to make room
+	PolicyDropOldest	SlowConsumerPolicy = "drop_oldest"
+
+	// PolicyDropNewest discards the frame that does not fit
+	PolicyDropNewest	SlowConsumerPolicy = "drop_newest"
+
+	// PolicyCoalesce discards frames while the client lags and then sends a
+	// single resync notice counting them, so the client can reload history
+	PolicyCoalesce		SlowConsumerPolicy = "coalesce"
+)
+
+// A client is warned once its buffer is this full, and again only after it
+// drained below the low watermark.
+const (
+	lagHighWatermark	= clientBufferSize * 3 / 4
+	lagLowWatermark		= clientBufferSize / 4
+)
+
+func ParseSlowConsumerPolicy(value string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(value); policy {
+		case PolicyDisconnect, PolicyDropOldest, PolicyDropNewest, PolicyCoalesce:
+			return policy, nil
+		default:
+			return "", fmt.Errorf("unknown slow consumer policy %q", value)
+	}
+}
+
+// fanOutStats counts slow consumer handling across every hub.
+type fanOutStats struct {
+	dropped		atomic.Int64
+	disconnects	atomic.Int64
+	warnings	atomic.Int64
+}
+
+// deliver queues an event for a client without ever blocking the hub.
+func (h *ChatHub) deliver(client *ChatClient, event Envelope) {
+	stats := &h.manager.stats
+
+	if client.missed > 0 {
+		// Coalesced frames are announced once the client has caught up
+		if len(client.message) > lagLowWatermark {
+			client.missed++
+			stats.dropped.Add(1)
+			return
+		}
+
+		client.message <- systemEnvelope(SystemPayload{Event: "resync", RoomID: h.roomID, Missed: client.missed})
+		client.missed = 0
+	}
+
+	if len(client.message) >= lagHighWatermark && !client.lagWarned {
+		client.lagWarned = true
+		stats.warnings.Add(1)
+		client.message <- systemEnvelope(SystemPayload{Event: "slow_consumer", RoomID: h.roomID})
+	} else if len(client.message) <= lagLowWatermark {
+		client.lagWarned = false
+	}
+
+	select {
+		case client.message <- event:
+			return
+		default:
+	}
+
+	switch h.policy {
+		case PolicyDropNewest:
+			stats.dropped.Add(1)
+
+		case PolicyDropOldest:
+			// writePump may empty the buffer meanwhile, so neither step blocks
+			select {
+				case <-client.message:
+					stats.dropped.Add(1)
+				default:
+			}
+
+			select {
+				case client.message <- event:
+				default:
+					stats.dropped.Add(1)
+			}
+
+		case PolicyCoalesce:
+			client.missed = 1
+			stats.dropped.Add(1)
+
+		default:
+			stats.disconnects.Add(1)
+			h.remove(client, websocket.CloseTryAgainLater, "too slow")
+	}
+}
@@ -1,8 +1,183 @@
 package chat
 
-type IncomingMessage struct {
-	TokenString	string	`json:"tokenString"`
-	Content		string	`json:"content"`
+import (
+	"time"
+)
+
+// DefaultRoomID is the room seeded by the migrations, used when a client does
+// not ask for a specific one.
+const DefaultRoomID = "00000000-0000-0000-0000-000000000000"
+
+// ChatMessage is a message of a room. Replies reference the message they
+// answer in ReplyToID and their thread's first message in ThreadID.
+type ChatMessage struct {
+	ID			string			`json:"id"`
+	RoomID		string			`json:"room_id"`
+	UserID		string			`json:"user_id"`
+	Username	string			`json:"username"`
+	Content		string			`json:"content"`
+	ReplyToID	string			`json:"reply_to_id,omitempty"`
+	ThreadID	string			`json:"thread_id,omitempty"`
+	Reactions	[]ReactionCount	`json:"reactions,omitempty"`
+	EditedAt	*time.Time		`json:"edited_at,omitempty"`
+	CreatedAt	time.Time		`json:"created_at"`
+}
+
+// MessageEdit is the content of a message before one of its edits.
+type MessageEdit struct {
+	ID				string		`json:"id"`
+	MessageID		string		`json:"message_id"`
+	PreviousContent	string		`json:"previous_content"`
+	EditedBy		string		`json:"edited_by"`
+	EditedAt		time.Time	`json:"edited_at"`
+}
+
+type EditMessagePayload struct {
+	Content	string	`json:"content"`
+}
+
+// DirectMessage is a message of a 1:1 conversation, seen only by its sender
+// and recipient.
+type DirectMessage struct {
+	ID				string		`json:"id"`
+	ConversationID	string		`json:"conversation_id"`
+	SenderID		string		`json:"sender_id"`
+	SenderUsername	string		`json:"sender_username"`
+	RecipientID		string		`json:"recipient_id"`
+	Content			string		`json:"content"`
+	CreatedAt		time.Time	`json:"created_at"`
+}
+
+// Conversation is a 1:1 conversation seen from one participant. UserID is the
+// other participant.
+type Conversation struct {
+	ID			string			`json:"id"`
+	UserID		string			`json:"user_id"`
+	Username	string			`json:"username"`
+	LastMessage	DirectMessage	`json:"last_message"`
+	Unread		int				`json:"unread"`
+}
+
+type DirectMessagePage struct {
+	Messages	[]DirectMessage	`json:"messages"`
+	NextCursor	string			`json:"next_cursor,omitempty"`
+	HasMore		bool			`json:"has_more"`
+}
+
+// DirectReadCursor is the last time a user has read a conversation.
+type DirectReadCursor struct {
+	ConversationID	string		`json:"conversation_id"`
+	UserID			string		`json:"user_id"`
+	LastReadAt		time.Time	`json:"last_read_at"`
+}
+
+type SendDirectPayload struct {
+	Content	string	`json:"content"`
+}
+
+type ReadDirectPayload struct {
+	MessageID	string	`json:"message_id"`
+}
+
+type ReactionCount struct {
+	Emoji	string	`json:"emoji"`
+	Count	int		`json:"count"`
+}
+
+const (
+	SanctionMute	= "mute"
+	SanctionBan		= "ban"
+)
+
+type RoomSanction struct {
+	RoomID		string		`json:"room_id"`
+	UserID		string		`json:"user_id"`
+	Kind		string		`json:"kind"`
+	Reason		string		`json:"reason"`
+	ExpiresAt	*time.Time	`json:"expires_at"`
+	CreatedBy	string		`json:"created_by"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type Room struct {
+	ID			string		`json:"id"`
+	Name		string		`json:"name"`
+	CreatedAt	time.Time	`json:"created_at"`
+	UpdatedAt	time.Time	`json:"updated_at"`
+}
+
+type ThreadPage struct {
+	Root		ChatMessage		`json:"root"`
+	Replies		[]ChatMessage	`json:"replies"`
+	NextCursor	string			`json:"next_cursor,omitempty"`
+	HasMore		bool			`json:"has_more"`
+}
+
+type MessagePage struct {
+	Messages	[]ChatMessage	`json:"messages"`
+	NextCursor	string			`json:"next_cursor,omitempty"`
+	HasMore		bool			`json:"has_more"`
+}
+
+// ReadCursor is the last message a user has read in a room.
+type ReadCursor struct {
+	UserID		string		`json:"user_id"`
+	Username	string		`json:"username,omitempty"`
+	RoomID		string		`json:"room_id"`
+	MessageID	string		`json:"message_id"`
+	LastReadAt	time.Time	`json:"last_read_at"`
+}
+
+type UnreadCount struct {
+	RoomID		string	`json:"room_id"`
+	Unread		int		`json:"unread"`
+}
+
+type PresenceUser struct {
+	UserID		string	`json:"user_id"`
+	Username	string	`json:"username"`
+}
+
+type RoomPresence struct {
+	RoomID		string			`json:"room_id"`
+	Users		[]PresenceUser	`json:"users"`
+}
+
+type HubMetrics struct {
+	QueueDepth		int		`json:"queue_depth"`
+	QueueCapacity	int		`json:"queue_capacity"`
+	Enqueued		int64	`json:"enqueued"`
+	Dropped			int64	`json:"dropped"`
+	Persisted		int64	`json:"persisted"`
+	Failed			int64	`json:"failed"`
+
+	// Slow consumer handling across every hub
+	SlowConsumerPolicy		SlowConsumerPolicy	`json:"slow_consumer_policy"`
+	SlowConsumerDropped		int64				`json:"slow_consumer_dropped"`
+	SlowConsumerDisconnects	int64				`json:"slow_consumer_disconnects"`
+	SlowConsumerWarnings	int64				`json:"slow_consumer_warnings"`
+}
+
+// WsTicket is exchanged once for a WebSocket connection with ?ticket=.
+type WsTicket struct {
+	Ticket		string		`json:"ticket"`
+	ExpiresIn	int			`json:"expires_in"`
+}
+
+type CreateRoomPayload struct {
+	Name	string		`json:"name"`
+}
+
+type UpdateRoomPayload struct {
+	Name	string		`json:"name"`
+}
+
+// ModerationPayload is the body of the mute, kick and ban endpoints. Minutes is
+// the sanction length; 0 bans permanently.
+type ModerationPayload struct {
+	UserID	string		`json:"user_id"`
+	Minutes	int			`json:"minutes"`
+	Reason	string		`json:"reason"`
 }
 
 type TriggerMediaPayload struct {
@@ -0,0 +1,92 @@
+package chat
+
+import (
+	"time"
+)
+
+const (
+	// typingInterval is the minimum time between two typing.start events
+	// fanned out for the same user; starts in between only extend the expiry.
+	typingInterval	= 2 * time.Second
+
+	// typingTimeout stops a typing indicator the client never stopped.
+	typingTimeout	= 6 * time.Second
+)
+
+// typingSignal is a typing.start or typing.stop frame from a client.
+type typingSignal struct {
+	client	*ChatClient
+	active	bool
+}
+
+// typingEntry is a user currently typing in a hub. Tabs of the same user
+// share one entry.
+type typingEntry struct {
+	userID		string
+	username	string
+	lastStart	time.Time
+	expiry		*time.Timer
+}
+
+func (h *ChatHub) handleTyping(signal typingSignal) {
+	if !signal.active {
+		h.stopTyping(signal.client.user.ID)
+		return
+	}
+
+	user := signal.client.user
+	entry, ok := h.typing[user.ID]
+
+	if !ok {
+		entry = &typingEntry{userID: user.ID, username: user.Username}
+		h.typing[user.ID] = entry
+	}
+
+	if entry.expiry != nil {
+		entry.expiry.Stop()
+	}
+
+	entry.expiry = time.AfterFunc(h.manager.timings.typingTimeout, func() {
+		select {
+			case h.typingExpired <- entry:
+			case <-h.done:
+		}
+	})
+
+	if time.Since(entry.lastStart) < h.manager.timings.typingInterval {
+		return
+	}
+
+	entry.lastStart = time.Now()
+	h.fanOutTyping(entry, TypeTypingStart)
+}
+
+// stopTyping clears the user's indicator, if any, and tells the room.
+func (h *ChatHub) stopTyping(userID string) {
+	entry, ok := h.typing[userID]
+
+	if !ok {
+		return
+	}
+
+	entry.expiry.Stop()
+	delete(h.typing, userID)
+	h.fanOutTyping(entry, TypeTypingStop)
+}
+
+func (h *ChatHub) typingTimedOut(entry *typingEntry) {
+	// The timer may fire after the entry was stopped or replaced
+	if h.typing[entry.userID] == entry {
+		h.stopTyping(entry.userID)
+	}
+}
+
+// fanOutTyping sends a typing event to everyone but the typing user's own
+// connections.
+func (h *ChatHub) fanOutTyping(entry *typingEntry, eventType string) {
+	h.fanOutRoom(newEnvelope(eventType, TypingPayload{
+		RoomID: h.roomID,
+		UserID: entry.userID,
+		Username: entry.username,
+	}), entry.userID)
+}
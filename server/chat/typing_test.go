@@ -0,0 +1,147 @@
+package chat
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+// typingOf drains client's queue and returns the typing event types.
+func typingOf(client *ChatClient) []string {
+	events := []string{}
+
+	for len(client.message) > 0 {
+		if event := <-client.message; event.Type == TypeTypingStart || event.Type == TypeTypingStop {
+			events = append(events, event.Type)
+		}
+	}
+
+	return events
+}
+
+func TestTypingIndicators(t *testing.T) {
+	const (
+		interval	= 100 * time.Millisecond
+		timeout		= 400 * time.Millisecond
+	)
+
+	const (
+		opStart	= "start"
+		opStop	= "stop"
+		opSend	= "send"
+		opLeave	= "leave"
+		opClose	= "close"
+		opWait	= "wait"
+	)
+
+	type step struct {
+		op		string
+		wait	time.Duration
+	}
+
+	tests := []struct {
+		name		string
+		steps		[]step
+		wantEvents	[]string
+	}{
+		{
+			name: "start and stop",
+			steps: []step{{op: opStart}, {op: opStop}},
+			wantEvents: []string{TypeTypingStart, TypeTypingStop},
+		},
+		{
+			name: "stop without start",
+			steps: []step{{op: opStop}},
+			wantEvents: []string{},
+		},
+		{
+			name: "starts within the interval are not repeated",
+			steps: []step{{op: opStart}, {op: opStart}, {op: opStart}},
+			wantEvents: []string{TypeTypingStart},
+		},
+		{
+			name: "start after the interval is repeated",
+			steps: []step{{op: opStart}, {op: opWait, wait: interval + interval / 2}, {op: opStart}},
+			wantEvents: []string{TypeTypingStart, TypeTypingStart},
+		},
+		{
+			name: "indicator expires",
+			steps: []step{{op: opStart}, {op: opWait, wait: 2 * timeout}},
+			wantEvents: []string{TypeTypingStart, TypeTypingStop},
+		},
+		{
+			name: "starts extend the expiry",
+			steps: []step{
+				{op: opStart},
+				{op: opWait, wait: timeout * 3 / 4},
+				{op: opStart},
+				{op: opWait, wait: timeout * 3 / 4},
+			},
+			wantEvents: []string{TypeTypingStart, TypeTypingStart},
+		},
+		{
+			name: "sending a message stops typing",
+			steps: []step{{op: opStart}, {op: opSend}},
+			wantEvents: []string{TypeTypingStart, TypeTypingStop},
+		},
+		{
+			name: "closing another tab keeps typing",
+			steps: []step{{op: opStart}, {op: opClose}},
+			wantEvents: []string{TypeTypingStart},
+		},
+		{
+			name: "leaving stops typing",
+			steps: []step{{op: opStart}, {op: opClose}, {op: opLeave}},
+			wantEvents: []string{TypeTypingStart, TypeTypingStop},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, PolicyDropOldest, NewMemoryBroker())
+			m.timings.typingInterval = interval
+			m.timings.typingTimeout = timeout
+
+			observer := joinStalled(t, m, testRoomID, "observer")
+			hub := runningHub(t, m, testRoomID)
+
+			// A second tab of the typing user never sees its own indicator
+			otherTab, closeOther := joinTab(t, m, testRoomID, &utils.AuthorizedUserInfo{ID: "alice", Username: "alice", SessionID: "session-alice-1"})
+			alice, leave := joinTab(t, m, testRoomID, &utils.AuthorizedUserInfo{ID: "alice", Username: "alice", SessionID: "session-alice-2"})
+
+			for _, st := range tt.steps {
+				switch st.op {
+					case opStart:
+						alice.handle(frame(t, TypeTypingStart, "", nil))
+
+					case opStop:
+						alice.handle(frame(t, TypeTypingStop, "", nil))
+
+					case opSend:
+						send(t, alice, "hello")
+
+					case opClose:
+						closeOther()
+
+					case opLeave:
+						leave()
+
+					case opWait:
+						time.Sleep(st.wait)
+				}
+
+				settle(t, hub)
+			}
+
+			if got := typingOf(observer); !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Errorf("got typing events %v, want %v", got, tt.wantEvents)
+			}
+
+			if got := typingOf(otherTab); len(got) != 0 {
+				t.Errorf("typing user got their own events %v", got)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
 	"github.com/pion/webrtc/v4"
 	"github.com/pion/webrtc/v4/pkg/media"
 )
@@ -197,7 +198,7 @@ type sdpPayload struct {
 func webrtcOfferHandler(w http.ResponseWriter, r *http.Request) {
 	// parse offer
 	var in sdpPayload
-	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+	if err := utils.DecodeJSON(w, r, &in); err != nil {
 		http.Error(w, "invalid offer", http.StatusBadRequest)
 		return
 	}
@@ -1,8 +1,12 @@
 package configs
 
 import (
+	"fmt"
 	"log"
+	"net/netip"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -13,6 +17,21 @@ type LocalEnv struct {
 	DatabaseName		string
 	DatabaseUser		string
 	DatabasePassword	string
+
+	JWTAlgorithm		string
+	JWTKeyID			string
+	JWTSecret			string
+	JWTPrivateKeyFile	string
+	JWTPreviousKeys		string
+
+	BreachedPasswordsFile	string
+	AdminUsernames			[]string
+
+	ChatSlowConsumerPolicy	string
+	ChatBroker				string
+	ChatEditWindow			time.Duration
+
+	TrustedProxies	[]netip.Prefix
 }
 
 func NewLocalEnv() *LocalEnv {
@@ -52,11 +71,130 @@ func NewLocalEnv() *LocalEnv {
 		log.Fatal("Failed to load DATABASE_PASSWORD in .env file")
 	}
 
+	// HS256 with JWT_SECRET by default; RS256 and EdDSA sign with the PEM key in
+	// JWT_PRIVATE_KEY_FILE. JWT_PREVIOUS_KEYS ("kid=path,kid=path") keeps
+	// retired PEM keys around for verification only; HMAC secrets are listed
+	// as "kid=hs256:path".
+	jwtAlgorithm, ok := os.LookupEnv("JWT_ALGORITHM")
+
+	if !ok {
+		jwtAlgorithm = "HS256"
+	}
+
+	jwtKeyID, ok := os.LookupEnv("JWT_KEY_ID")
+
+	if !ok {
+		jwtKeyID = "default"
+	}
+
+	jwtSecret, ok := os.LookupEnv("JWT_SECRET")
+
+	if !ok && jwtAlgorithm == "HS256" {
+		log.Fatal("Failed to load JWT_SECRET in .env file")
+	}
+
+	jwtPrivateKeyFile, ok := os.LookupEnv("JWT_PRIVATE_KEY_FILE")
+
+	if !ok && jwtAlgorithm != "HS256" {
+		log.Fatal("Failed to load JWT_PRIVATE_KEY_FILE in .env file")
+	}
+
+	jwtPreviousKeys := os.Getenv("JWT_PREVIOUS_KEYS")
+
+	breachedPasswordsFile, ok := os.LookupEnv("BREACHED_PASSWORDS_FILE")
+
+	if !ok {
+		breachedPasswordsFile = "data/breached_passwords.txt"
+	}
+
+	// Comma-separated usernames promoted to admin at startup
+	adminUsernames := []string{}
+
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERNAMES"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			adminUsernames = append(adminUsernames, username)
+		}
+	}
+
+	// What chat hubs do when a client's buffer fills: disconnect, drop_oldest,
+	// drop_newest or coalesce
+	chatSlowConsumerPolicy, ok := os.LookupEnv("CHAT_SLOW_CONSUMER_POLICY")
+
+	if !ok {
+		chatSlowConsumerPolicy = "drop_oldest"
+	}
+
+	// How chat events reach the other server instances: memory for a single
+	// instance, postgres for LISTEN/NOTIFY
+	chatBroker, ok := os.LookupEnv("CHAT_BROKER")
+
+	if !ok {
+		chatBroker = "memory"
+	}
+
+	// How long authors may edit or delete their messages, e.g. "15m"
+	chatEditWindow := 15 * time.Minute
+
+	if value, ok := os.LookupEnv("CHAT_EDIT_WINDOW"); ok {
+		chatEditWindow, err = time.ParseDuration(value)
+
+		if err != nil || chatEditWindow < 0 {
+			log.Fatalf("Failed to parse CHAT_EDIT_WINDOW %q in .env file", value)
+		}
+	}
+
+	// Comma-separated addresses or CIDRs of reverse proxies whose
+	// X-Forwarded-For / X-Real-IP headers are believed. Empty trusts nobody.
+	trustedProxies := []netip.Prefix{}
+
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(entry)
+
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+
+			if addrErr != nil {
+				log.Fatalf("Failed to parse TRUSTED_PROXIES entry %q in .env file", entry)
+			}
+
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+
 	return &LocalEnv{
 		DatabaseHost: databaseHost,
 		DatabasePort: databasePort,
 		DatabaseName: databaseName,
 		DatabaseUser: databaseUser,
 		DatabasePassword: databasePassword,
+		JWTAlgorithm: jwtAlgorithm,
+		JWTKeyID: jwtKeyID,
+		JWTSecret: jwtSecret,
+		JWTPrivateKeyFile: jwtPrivateKeyFile,
+		JWTPreviousKeys: jwtPreviousKeys,
+		BreachedPasswordsFile: breachedPasswordsFile,
+		AdminUsernames: adminUsernames,
+		ChatSlowConsumerPolicy: chatSlowConsumerPolicy,
+		ChatBroker: chatBroker,
+		ChatEditWindow: chatEditWindow,
+		TrustedProxies: trustedProxies,
 	}
 }
+
+// DatabaseURI is the connection string of the application database.
+func (e *LocalEnv) DatabaseURI() string {
+	return fmt.Sprintf(
+		"postgres://%v:%v@%v:%v/%v?sslmode=disable",
+		e.DatabaseUser,
+		e.DatabasePassword,
+		e.DatabaseHost,
+		e.DatabasePort,
+		e.DatabaseName,
+	)
+}
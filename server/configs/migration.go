@@ -2,7 +2,6 @@ package configs
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 	_ "github.com/lib/pq"
 
@@ -12,15 +11,7 @@ import (
 )
 
 func RunMigration(localEnv *LocalEnv) *sql.DB {
-	dbUri := fmt.Sprintf(
-		"postgres://%v:%v@%v:%v/%v?sslmode=disable",
-		localEnv.DatabaseUser,
-		localEnv.DatabasePassword,
-		localEnv.DatabaseHost,
-		localEnv.DatabasePort,
-		localEnv.DatabaseName,
-	)
-	db, err := sql.Open("postgres", dbUri)
+	db, err := sql.Open("postgres", localEnv.DatabaseURI())
 
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
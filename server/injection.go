@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"time"
 
@@ -12,17 +14,25 @@ import (
 	"github.com/nambuitechx/nam-chilling-room-server/chat"
 	"github.com/nambuitechx/nam-chilling-room-server/configs"
 	"github.com/nambuitechx/nam-chilling-room-server/users"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
 )
 
-func NewRouter() *chi.Mux {
+// NewRouter wires every package and returns the router along with a shutdown
+// function that closes long-lived chat connections.
+func NewRouter() (*chi.Mux, func(ctx context.Context) error) {
 	// Setup
 	localEnv := configs.NewLocalEnv()
 	db := configs.RunMigration(localEnv)
+	keySet, err := utils.NewKeySet(localEnv)
+
+	if err != nil {
+		log.Fatalf("Failed to load jwt signing keys: %v", err)
+	}
 
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
-	r.Use(middleware.RealIP)
+	r.Use(utils.RealIP(localEnv.TrustedProxies))
 	r.Use(middleware.RequestID)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
@@ -33,7 +43,7 @@ func NewRouter() *chi.Mux {
 		// AllowedOrigins:   []string{"https://foo.com"}, // Use this to allow specific origin hosts
 		AllowedOrigins:   []string{"https://*", "http://*"},
 		// AllowOriginFunc:  func(r *http.Request, origin string) bool { return true },
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: false,
@@ -48,17 +58,62 @@ func NewRouter() *chi.Mux {
 		w.Write(resp)
 	})
 
+	// Public keys for verifying our tokens
+	r.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := json.Marshal(keySet.JWKS())
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		w.Write(resp)
+	})
+
 	// Users
+	passwordPolicy, err := users.NewPasswordPolicy(localEnv.BreachedPasswordsFile)
+
+	if err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+
 	userRepository := users.NewUserRepository(db)
-	userService := users.NewUserService(userRepository)
+	userService := users.NewUserService(userRepository, keySet, passwordPolicy)
 	userRouter := users.NewUserRouter(userService)
 
+	if err := userService.BootstrapAdmins(localEnv.AdminUsernames); err != nil {
+		log.Fatalf("Failed to bootstrap admins: %v", err)
+	}
+
 	r.Mount("/users", userRouter)
 
 	// Chat
-	chatRouter := chat.NewChatRouter()
+	slowConsumerPolicy, err := chat.ParseSlowConsumerPolicy(localEnv.ChatSlowConsumerPolicy)
+
+	if err != nil {
+		log.Fatalf("Failed to load chat config: %v", err)
+	}
+
+	var chatBroker chat.Broker
+
+	switch localEnv.ChatBroker {
+		case "memory":
+			chatBroker = chat.NewMemoryBroker()
+		case "postgres":
+			chatBroker, err = chat.NewPostgresBroker(db, localEnv.DatabaseURI())
+
+			if err != nil {
+				log.Fatalf("Failed to start chat broker: %v", err)
+			}
+		default:
+			log.Fatalf("Failed to load chat config: unknown broker %q", localEnv.ChatBroker)
+	}
+
+	chatRepository := chat.NewChatRepository(db)
+	chatService := chat.NewChatService(chatRepository, keySet, userService, chat.Config{
+		SlowConsumerPolicy: slowConsumerPolicy,
+		EditWindow: localEnv.ChatEditWindow,
+	})
+	chatRouter := chat.NewChatRouter(chatService, chatBroker)
 
 	r.Mount("/chat", chatRouter)
 
-	return r
+	return r, chatService.Shutdown
 }
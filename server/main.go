@@ -11,7 +11,7 @@ import (
 )
 
 func main() {
-	r := NewRouter()
+	r, shutdownChat := NewRouter()
 	server := http.Server{
 		Addr: ":8000",
 		Handler: r,
@@ -40,5 +40,10 @@ func main() {
 		log.Printf("Server forced to shutdown: %v", err)
 	}
 
+	// Hijacked WebSocket connections are not closed by server.Shutdown
+	if err := shutdownChat(ctx); err != nil {
+		log.Printf("Chat forced to shutdown: %v", err)
+	}
+
 	log.Println("Server exiting")
 }
@@ -0,0 +1,5 @@
+-- Drop index
+DROP INDEX IF EXISTS messages_created_at_id_idx;
+
+-- Drop table
+DROP TABLE IF EXISTS messages;
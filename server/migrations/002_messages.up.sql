@@ -0,0 +1,10 @@
+-- Create table
+CREATE TABLE IF NOT EXISTS messages (
+    id VARCHAR(36) Primary Key,
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id),
+    content TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for reading history newest-first
+CREATE INDEX IF NOT EXISTS messages_created_at_id_idx ON messages (created_at DESC, id DESC);
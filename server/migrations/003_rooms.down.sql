@@ -0,0 +1,12 @@
+-- Restore global history index
+DROP INDEX IF EXISTS messages_room_id_created_at_id_idx;
+CREATE INDEX IF NOT EXISTS messages_created_at_id_idx ON messages (created_at DESC, id DESC);
+
+-- Detach messages from rooms
+ALTER TABLE messages DROP COLUMN IF EXISTS room_id;
+
+-- Drop trigger first (depends on function & table)
+DROP TRIGGER IF EXISTS set_timestamp ON rooms;
+
+-- Drop table
+DROP TABLE IF EXISTS rooms;
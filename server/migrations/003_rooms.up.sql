@@ -0,0 +1,29 @@
+-- Create table
+CREATE TABLE IF NOT EXISTS rooms (
+    id VARCHAR(36) Primary Key,
+    name VARCHAR(256) UNIQUE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create trigger to call function before every UPDATE
+CREATE TRIGGER set_timestamp
+BEFORE UPDATE ON rooms
+FOR EACH ROW
+EXECUTE FUNCTION update_timestamp();
+
+-- Default room for existing messages and clients that do not pick a room
+INSERT INTO rooms(id, name)
+VALUES ('00000000-0000-0000-0000-000000000000', 'general')
+ON CONFLICT DO NOTHING;
+
+-- Attach messages to rooms
+ALTER TABLE messages
+ADD COLUMN IF NOT EXISTS room_id VARCHAR(36) NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000'
+REFERENCES rooms(id) ON DELETE CASCADE;
+
+ALTER TABLE messages ALTER COLUMN room_id DROP DEFAULT;
+
+-- Replace history index with a per-room one
+DROP INDEX IF EXISTS messages_created_at_id_idx;
+CREATE INDEX IF NOT EXISTS messages_room_id_created_at_id_idx ON messages (room_id, created_at DESC, id DESC);
@@ -0,0 +1,5 @@
+-- Drop index
+DROP INDEX IF EXISTS refresh_tokens_family_id_idx;
+
+-- Drop table
+DROP TABLE IF EXISTS refresh_tokens;
@@ -0,0 +1,6 @@
+-- Drop index
+DROP INDEX IF EXISTS audit_logs_created_at_idx;
+
+-- Drop tables
+DROP TABLE IF EXISTS audit_logs;
+DROP TABLE IF EXISTS login_attempts;
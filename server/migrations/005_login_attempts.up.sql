@@ -0,0 +1,19 @@
+-- Failed login tracking, keyed by "user:<username>" or "ip:<address>"
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(320) Primary Key,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    last_failed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+
+-- Security audit trail
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id VARCHAR(36) Primary Key,
+    event VARCHAR(64) NOT NULL,
+    subject VARCHAR(320) NOT NULL,
+    ip VARCHAR(64),
+    details TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS audit_logs_created_at_idx ON audit_logs (created_at DESC);
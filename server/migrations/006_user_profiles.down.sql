@@ -0,0 +1,6 @@
+-- Drop profile fields and soft-delete marker
+ALTER TABLE users
+DROP COLUMN IF EXISTS deleted_at,
+DROP COLUMN IF EXISTS bio,
+DROP COLUMN IF EXISTS avatar_url,
+DROP COLUMN IF EXISTS display_name;
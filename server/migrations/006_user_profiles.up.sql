@@ -0,0 +1,6 @@
+-- Profile fields and soft-delete marker
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS display_name VARCHAR(64) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS avatar_url VARCHAR(2048) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS bio VARCHAR(500) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE;
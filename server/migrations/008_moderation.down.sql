@@ -0,0 +1,7 @@
+-- Drop table
+DROP TABLE IF EXISTS room_sanctions;
+
+-- Drop soft-delete columns
+ALTER TABLE messages
+DROP COLUMN IF EXISTS deleted_by,
+DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,16 @@
+-- Soft-deleted messages are hidden from history
+ALTER TABLE messages
+ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN IF NOT EXISTS deleted_by VARCHAR(36);
+
+-- Mutes and bans per room; a NULL expires_at never expires
+CREATE TABLE IF NOT EXISTS room_sanctions (
+    room_id VARCHAR(36) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    kind VARCHAR(8) NOT NULL CHECK (kind IN ('mute', 'ban')),
+    reason VARCHAR(500) NOT NULL DEFAULT '',
+    expires_at TIMESTAMP WITH TIME ZONE,
+    created_by VARCHAR(36) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (room_id, user_id, kind)
+);
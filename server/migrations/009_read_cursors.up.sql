@@ -0,0 +1,12 @@
+-- Last message each user has read in each room
+CREATE TABLE IF NOT EXISTS read_cursors (
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    room_id VARCHAR(36) NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+    message_id VARCHAR(36) NOT NULL,
+    last_read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (user_id, room_id)
+);
+
+-- Index for "seen by" lookups per room
+CREATE INDEX IF NOT EXISTS read_cursors_room_id_idx ON read_cursors (room_id);
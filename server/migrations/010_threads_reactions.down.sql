@@ -0,0 +1,9 @@
+-- Drop table
+DROP TABLE IF EXISTS message_reactions;
+
+-- Drop reply columns
+DROP INDEX IF EXISTS messages_thread_id_created_at_id_idx;
+
+ALTER TABLE messages
+DROP COLUMN IF EXISTS thread_id,
+DROP COLUMN IF EXISTS reply_to_id;
@@ -0,0 +1,15 @@
+-- Replies point at the message they answer; thread_id is the thread's first message
+ALTER TABLE messages
+ADD COLUMN IF NOT EXISTS reply_to_id VARCHAR(36),
+ADD COLUMN IF NOT EXISTS thread_id VARCHAR(36);
+
+CREATE INDEX IF NOT EXISTS messages_thread_id_created_at_id_idx ON messages (thread_id, created_at, id) WHERE thread_id IS NOT NULL;
+
+-- One row per user and emoji on a message; messages are written in batches, so no foreign key
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id VARCHAR(36) NOT NULL,
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
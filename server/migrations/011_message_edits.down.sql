@@ -0,0 +1,6 @@
+-- Drop table
+DROP TABLE IF EXISTS message_edits;
+
+-- Drop edit column
+ALTER TABLE messages
+DROP COLUMN IF EXISTS edited_at;
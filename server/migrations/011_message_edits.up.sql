@@ -0,0 +1,14 @@
+-- Last time the author changed the content
+ALTER TABLE messages
+ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP WITH TIME ZONE;
+
+-- Content of a message before each edit
+CREATE TABLE IF NOT EXISTS message_edits (
+    id VARCHAR(36) Primary Key,
+    message_id VARCHAR(36) NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    previous_content TEXT NOT NULL,
+    edited_by VARCHAR(36) NOT NULL,
+    edited_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS message_edits_message_id_idx ON message_edits (message_id, edited_at);
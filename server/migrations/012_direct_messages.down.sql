@@ -0,0 +1,4 @@
+-- Drop tables
+DROP TABLE IF EXISTS direct_read_cursors;
+DROP TABLE IF EXISTS direct_messages;
+DROP TABLE IF EXISTS direct_conversations;
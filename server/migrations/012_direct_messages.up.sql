@@ -0,0 +1,32 @@
+-- One row per pair of users, stored with user_a_id < user_b_id
+CREATE TABLE IF NOT EXISTS direct_conversations (
+    id VARCHAR(36) Primary Key,
+    user_a_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    user_b_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    UNIQUE (user_a_id, user_b_id),
+    CHECK (user_a_id < user_b_id)
+);
+
+CREATE INDEX IF NOT EXISTS direct_conversations_user_b_id_idx ON direct_conversations (user_b_id);
+
+-- Create table
+CREATE TABLE IF NOT EXISTS direct_messages (
+    id VARCHAR(36) Primary Key,
+    conversation_id VARCHAR(36) NOT NULL REFERENCES direct_conversations(id) ON DELETE CASCADE,
+    sender_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for reading history newest-first
+CREATE INDEX IF NOT EXISTS direct_messages_conversation_id_created_at_id_idx ON direct_messages (conversation_id, created_at DESC, id DESC);
+
+-- Last message each participant has read
+CREATE TABLE IF NOT EXISTS direct_read_cursors (
+    conversation_id VARCHAR(36) NOT NULL REFERENCES direct_conversations(id) ON DELETE CASCADE,
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    last_read_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (conversation_id, user_id)
+);
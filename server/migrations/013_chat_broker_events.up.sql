@@ -0,0 +1,9 @@
+-- Chat broker events too large for a NOTIFY payload; instances are notified
+-- with the row id and old rows are deleted by the broker
+CREATE TABLE IF NOT EXISTS chat_broker_events (
+    id BIGSERIAL Primary Key,
+    payload BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS chat_broker_events_created_at_idx ON chat_broker_events (created_at);
@@ -0,0 +1,14 @@
+-- One-time tickets for WebSocket clients that can send the access token
+-- neither in a header nor in a subprotocol; only their hash is stored
+CREATE TABLE IF NOT EXISTS ws_tickets (
+    ticket_hash VARCHAR(64) Primary Key,
+    user_id VARCHAR(36) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    username VARCHAR(256) NOT NULL,
+    session_id VARCHAR(36) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Index for deleting expired tickets
+CREATE INDEX IF NOT EXISTS ws_tickets_expires_at_idx ON ws_tickets (expires_at);
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeDB answers each statement with the first handler whose pattern matches
+// the query. Statements without a handler return no rows and affect nothing,
+// so tests only script the statements they care about.
+type fakeDB struct {
+	db			*sql.DB
+	mu			sync.Mutex
+	handlers	[]fakeHandler
+}
+
+type fakeHandler struct {
+	pattern	*regexp.Regexp
+	handle	func(args []driver.Value) fakeResult
+}
+
+type fakeResult struct {
+	columns		[]string
+	rows		[][]driver.Value
+	affected	int64
+	err			error
+}
+
+var (
+	fakeDBs		sync.Map
+	fakeDBCount	atomic.Int64
+)
+
+func init() {
+	sql.Register("users-fake", fakeDriver{})
+}
+
+func newFakeDB(t *testing.T) *fakeDB {
+	t.Helper()
+
+	name := strconv.FormatInt(fakeDBCount.Add(1), 10)
+	fake := &fakeDB{}
+	fakeDBs.Store(name, fake)
+
+	db, err := sql.Open("users-fake", name)
+
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+
+	fake.db = db
+
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBs.Delete(name)
+	})
+
+	return fake
+}
+
+// on answers queries matching pattern with handle. Handlers added later win.
+func (f *fakeDB) on(pattern string, handle func(args []driver.Value) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers = append([]fakeHandler{{pattern: regexp.MustCompile(pattern), handle: handle}}, f.handlers...)
+}
+
+func (f *fakeDB) result(query string, args []driver.Value) fakeResult {
+	f.mu.Lock()
+	handlers := f.handlers
+	f.mu.Unlock()
+
+	for _, h := range handlers {
+		if h.pattern.MatchString(query) {
+			return h.handle(args)
+		}
+	}
+
+	return fakeResult{}
+}
+
+// row is a single row result.
+func row(columns []string, values ...driver.Value) fakeResult {
+	return fakeResult{columns: columns, rows: [][]driver.Value{values}}
+}
+
+type fakeDriver struct{}
+type fakeConn struct{ db *fakeDB }
+type fakeTx struct{}
+type fakeStmt struct {
+	db		*fakeDB
+	query	string
+}
+type fakeRows struct {
+	result	fakeResult
+	next	int
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	db, _ := fakeDBs.Load(name)
+	return fakeConn{db: db.(*fakeDB)}, nil
+}
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{db: c.db, query: query}, nil }
+func (fakeConn) Close() error { return nil }
+func (fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+func (fakeTx) Commit() error { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+func (fakeStmt) Close() error { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result := s.db.result(s.query, args)
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result := s.db.result(s.query, args)
+
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return &fakeRows{result: result}, nil
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+
+	copy(dest, r.result.rows[r.next])
+	r.next++
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package users
+
+import (
+	"errors"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+var (
+	ErrUserNotFound			= utils.NotFound("user_not_found", "user not found")
+	ErrUsernameExists		= utils.Conflict("username_exists", "username exists")
+	ErrInvalidCredentials	= utils.Unauthorized("invalid_credentials", "invalid username or password")
+	ErrInvalidRefreshToken	= utils.Unauthorized("invalid_refresh_token", "invalid refresh token")
+	ErrInvalidRole			= utils.Validation("invalid_role", "role must be one of user, moderator, admin")
+	ErrLoginLocked			= utils.TooManyRequests("login_locked", "too many failed login attempts, try again later")
+
+	errRefreshTokenNotFound	= errors.New("refresh token not found")
+	errRefreshTokenReused	= errors.New("refresh token reused")
+)
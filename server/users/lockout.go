@@ -0,0 +1,104 @@
+package users
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// Failures are forgotten after this long without another one
+	loginFailureWindow	= 15 * time.Minute
+
+	// Failures allowed before locking, per username and per client IP
+	usernameFailureLimit	= 5
+	ipFailureLimit			= 20
+
+	loginLockBase	= time.Minute
+	loginLockMax	= time.Hour
+)
+
+func usernameAttemptKey(username string) string {
+	return "user:" + username
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// lockDuration doubles for every failure past the limit, capped at loginLockMax.
+func lockDuration(failedCount int, limit int) time.Duration {
+	if failedCount < limit {
+		return 0
+	}
+
+	duration := loginLockBase
+
+	for i := limit; i < failedCount && duration < loginLockMax; i++ {
+		duration *= 2
+	}
+
+	return min(duration, loginLockMax)
+}
+
+// checkLoginLocked fails with ErrLoginLocked while either the username or the
+// client IP is locked out.
+func (s *UserService) checkLoginLocked(username string, ip string) error {
+	for _, key := range []string{usernameAttemptKey(username), ipAttemptKey(ip)} {
+		attempt, err := s.UserRepository.selectLoginAttempt(key)
+
+		if err != nil {
+			return err
+		}
+
+		if attempt != nil && attempt.LockedUntil != nil && time.Now().Before(*attempt.LockedUntil) {
+			return ErrLoginLocked
+		}
+	}
+
+	return nil
+}
+
+// recordLoginFailure counts a failed attempt against the username and the IP,
+// locking either one once it passes its limit.
+func (s *UserService) recordLoginFailure(username string, ip string) {
+	keys := []struct {
+		key		string
+		limit	int
+	}{
+		{usernameAttemptKey(username), usernameFailureLimit},
+		{ipAttemptKey(ip), ipFailureLimit},
+	}
+
+	for _, k := range keys {
+		failedCount, err := s.UserRepository.incrementLoginFailures(k.key, loginFailureWindow)
+
+		if err != nil {
+			log.Printf("failed to record login failure for %s: %v", k.key, err)
+			continue
+		}
+
+		duration := lockDuration(failedCount, k.limit)
+
+		if duration == 0 {
+			continue
+		}
+
+		if err := s.UserRepository.updateLoginLock(k.key, time.Now().Add(duration)); err != nil {
+			log.Printf("failed to lock %s: %v", k.key, err)
+			continue
+		}
+
+		details := fmt.Sprintf("locked for %s after %d failed attempts", duration, failedCount)
+
+		if err := s.UserRepository.insertAuditLog("login_lockout", k.key, ip, details); err != nil {
+			log.Printf("failed to write audit log for %s: %v", k.key, err)
+		}
+	}
+}
+
+func (s *UserService) resetLoginFailures(username string) {
+	if err := s.UserRepository.deleteLoginAttempt(usernameAttemptKey(username)); err != nil {
+		log.Printf("failed to reset login failures for %s: %v", username, err)
+	}
+}
@@ -0,0 +1,352 @@
+package users
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nambuitechx/nam-chilling-room-server/configs"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+var userColumns = []string{"id", "username", "password", "display_name", "avatar_url", "bio", "role", "created_at", "updated_at"}
+
+func newTestService(t *testing.T, db *fakeDB) *UserService {
+	t.Helper()
+
+	keySet, err := utils.NewKeySet(&configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "test", JWTSecret: "secret"})
+
+	if err != nil {
+		t.Fatalf("failed to create key set: %v", err)
+	}
+
+	return NewUserService(NewUserRepository(db.db), keySet, &PasswordPolicy{breached: map[string]struct{}{}})
+}
+
+// onUsers answers user lookups by id or username with one of users.
+func onUsers(db *fakeDB, users ...User) {
+	db.on(`FROM users WHERE deleted_at IS NULL AND (id|username) = \$1`, func(args []driver.Value) fakeResult {
+		for _, user := range users {
+			if args[0] == user.ID || args[0] == user.Username {
+				return row(userColumns, user.ID, user.Username, user.Password, user.DisplayName, user.AvatarURL, user.Bio, user.Role, user.CreatedAt, user.UpdatedAt)
+			}
+		}
+
+		return fakeResult{}
+	})
+}
+
+// loginAttempts keeps the login_attempts table in memory.
+type loginAttempts struct {
+	mu		sync.Mutex
+	counts	map[string]int
+	locks	map[string]time.Time
+}
+
+func onLoginAttempts(db *fakeDB) *loginAttempts {
+	a := &loginAttempts{counts: map[string]int{}, locks: map[string]time.Time{}}
+
+	db.on(`SELECT key, failed_count, last_failed_at, locked_until FROM login_attempts`, func(args []driver.Value) fakeResult {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		key := args[0].(string)
+		count, ok := a.counts[key]
+
+		if !ok {
+			return fakeResult{}
+		}
+
+		var lockedUntil driver.Value
+
+		if until, ok := a.locks[key]; ok {
+			lockedUntil = until
+		}
+
+		return row([]string{"key", "failed_count", "last_failed_at", "locked_until"}, key, int64(count), time.Now(), lockedUntil)
+	})
+
+	db.on(`INSERT INTO login_attempts`, func(args []driver.Value) fakeResult {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		key := args[0].(string)
+		a.counts[key]++
+
+		return row([]string{"failed_count"}, int64(a.counts[key]))
+	})
+
+	db.on(`UPDATE login_attempts SET locked_until`, func(args []driver.Value) fakeResult {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		a.locks[args[0].(string)] = args[1].(time.Time)
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`DELETE FROM login_attempts`, func(args []driver.Value) fakeResult {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		delete(a.counts, args[0].(string))
+		delete(a.locks, args[0].(string))
+		return fakeResult{affected: 1}
+	})
+
+	return a
+}
+
+func (a *loginAttempts) count(key string) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.counts[key]
+}
+
+func postJSON(t *testing.T, handler http.Handler, path string, body any, prepare func(r *http.Request)) *httptest.ResponseRecorder {
+	t.Helper()
+
+	payload, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+
+	if prepare != nil {
+		prepare(req)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func TestLoginFailuresKeyedOnClientIP(t *testing.T) {
+	proxy := netip.MustParsePrefix("10.0.0.0/8")
+
+	tests := []struct {
+		name		string
+		trusted		[]netip.Prefix
+		remoteAddr	string
+		headers		map[string]string
+		wantIP		string
+	}{
+		{
+			name: "direct",
+			remoteAddr: "203.0.113.7:4321",
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "spoofed X-Forwarded-For",
+			remoteAddr: "203.0.113.7:4321",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "spoofed X-Real-IP",
+			remoteAddr: "203.0.113.7:4321",
+			headers: map[string]string{"X-Real-IP": "198.51.100.1"},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "forwarded by a trusted proxy",
+			trusted: []netip.Prefix{proxy},
+			remoteAddr: "10.0.0.2:4321",
+			headers: map[string]string{"X-Forwarded-For": "203.0.113.7"},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "spoofed hop before a trusted proxy",
+			trusted: []netip.Prefix{proxy},
+			remoteAddr: "10.0.0.2:4321",
+			headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 203.0.113.7, 10.0.0.3"},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "X-Real-IP from a trusted proxy",
+			trusted: []netip.Prefix{proxy},
+			remoteAddr: "10.0.0.2:4321",
+			headers: map[string]string{"X-Real-IP": "203.0.113.7"},
+			wantIP: "203.0.113.7",
+		},
+		{
+			name: "untrusted peer inside a forwarded chain",
+			trusted: []netip.Prefix{proxy},
+			remoteAddr: "203.0.113.7:4321",
+			headers: map[string]string{"X-Forwarded-For": "10.0.0.3"},
+			wantIP: "203.0.113.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			attempts := onLoginAttempts(db)
+			onUsers(db, testUser(t))
+			handler := utils.RealIP(tt.trusted)(NewUserRouter(newTestService(t, db)))
+
+			rec := postJSON(t, handler, "/login", LoginPayload{Username: "alice", Password: "wrong password"}, func(r *http.Request) {
+				r.RemoteAddr = tt.remoteAddr
+
+				for name, value := range tt.headers {
+					r.Header.Set(name, value)
+				}
+			})
+
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+
+			if got := attempts.count(ipAttemptKey(tt.wantIP)); got != 1 {
+				t.Errorf("got %d failures for %s, want 1", got, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	user := testUser(t)
+
+	type attempt struct {
+		username	string
+		password	string
+		ip			string
+		wantStatus	int
+	}
+
+	repeat := func(n int, a attempt) []attempt {
+		attempts := make([]attempt, n)
+
+		for i := range attempts {
+			attempts[i] = a
+		}
+
+		return attempts
+	}
+
+	wrong := attempt{username: user.Username, password: "wrong password", ip: "203.0.113.7", wantStatus: http.StatusUnauthorized}
+	right := attempt{username: user.Username, password: "correct horse battery staple", ip: "203.0.113.7", wantStatus: http.StatusOK}
+
+	tests := []struct {
+		name		string
+		attempts	[]attempt
+	}{
+		{
+			name: "below the username limit",
+			attempts: append(repeat(usernameFailureLimit - 1, wrong), right),
+		},
+		{
+			name: "username locked even with the right password",
+			attempts: append(
+				repeat(usernameFailureLimit, wrong),
+				attempt{username: user.Username, password: right.password, ip: "198.51.100.1", wantStatus: http.StatusTooManyRequests},
+			),
+		},
+		{
+			name: "ip locked across usernames",
+			attempts: func() []attempt {
+				var attempts []attempt
+
+				for i := 0; i < ipFailureLimit; i++ {
+					attempts = append(attempts, attempt{username: "user" + string(rune('a' + i)), password: "wrong password", ip: "203.0.113.7", wantStatus: http.StatusUnauthorized})
+				}
+
+				return append(attempts, attempt{username: user.Username, password: right.password, ip: "203.0.113.7", wantStatus: http.StatusTooManyRequests})
+			}(),
+		},
+		{
+			name: "other ips are not locked by one ip",
+			attempts: func() []attempt {
+				var attempts []attempt
+
+				for i := 0; i < ipFailureLimit; i++ {
+					attempts = append(attempts, attempt{username: "user" + string(rune('a' + i)), password: "wrong password", ip: "203.0.113.7", wantStatus: http.StatusUnauthorized})
+				}
+
+				return append(attempts, attempt{username: user.Username, password: right.password, ip: "198.51.100.1", wantStatus: http.StatusOK})
+			}(),
+		},
+		{
+			name: "success resets the username counter",
+			attempts: append(append(repeat(usernameFailureLimit - 1, wrong), right), append(repeat(usernameFailureLimit - 1, wrong), right)...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onLoginAttempts(db)
+
+			// Unknown usernames would be checked against the slow dummy hash
+			var known []User
+
+			for _, a := range tt.attempts {
+				u := user
+				u.Username = a.username
+				known = append(known, u)
+			}
+
+			onUsers(db, known...)
+
+			handler := NewUserRouter(newTestService(t, db))
+
+			for i, a := range tt.attempts {
+				rec := postJSON(t, handler, "/login", LoginPayload{Username: a.username, Password: a.password}, func(r *http.Request) {
+					r.RemoteAddr = a.ip + ":4321"
+				})
+
+				if rec.Code != a.wantStatus {
+					t.Fatalf("attempt %d: got status %d, want %d: %s", i, rec.Code, a.wantStatus, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestChangePasswordLockout(t *testing.T) {
+	user := testUser(t)
+	correct := "correct horse battery staple"
+
+	tests := []struct {
+		name		string
+		failures	int
+		password	string
+		wantErr		error
+	}{
+		{name: "below the limit", failures: usernameFailureLimit - 1, password: correct},
+		{name: "wrong password", failures: 0, password: "wrong password", wantErr: utils.ErrValidation},
+		{name: "locked after the limit", failures: usernameFailureLimit, password: correct, wantErr: ErrLoginLocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onLoginAttempts(db)
+			onUsers(db, user)
+			db.on(`UPDATE users SET password`, func(args []driver.Value) fakeResult { return fakeResult{affected: 1} })
+			s := newTestService(t, db)
+
+			for i := 0; i < tt.failures; i++ {
+				if err := s.changePassword(user.ID, "session", "wrong password", "new password 123", "203.0.113.7"); !errors.Is(err, utils.ErrValidation) {
+					t.Fatalf("failure %d: got %v, want a validation error", i, err)
+				}
+			}
+
+			err := s.changePassword(user.ID, "session", tt.password, "new password 123", "198.51.100.1")
+
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("got %v, want no error", err)
+			}
+
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
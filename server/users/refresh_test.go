@@ -0,0 +1,292 @@
+package users
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// refreshTokens keeps the refresh_tokens table in memory.
+type refreshTokens struct {
+	mu		sync.Mutex
+	tokens	map[string]*RefreshToken
+
+	// staleReads hides revocations from lookups, as if another request
+	// rotated the token between the lookup and the update
+	staleReads	bool
+}
+
+func onRefreshTokens(db *fakeDB) *refreshTokens {
+	f := &refreshTokens{tokens: map[string]*RefreshToken{}}
+
+	insert := func(args []driver.Value) {
+		f.tokens[args[0].(string)] = &RefreshToken{
+			ID: args[0].(string),
+			UserID: args[1].(string),
+			FamilyID: args[2].(string),
+			TokenHash: args[3].(string),
+			ExpiresAt: args[4].(time.Time),
+			CreatedAt: time.Now(),
+		}
+	}
+
+	db.on(`INSERT INTO refresh_tokens`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		insert(args)
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`FROM refresh_tokens WHERE token_hash = \$1`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, token := range f.tokens {
+			if token.TokenHash != args[0] {
+				continue
+			}
+
+			var revokedAt, replacedBy driver.Value
+
+			if token.RevokedAt != nil && !f.staleReads {
+				revokedAt = *token.RevokedAt
+			}
+
+			if token.ReplacedBy != nil && !f.staleReads {
+				replacedBy = *token.ReplacedBy
+			}
+
+			return row(
+				[]string{"id", "user_id", "family_id", "token_hash", "expires_at", "revoked_at", "replaced_by", "created_at"},
+				token.ID, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt, revokedAt, replacedBy, token.CreatedAt,
+			)
+		}
+
+		return fakeResult{}
+	})
+
+	db.on(`UPDATE refresh_tokens SET revoked_at = NOW\(\), replaced_by = \$2 WHERE id = \$1 AND revoked_at IS NULL`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		token, ok := f.tokens[args[0].(string)]
+
+		if !ok || token.RevokedAt != nil {
+			return fakeResult{}
+		}
+
+		now := time.Now()
+		replacedBy := args[1].(string)
+		token.RevokedAt = &now
+		token.ReplacedBy = &replacedBy
+
+		return fakeResult{affected: 1}
+	})
+
+	db.on(`UPDATE refresh_tokens SET revoked_at = NOW\(\) WHERE family_id = \$1`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		var affected int64
+		now := time.Now()
+
+		for _, token := range f.tokens {
+			if token.FamilyID == args[0] && token.RevokedAt == nil {
+				token.RevokedAt = &now
+				affected++
+			}
+		}
+
+		return fakeResult{affected: affected}
+	})
+
+	db.on(`SELECT EXISTS\(SELECT 1 FROM refresh_tokens WHERE family_id = \$1`, func(args []driver.Value) fakeResult {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		for _, token := range f.tokens {
+			if token.FamilyID == args[0] && token.RevokedAt == nil && time.Now().Before(token.ExpiresAt) {
+				return row([]string{"exists"}, true)
+			}
+		}
+
+		return row([]string{"exists"}, false)
+	})
+
+	return f
+}
+
+func (f *refreshTokens) expireAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, token := range f.tokens {
+		token.ExpiresAt = time.Now().Add(-time.Second)
+	}
+}
+
+func (f *refreshTokens) setStaleReads() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.staleReads = true
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	const (
+		opRefresh	= "refresh"
+		opLogout	= "logout"
+		opExpire	= "expire"
+		opStale		= "stale"
+	)
+
+	// step acts on the refresh token issued at index token; login issues
+	// token 0 and every successful refresh issues the next one
+	type step struct {
+		op		string
+		token	int
+		wantErr	error
+	}
+
+	tests := []struct {
+		name			string
+		steps			[]step
+		wantRevoked		bool
+		wantRevocations	int
+	}{
+		{
+			name: "rotation",
+			steps: []step{{op: opRefresh, token: 0}, {op: opRefresh, token: 1}, {op: opRefresh, token: 2}},
+		},
+		{
+			name: "reusing a rotated token revokes the family",
+			steps: []step{
+				{op: opRefresh, token: 0},
+				{op: opRefresh, token: 0, wantErr: ErrInvalidRefreshToken},
+				{op: opRefresh, token: 1, wantErr: ErrInvalidRefreshToken},
+			},
+			wantRevoked: true,
+			wantRevocations: 1,
+		},
+		{
+			name: "losing a rotation race revokes the family",
+			steps: []step{
+				{op: opRefresh, token: 0},
+				{op: opStale},
+				{op: opRefresh, token: 0, wantErr: ErrInvalidRefreshToken},
+			},
+			wantRevoked: true,
+			wantRevocations: 1,
+		},
+		{
+			name: "logout",
+			steps: []step{
+				{op: opLogout, token: 0},
+				{op: opRefresh, token: 0, wantErr: ErrInvalidRefreshToken},
+				{op: opLogout, token: 0},
+			},
+			wantRevoked: true,
+			wantRevocations: 2,
+		},
+		{
+			name: "expired token is refused without revoking",
+			steps: []step{
+				{op: opExpire},
+				{op: opRefresh, token: 0, wantErr: ErrInvalidRefreshToken},
+			},
+			wantRevoked: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := testUser(t)
+			db := newFakeDB(t)
+			onLoginAttempts(db)
+			onUsers(db, user)
+			store := onRefreshTokens(db)
+			s := newTestService(t, db)
+
+			var mu sync.Mutex
+			revocations := 0
+
+			s.OnSessionRevoked(func(string) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				revocations++
+			})
+
+			login, err := s.authenticate(user.Username, "correct horse battery staple", "203.0.113.7")
+
+			if err != nil {
+				t.Fatalf("failed to log in: %v", err)
+			}
+
+			claims, err := s.KeySet.ValidateTokenString(login.AccessToken)
+
+			if err != nil {
+				t.Fatalf("invalid access token: %v", err)
+			}
+
+			issued := []string{login.RefreshToken}
+
+			for i, st := range tt.steps {
+				var err error
+
+				switch st.op {
+					case opRefresh:
+						var pair *TokenPair
+
+						if pair, err = s.refreshTokens(issued[st.token]); err == nil {
+							issued = append(issued, pair.RefreshToken)
+						}
+
+					case opLogout:
+						err = s.logout(issued[st.token])
+
+					case opExpire:
+						store.expireAll()
+
+					case opStale:
+						store.setStaleReads()
+				}
+
+				if !errors.Is(err, st.wantErr) {
+					t.Fatalf("step %d: got %v, want %v", i, err, st.wantErr)
+				}
+			}
+
+			// Skip the cache so the table decides
+			s.sessions = newSessionCache()
+
+			if revoked, err := s.IsSessionRevoked(claims.SessionID); err != nil || revoked != tt.wantRevoked {
+				t.Errorf("got revoked %v (%v), want %v", revoked, err, tt.wantRevoked)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if revocations != tt.wantRevocations {
+				t.Errorf("got %d revocations, want %d", revocations, tt.wantRevocations)
+			}
+		})
+	}
+}
+
+func TestRefreshUnknownToken(t *testing.T) {
+	db := newFakeDB(t)
+	onRefreshTokens(db)
+	s := newTestService(t, db)
+
+	if _, err := s.refreshTokens("unknown"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("got %v, want %v", err, ErrInvalidRefreshToken)
+	}
+
+	if err := s.logout("unknown"); err != nil {
+		t.Errorf("got %v, want no error", err)
+	}
+}
@@ -3,6 +3,11 @@ package users
 import (
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
 )
 
 type UserRepository struct {
@@ -19,7 +24,7 @@ func (r *UserRepository) selectUsers(username string, limit int, offset int) ([]
 	var users = []User{}
 
 	rows, err := r.DB.Query(
-		"SELECT id, username, password, created_at, updated_at FROM users WHERE username LIKE $1 LIMIT $2 OFFSET $3",
+		"SELECT id, username, password, display_name, avatar_url, bio, role, created_at, updated_at FROM users WHERE deleted_at IS NULL AND username LIKE $1 LIMIT $2 OFFSET $3",
 		"%" + username + "%",
 		limit,
 		offset,
@@ -34,7 +39,7 @@ func (r *UserRepository) selectUsers(username string, limit int, offset int) ([]
 	for rows.Next() {
 		var user User
 
-		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if err := rows.Scan(&user.ID, &user.Username, &user.Password, &user.DisplayName, &user.AvatarURL, &user.Bio, &user.Role, &user.CreatedAt, &user.UpdatedAt); err != nil {
 			return nil, err
 		}
 		users = append(users, user)
@@ -51,13 +56,13 @@ func (r *UserRepository) selectUserByID(id string) (*User, error) {
 	var user User
 
 	row := r.DB.QueryRow(
-		"SELECT id, username, password, created_at, updated_at FROM users WHERE id = $1",
+		"SELECT id, username, password, display_name, avatar_url, bio, role, created_at, updated_at FROM users WHERE deleted_at IS NULL AND id = $1",
 		id,
 	)
 
-	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.DisplayName, &user.AvatarURL, &user.Bio, &user.Role, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -69,13 +74,13 @@ func (r *UserRepository) selectUserByUsername(username string) (*User, error) {
 	var user User
 
 	row := r.DB.QueryRow(
-		"SELECT id, username, password, created_at, updated_at FROM users WHERE username = $1",
+		"SELECT id, username, password, display_name, avatar_url, bio, role, created_at, updated_at FROM users WHERE deleted_at IS NULL AND username = $1",
 		username,
 	)
 
-	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.CreatedAt, &user.UpdatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+	if err := row.Scan(&user.ID, &user.Username, &user.Password, &user.DisplayName, &user.AvatarURL, &user.Bio, &user.Role, &user.CreatedAt, &user.UpdatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
@@ -89,16 +94,342 @@ func (r *UserRepository) insertUser(user *User) (*User, error) {
 	err := r.DB.QueryRow(
 		`INSERT INTO users(id, username, password)
 		VALUES($1, $2, $3)
-		RETURNING id, username, password, created_at, updated_at
+		RETURNING id, username, password, display_name, avatar_url, bio, role, created_at, updated_at
 		`,
 		user.ID,
 		user.Username,
 		user.Password,
-	).Scan(&insertedUser.ID, &insertedUser.Username, &insertedUser.Password, &insertedUser.CreatedAt, &insertedUser.UpdatedAt)
+	).Scan(&insertedUser.ID, &insertedUser.Username, &insertedUser.Password, &insertedUser.DisplayName, &insertedUser.AvatarURL, &insertedUser.Bio, &insertedUser.Role, &insertedUser.CreatedAt, &insertedUser.UpdatedAt)
 
 	if err != nil {
+		if utils.IsUniqueViolation(err) {
+			return nil, ErrUsernameExists
+		}
 		return nil, err
 	}
 
 	return &insertedUser, nil
 }
+
+func (r *UserRepository) updateUserProfile(user *User) (*User, error) {
+	var updatedUser User
+
+	err := r.DB.QueryRow(
+		`UPDATE users SET display_name = $2, avatar_url = $3, bio = $4
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id, username, password, display_name, avatar_url, bio, role, created_at, updated_at
+		`,
+		user.ID,
+		user.DisplayName,
+		user.AvatarURL,
+		user.Bio,
+	).Scan(&updatedUser.ID, &updatedUser.Username, &updatedUser.Password, &updatedUser.DisplayName, &updatedUser.AvatarURL, &updatedUser.Bio, &updatedUser.Role, &updatedUser.CreatedAt, &updatedUser.UpdatedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &updatedUser, nil
+}
+
+func (r *UserRepository) updateUserRole(id string, role string) (*User, error) {
+	var updatedUser User
+
+	err := r.DB.QueryRow(
+		`UPDATE users SET role = $2
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING id, username, password, display_name, avatar_url, bio, role, created_at, updated_at
+		`,
+		id,
+		role,
+	).Scan(&updatedUser.ID, &updatedUser.Username, &updatedUser.Password, &updatedUser.DisplayName, &updatedUser.AvatarURL, &updatedUser.Bio, &updatedUser.Role, &updatedUser.CreatedAt, &updatedUser.UpdatedAt)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &updatedUser, nil
+}
+
+// updateUserRolesByUsername promotes the given usernames to role.
+func (r *UserRepository) updateUserRolesByUsername(usernames []string, role string) error {
+	_, err := r.DB.Exec(
+		"UPDATE users SET role = $2 WHERE username = ANY($1) AND deleted_at IS NULL AND role <> $2",
+		pq.Array(usernames),
+		role,
+	)
+
+	return err
+}
+
+func (r *UserRepository) updateUserPassword(id string, password string) error {
+	result, err := r.DB.Exec(
+		"UPDATE users SET password = $2 WHERE id = $1 AND deleted_at IS NULL",
+		id,
+		password,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// softDeleteUser marks the user deleted and clears their profile. The row is
+// kept so their chat history still resolves a username.
+func (r *UserRepository) softDeleteUser(id string) error {
+	result, err := r.DB.Exec(
+		`UPDATE users SET deleted_at = NOW(), display_name = '', avatar_url = '', bio = ''
+		WHERE id = $1 AND deleted_at IS NULL`,
+		id,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (r *UserRepository) insertRefreshToken(token *RefreshToken) error {
+	_, err := r.DB.Exec(
+		`INSERT INTO refresh_tokens(id, user_id, family_id, token_hash, expires_at)
+		VALUES($1, $2, $3, $4, $5)
+		`,
+		token.ID,
+		token.UserID,
+		token.FamilyID,
+		token.TokenHash,
+		token.ExpiresAt,
+	)
+
+	return err
+}
+
+func (r *UserRepository) selectRefreshTokenByHash(tokenHash string) (*RefreshToken, error) {
+	var token RefreshToken
+
+	row := r.DB.QueryRow(
+		`SELECT id, user_id, family_id, token_hash, expires_at, revoked_at, replaced_by, created_at
+		FROM refresh_tokens WHERE token_hash = $1`,
+		tokenHash,
+	)
+
+	if err := row.Scan(&token.ID, &token.UserID, &token.FamilyID, &token.TokenHash, &token.ExpiresAt, &token.RevokedAt, &token.ReplacedBy, &token.CreatedAt); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errRefreshTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// rotateRefreshToken retires oldID in favour of newToken atomically. It fails
+// with "refresh token reused" when oldID was already retired, which includes
+// losing a race against a concurrent rotation.
+func (r *UserRepository) rotateRefreshToken(oldID string, newToken *RefreshToken) error {
+	tx, err := r.DB.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = $2 WHERE id = $1 AND revoked_at IS NULL",
+		oldID,
+		newToken.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return errRefreshTokenReused
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO refresh_tokens(id, user_id, family_id, token_hash, expires_at)
+		VALUES($1, $2, $3, $4, $5)
+		`,
+		newToken.ID,
+		newToken.UserID,
+		newToken.FamilyID,
+		newToken.TokenHash,
+		newToken.ExpiresAt,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (r *UserRepository) revokeRefreshTokenFamily(familyID string) error {
+	_, err := r.DB.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL",
+		familyID,
+	)
+
+	return err
+}
+
+func (r *UserRepository) selectActiveRefreshTokenFamily(familyID string) (bool, error) {
+	var active bool
+
+	err := r.DB.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM refresh_tokens WHERE family_id = $1 AND revoked_at IS NULL AND expires_at > NOW())",
+		familyID,
+	).Scan(&active)
+
+	return active, err
+}
+
+func (r *UserRepository) selectLoginAttempt(key string) (*LoginAttempt, error) {
+	var attempt LoginAttempt
+
+	row := r.DB.QueryRow(
+		"SELECT key, failed_count, last_failed_at, locked_until FROM login_attempts WHERE key = $1",
+		key,
+	)
+
+	if err := row.Scan(&attempt.Key, &attempt.FailedCount, &attempt.LastFailedAt, &attempt.LockedUntil); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// incrementLoginFailures bumps the failure counter of key and returns the new
+// count. Counters idle for longer than window start over.
+func (r *UserRepository) incrementLoginFailures(key string, window time.Duration) (int, error) {
+	var failedCount int
+
+	err := r.DB.QueryRow(
+		`INSERT INTO login_attempts(key, failed_count, last_failed_at)
+		VALUES($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failed_count = CASE
+				WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $2) THEN 1
+				ELSE login_attempts.failed_count + 1
+			END,
+			last_failed_at = NOW()
+		RETURNING failed_count
+		`,
+		key,
+		window.Seconds(),
+	).Scan(&failedCount)
+
+	return failedCount, err
+}
+
+func (r *UserRepository) updateLoginLock(key string, lockedUntil time.Time) error {
+	_, err := r.DB.Exec(
+		"UPDATE login_attempts SET locked_until = $2 WHERE key = $1",
+		key,
+		lockedUntil,
+	)
+
+	return err
+}
+
+func (r *UserRepository) deleteLoginAttempt(key string) error {
+	_, err := r.DB.Exec("DELETE FROM login_attempts WHERE key = $1", key)
+
+	return err
+}
+
+func (r *UserRepository) insertAuditLog(event string, subject string, ip string, details string) error {
+	_, err := r.DB.Exec(
+		`INSERT INTO audit_logs(id, event, subject, ip, details)
+		VALUES($1, $2, $3, $4, $5)
+		`,
+		uuid.New().String(),
+		event,
+		subject,
+		ip,
+		details,
+	)
+
+	return err
+}
+
+// revokeUserRefreshTokens revokes every session of a user except keepFamilyID
+// and returns the revoked family ids.
+func (r *UserRepository) revokeUserRefreshTokens(userID string, keepFamilyID string) ([]string, error) {
+	rows, err := r.DB.Query(
+		`UPDATE refresh_tokens SET revoked_at = NOW()
+		WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL
+		RETURNING family_id`,
+		userID,
+		keepFamilyID,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var familyIDs = []string{}
+	seen := map[string]bool{}
+
+	for rows.Next() {
+		var familyID string
+
+		if err := rows.Scan(&familyID); err != nil {
+			return nil, err
+		}
+
+		if !seen[familyID] {
+			seen[familyID] = true
+			familyIDs = append(familyIDs, familyID)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return familyIDs, nil
+}
@@ -2,8 +2,8 @@ package users
 
 import (
 	"encoding/json"
+	"net"
 	"net/http"
-	"strconv"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/nambuitechx/nam-chilling-room-server/utils"
@@ -12,10 +12,23 @@ import (
 func NewUserRouter(userService *UserService) http.Handler {
 	r := chi.NewRouter()
 
-	r.Get("/", listUsers(userService))
-	r.Get("/{userID}", getUserByID(userService))
 	r.Post("/register", createUser(userService))
 	r.Post("/login", login(userService))
+	r.Post("/token/refresh", refreshToken(userService))
+	r.Post("/logout", logout(userService))
+
+	r.Group(func(r chi.Router) {
+		r.Use(utils.Authenticate(userService.KeySet, userService))
+
+		r.Get("/", listUsers(userService))
+		r.Get("/me", getCurrentUser(userService))
+		r.Patch("/me", updateCurrentUser(userService))
+		r.Post("/me/password", changePassword(userService))
+		r.Delete("/me", deleteCurrentUser(userService))
+		r.Get("/{userID}", getUserByID(userService))
+
+		r.With(utils.RequireRole(utils.RoleAdmin)).Put("/{userID}/role", updateUserRole(userService))
+	})
 
 	return r
 }
@@ -23,14 +36,14 @@ func NewUserRouter(userService *UserService) http.Handler {
 func listUsers(s *UserService) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		username := r.URL.Query().Get("username")
-		limit, err := getQueryInt(r, "limit", 10)
+		limit, err := utils.GetQueryInt(r, "limit", 10)
 		
 		if err != nil {
 			utils.ResponseError(w, "Invalid limit", 400, err)
 			return
 		}
 
-		offset, err := getQueryInt(r, "offset", 0)
+		offset, err := utils.GetQueryInt(r, "offset", 0)
 		
 		if err != nil {
 			utils.ResponseError(w, "Invalid offset", 400, err)
@@ -40,13 +53,13 @@ func listUsers(s *UserService) http.HandlerFunc {
 		users, err := s.listUsers(username, limit, offset)
 
 		if err != nil {
-			utils.ResponseError(w, "Failed to get all users", 500, err)
+			utils.ResponseError(w, "Failed to get all users", utils.StatusCode(err), err)
 			return
 		}
 
 		resp, _ := json.Marshal(map[string]any {
 			"message": "Get all users successfully",
-			"data": users,
+			"data": toPublicUsers(users),
 		})
 
 		w.Write(resp)
@@ -59,13 +72,125 @@ func getUserByID(s *UserService) http.HandlerFunc {
 		user, err := s.getUserByID(userID)
 
 		if err != nil {
-			utils.ResponseError(w, "Failed to get user by id", 500, err)
+			utils.ResponseError(w, "Failed to get user by id", utils.StatusCode(err), err)
 			return
 		}
 
 		resp, _ := json.Marshal(map[string]any {
 			"message": "Get user by id successfully",
-			"data": *user,
+			"data": user.toPublic(),
+		})
+
+		w.Write(resp)
+	})
+}
+
+func getCurrentUser(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		user, err := s.getUserByID(claims.ID)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to get current user", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Get current user successfully",
+			"data": user.toPublic(),
+		})
+
+		w.Write(resp)
+	})
+}
+
+func updateCurrentUser(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload UpdateProfilePayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+		user, err := s.updateProfile(claims.ID, payload)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to update profile", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Update profile successfully",
+			"data": user.toPublic(),
+		})
+
+		w.Write(resp)
+	})
+}
+
+func changePassword(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload ChangePasswordPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+
+		if err := s.changePassword(claims.ID, claims.SessionID, payload.CurrentPassword, payload.NewPassword, clientIP(r)); err != nil {
+			utils.ResponseError(w, "Failed to change password", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Change password successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func deleteCurrentUser(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := utils.GetAuthorizedUser(r.Context())
+
+		if err := s.deleteAccount(claims.ID); err != nil {
+			utils.ResponseError(w, "Failed to delete account", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Delete account successfully",
+		})
+
+		w.Write(resp)
+	})
+}
+
+func updateUserRole(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload UpdateRolePayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		userID := chi.URLParam(r, "userID")
+		user, err := s.updateRole(userID, payload.Role)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to update user role", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Update user role successfully",
+			"data": user.toPublic(),
 		})
 
 		w.Write(resp)
@@ -76,21 +201,21 @@ func createUser(s *UserService) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var payload CreateUserPayload
 
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			utils.ResponseError(w, "Failed to decode body payload", 400, err)
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
 			return
 		}
 
 		user, err := s.createUser(payload.Username, payload.Password)
 
 		if err != nil {
-			utils.ResponseError(w, "Failed to create new user", 500, err)
+			utils.ResponseError(w, "Failed to create new user", utils.StatusCode(err), err)
 			return
 		}
 
 		resp, _ := json.Marshal(map[string]any {
 			"message": "Create new user successfully",
-			"data": *user,
+			"data": user.toPublic(),
 		})
 
 		w.Write(resp)
@@ -101,33 +226,82 @@ func login(s *UserService) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		var payload LoginPayload
 
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-			utils.ResponseError(w, "Failed to decode body payload", 400, err)
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
 			return
 		}
 
-		tokenString, err := s.authenticate(payload.Username, payload.Password)
+		tokenPair, err := s.authenticate(payload.Username, payload.Password, clientIP(r))
 
 		if err != nil {
-			utils.ResponseError(w, "Invalid username or password", 400, err)
+			utils.ResponseError(w, "Invalid username or password", utils.StatusCode(err), err)
 			return
 		}
 
 		resp, _ := json.Marshal(map[string]any {
 			"message": "login successfully",
-			"data": tokenString,
+			"data": *tokenPair,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func refreshToken(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload RefreshTokenPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		tokenPair, err := s.refreshTokens(payload.RefreshToken)
+
+		if err != nil {
+			utils.ResponseError(w, "Failed to refresh token", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "Refresh token successfully",
+			"data": *tokenPair,
+		})
+
+		w.Write(resp)
+	})
+}
+
+func logout(s *UserService) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload RefreshTokenPayload
+
+		if err := utils.DecodeJSON(w, r, &payload); err != nil {
+			utils.ResponseError(w, "Failed to decode body payload", utils.StatusCode(err), err)
+			return
+		}
+
+		if err := s.logout(payload.RefreshToken); err != nil {
+			utils.ResponseError(w, "Failed to logout", utils.StatusCode(err), err)
+			return
+		}
+
+		resp, _ := json.Marshal(map[string]any {
+			"message": "logout successfully",
 		})
 
 		w.Write(resp)
 	})
 }
 
-func getQueryInt(r *http.Request, key string, defaultValue int) (int, error) {
-    valStr := r.URL.Query().Get(key)
+// clientIP returns the caller address; utils.RealIP has already applied
+// X-Forwarded-For / X-Real-IP to RemoteAddr for requests from trusted proxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
 
-    if valStr == "" {
-        return defaultValue, nil
-    }
+	if err != nil {
+		return r.RemoteAddr
+	}
 
-    return strconv.Atoi(valStr)
+	return host
 }
@@ -0,0 +1,188 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testUser(t *testing.T) User {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse battery staple"), bcrypt.MinCost)
+
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+
+	return User{
+		ID: "8f0e2c1a-0000-4000-8000-000000000001",
+		Username: "alice",
+		Password: string(hash),
+		DisplayName: "Alice",
+		Bio: "hello",
+		Role: "user",
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+}
+
+func assertNoPasswordHash(t *testing.T, name string, body []byte, hash string) {
+	t.Helper()
+
+	if strings.Contains(string(body), hash) {
+		t.Errorf("%s: response contains the password hash: %s", name, body)
+	}
+
+	if strings.Contains(string(body), "$2a$") || strings.Contains(string(body), "$2b$") {
+		t.Errorf("%s: response contains a bcrypt hash: %s", name, body)
+	}
+
+	if strings.Contains(strings.ToLower(string(body)), `"password"`) {
+		t.Errorf("%s: response contains a password field: %s", name, body)
+	}
+}
+
+// Every handler returning users responds with one of these bodies.
+func TestUserResponsesNeverContainPasswordHash(t *testing.T) {
+	user := testUser(t)
+	users := []User{user, testUser(t)}
+
+	responses := map[string]any {
+		"listUsers": map[string]any {
+			"message": "Get all users successfully",
+			"data": toPublicUsers(users),
+		},
+		"getUserByID": map[string]any {
+			"message": "Get user by id successfully",
+			"data": user.toPublic(),
+		},
+		"getCurrentUser": map[string]any {
+			"message": "Get current user successfully",
+			"data": user.toPublic(),
+		},
+		"updateCurrentUser": map[string]any {
+			"message": "Update profile successfully",
+			"data": user.toPublic(),
+		},
+		"updateUserRole": map[string]any {
+			"message": "Update user role successfully",
+			"data": user.toPublic(),
+		},
+		"createUser": map[string]any {
+			"message": "Create new user successfully",
+			"data": user.toPublic(),
+		},
+		"storage model": user,
+	}
+
+	for name, response := range responses {
+		body, err := json.Marshal(response)
+
+		if err != nil {
+			t.Fatalf("%s: failed to marshal response: %v", name, err)
+		}
+
+		assertNoPasswordHash(t, name, body, user.Password)
+
+		for i := range users {
+			assertNoPasswordHash(t, name, body, users[i].Password)
+		}
+	}
+}
+
+func TestPublicUserHasNoPasswordField(t *testing.T) {
+	publicType := reflect.TypeOf(PublicUser{})
+
+	for i := 0; i < publicType.NumField(); i++ {
+		field := publicType.Field(i)
+
+		if strings.Contains(strings.ToLower(field.Name), "password") || strings.Contains(strings.ToLower(field.Tag.Get("json")), "password") {
+			t.Errorf("PublicUser exposes field %s", field.Name)
+		}
+	}
+}
+
+func TestRouterErrorResponses(t *testing.T) {
+	user := testUser(t)
+
+	tests := []struct {
+		name		string
+		method		string
+		path		string
+		body		any
+		role		string
+		wantStatus	int
+		wantCode	string
+	}{
+		{name: "duplicate username", method: http.MethodPost, path: "/register", body: CreateUserPayload{Username: user.Username, Password: "correct horse battery staple"}, wantStatus: http.StatusConflict, wantCode: "username_exists"},
+		{name: "invalid registration", method: http.MethodPost, path: "/register", body: CreateUserPayload{Username: "", Password: "x"}, wantStatus: http.StatusBadRequest, wantCode: "validation_failed"},
+		{name: "wrong password", method: http.MethodPost, path: "/login", body: LoginPayload{Username: user.Username, Password: "wrong password"}, wantStatus: http.StatusUnauthorized, wantCode: "invalid_credentials"},
+		{name: "unknown refresh token", method: http.MethodPost, path: "/token/refresh", body: RefreshTokenPayload{RefreshToken: "unknown"}, wantStatus: http.StatusUnauthorized, wantCode: "invalid_refresh_token"},
+		{name: "missing token", method: http.MethodGet, path: "/" + user.ID, wantStatus: http.StatusUnauthorized, wantCode: "missing_token"},
+		{name: "unknown user", method: http.MethodGet, path: "/8f0e2c1a-0000-4000-8000-0000000000ff", role: utils.RoleUser, wantStatus: http.StatusNotFound, wantCode: "user_not_found"},
+		{name: "known user", method: http.MethodGet, path: "/" + user.ID, role: utils.RoleUser, wantStatus: http.StatusOK},
+		{name: "role change by a user", method: http.MethodPut, path: "/" + user.ID + "/role", body: UpdateRolePayload{Role: utils.RoleAdmin}, role: utils.RoleUser, wantStatus: http.StatusForbidden, wantCode: "insufficient_role"},
+		{name: "unknown role", method: http.MethodPut, path: "/" + user.ID + "/role", body: UpdateRolePayload{Role: "owner"}, role: utils.RoleAdmin, wantStatus: http.StatusBadRequest, wantCode: "invalid_role"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			onLoginAttempts(db)
+			onUsers(db, user)
+			onRefreshTokens(db)
+			s := newTestService(t, db)
+
+			var body bytes.Buffer
+
+			if tt.body != nil {
+				json.NewEncoder(&body).Encode(tt.body)
+			}
+
+			req := httptest.NewRequest(tt.method, tt.path, &body)
+			req.Header.Set("Content-Type", "application/json")
+
+			if tt.role != "" {
+				token, err := s.KeySet.SignToken(utils.AuthorizedUserInfo{
+					ID: user.ID,
+					Username: user.Username,
+					Role: tt.role,
+					RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))},
+				})
+
+				if err != nil {
+					t.Fatalf("failed to sign token: %v", err)
+				}
+
+				req.Header.Set("Authorization", "Bearer " + token)
+			}
+
+			rec := httptest.NewRecorder()
+			NewUserRouter(s).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			var resp struct {
+				Code	string	`json:"code"`
+			}
+
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+
+			if resp.Code != tt.wantCode {
+				t.Errorf("got code %q, want %q", resp.Code, tt.wantCode)
+			}
+		})
+	}
+}
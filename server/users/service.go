@@ -1,7 +1,13 @@
 package users
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -10,13 +16,29 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	accessTokenTTL	= 15 * time.Minute
+	refreshTokenTTL	= 30 * 24 * time.Hour
+)
+
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
 type UserService struct {
-	UserRepository *UserRepository
+	UserRepository	*UserRepository
+	KeySet			*utils.KeySet
+	PasswordPolicy	*PasswordPolicy
+
+	mu					sync.RWMutex
+	sessionListeners	[]func(sessionID string)
+	sessions			*sessionCache
 }
 
-func NewUserService(userRepository *UserRepository) *UserService {
+func NewUserService(userRepository *UserRepository, keySet *utils.KeySet, passwordPolicy *PasswordPolicy) *UserService {
 	return &UserService{
 		UserRepository: userRepository,
+		KeySet: keySet,
+		PasswordPolicy: passwordPolicy,
+		sessions: newSessionCache(),
 	}
 }
 
@@ -29,14 +51,20 @@ func (s *UserService) getUserByID(id string) (*User, error) {
 }
 
 func (s *UserService) createUser(username string, password string) (*User, error) {
+	payload := CreateUserPayload{Username: username, Password: password}
+
+	if err := s.PasswordPolicy.validateCreateUserPayload(payload); err != nil {
+		return nil, err
+	}
+
 	user, err := s.UserRepository.selectUserByUsername(username)
 
-	if err != nil && err.Error() != "user not found" {
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
 		return nil, err
 	}
 
 	if user != nil {
-		return nil, errors.New("username exists")
+		return nil, ErrUsernameExists
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
@@ -54,42 +82,346 @@ func (s *UserService) createUser(username string, password string) (*User, error
 	return s.UserRepository.insertUser(newUser)
 }
 
-func (s *UserService) authenticate(username string, password string) (string, error) {
+func (s *UserService) updateProfile(userID string, payload UpdateProfilePayload) (*User, error) {
+	if err := validateUpdateProfilePayload(payload); err != nil {
+		return nil, err
+	}
+
+	user, err := s.UserRepository.selectUserByID(userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if payload.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*payload.DisplayName)
+	}
+
+	if payload.AvatarURL != nil {
+		user.AvatarURL = *payload.AvatarURL
+	}
+
+	if payload.Bio != nil {
+		user.Bio = *payload.Bio
+	}
+
+	return s.UserRepository.updateUserProfile(user)
+}
+
+// changePassword requires the current password and signs out every other
+// session of the user, keeping the one making the request. Wrong current
+// passwords count as failed logins, so a stolen access token cannot be used
+// to guess the password either.
+func (s *UserService) changePassword(userID string, sessionID string, currentPassword string, newPassword string, ip string) error {
+	user, err := s.UserRepository.selectUserByID(userID)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkLoginLocked(user.Username, ip); err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		s.recordLoginFailure(user.Username, ip)
+		return utils.FieldErrors{"current_password": "is incorrect"}
+	}
+
+	s.resetLoginFailures(user.Username)
+
+	if msg := s.PasswordPolicy.validate(newPassword); msg != "" {
+		return utils.FieldErrors{"new_password": msg}
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.UserRepository.updateUserPassword(userID, string(hashedPassword)); err != nil {
+		return err
+	}
+
+	return s.revokeUserSessions(userID, sessionID)
+}
+
+// updateRole changes a user's role and revokes their sessions so tokens
+// carrying the old role stop working right away.
+func (s *UserService) updateRole(userID string, role string) (*User, error) {
+	if !utils.IsValidRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	user, err := s.UserRepository.updateUserRole(userID, role)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.revokeUserSessions(userID, ""); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// BootstrapAdmins grants the admin role to the given usernames so a fresh
+// deployment has someone able to assign roles.
+func (s *UserService) BootstrapAdmins(usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	return s.UserRepository.updateUserRolesByUsername(usernames, utils.RoleAdmin)
+}
+
+// deleteAccount soft-deletes the user and revokes all of their sessions.
+func (s *UserService) deleteAccount(userID string) error {
+	if err := s.UserRepository.softDeleteUser(userID); err != nil {
+		return err
+	}
+
+	return s.revokeUserSessions(userID, "")
+}
+
+func (s *UserService) authenticate(username string, password string, ip string) (*TokenPair, error) {
+	if err := validateLoginPayload(LoginPayload{Username: username, Password: password}); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkLoginLocked(username, ip); err != nil {
+		return nil, err
+	}
+
 	user, err := s.UserRepository.selectUserByUsername(username)
 
+	if err != nil && !errors.Is(err, ErrUserNotFound) {
+		return nil, err
+	}
+
+	// Unknown users are compared against a dummy hash so the response time
+	// does not reveal whether the username exists
+	hashedPassword := dummyPasswordHash
+
+	if user != nil {
+		hashedPassword = []byte(user.Password)
+	}
+
+	err = bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+
+	if err != nil || user == nil {
+		s.recordLoginFailure(username, ip)
+		return nil, ErrInvalidCredentials
+	}
+
+	s.resetLoginFailures(username)
+
+	// Each login starts a new refresh token family, which doubles as the session id
+	return s.issueTokens(user, uuid.New().String(), "")
+}
+
+// refreshTokens rotates a refresh token. Presenting a token that was already
+// rotated means it leaked, so the whole family is revoked.
+func (s *UserService) refreshTokens(refreshToken string) (*TokenPair, error) {
+	token, err := s.UserRepository.selectRefreshTokenByHash(hashRefreshToken(refreshToken))
+
 	if err != nil {
-		return "", err
+		if errors.Is(err, errRefreshTokenNotFound) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	if token.RevokedAt != nil {
+		if token.ReplacedBy != nil {
+			s.revokeSession(token.FamilyID)
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if time.Now().After(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password))
+	user, err := s.UserRepository.selectUserByID(token.UserID)
 
 	if err != nil {
-		return "", errors.New("invalid username or password")
+		return nil, err
+	}
+
+	tokenPair, err := s.issueTokens(user, token.FamilyID, token.ID)
+
+	if err != nil {
+		if errors.Is(err, errRefreshTokenReused) {
+			s.revokeSession(token.FamilyID)
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
 	}
 
+	return tokenPair, nil
+}
+
+// logout revokes the session the refresh token belongs to. Unknown tokens are
+// ignored so logging out twice is harmless.
+func (s *UserService) logout(refreshToken string) error {
+	token, err := s.UserRepository.selectRefreshTokenByHash(hashRefreshToken(refreshToken))
+
+	if err != nil {
+		if errors.Is(err, errRefreshTokenNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	return s.revokeSession(token.FamilyID)
+}
+
+// issueTokens signs an access token bound to familyID and stores a new refresh
+// token in that family, replacing previousID when rotating.
+func (s *UserService) issueTokens(user *User, familyID string, previousID string) (*TokenPair, error) {
+	now := time.Now()
+
 	claimsStruct := utils.AuthorizedUserInfo {
 		ID: user.ID,
 		Username: user.Username,
+		SessionID: familyID,
+		Role: user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
-			IssuedAt: jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+			IssuedAt: jwt.NewNumericDate(now),
 			Issuer: "nam-chilling-room",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claimsStruct)
+	accessToken, err := s.KeySet.SignToken(claimsStruct)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := generateRefreshToken()
+
+	if err != nil {
+		return nil, err
+	}
+
+	newToken := &RefreshToken{
+		ID: uuid.New().String(),
+		UserID: user.ID,
+		FamilyID: familyID,
+		TokenHash: hashRefreshToken(refreshToken),
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+
+	if previousID == "" {
+		err = s.UserRepository.insertRefreshToken(newToken)
+	} else {
+		err = s.UserRepository.rotateRefreshToken(previousID, newToken)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken: accessToken,
+		RefreshToken: refreshToken,
+		TokenType: "Bearer",
+		ExpiresIn: int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+func (s *UserService) revokeSession(familyID string) error {
+	if err := s.UserRepository.revokeRefreshTokenFamily(familyID); err != nil {
+		return err
+	}
+
+	s.notifySessionRevoked(familyID)
+
+	return nil
+}
 
-	tokenString, err := token.SignedString([]byte("secret"))
+// revokeUserSessions revokes every session of a user except keepFamilyID.
+func (s *UserService) revokeUserSessions(userID string, keepFamilyID string) error {
+	familyIDs, err := s.UserRepository.revokeUserRefreshTokens(userID, keepFamilyID)
 
 	if err != nil {
+		return err
+	}
+
+	for _, familyID := range familyIDs {
+		s.notifySessionRevoked(familyID)
+	}
+
+	return nil
+}
+
+func (s *UserService) notifySessionRevoked(familyID string) {
+	s.sessions.set(familyID, true)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, listener := range s.sessionListeners {
+		listener(familyID)
+	}
+}
+
+// IsSessionRevoked reports whether the session behind an access token has no
+// usable refresh token left. Tokens without a session id predate refresh
+// tokens and are only bounded by their expiry. Answers are cached for
+// sessionCacheTTL; revocations made here update the cache right away.
+func (s *UserService) IsSessionRevoked(sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+
+	if revoked, ok := s.sessions.get(sessionID); ok {
+		return revoked, nil
+	}
+
+	active, err := s.UserRepository.selectActiveRefreshTokenFamily(sessionID)
+
+	if err != nil {
+		return false, err
+	}
+
+	s.sessions.set(sessionID, !active)
+
+	return !active, nil
+}
+
+// OnSessionRevoked registers a listener called with the session id whenever a
+// session is revoked by logout or refresh token reuse.
+func (s *UserService) OnSessionRevoked(listener func(sessionID string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessionListeners = append(s.sessionListeners, listener)
+}
+
+func generateRefreshToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Refresh tokens are high-entropy random values, so a plain SHA-256 is enough
+// to keep them useless if the table leaks.
+func hashRefreshToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
 }
 
 // func (s *UserService) authorize(tokenString string) (*User, error) {
-// 	claims, err := utils.ValidateTokenString(tokenString)
+// 	claims, err := s.KeySet.ValidateTokenString(tokenString)
 
 // 	if err != nil {
 // 		return nil, err
@@ -0,0 +1,78 @@
+package users
+
+import (
+	"sync"
+	"time"
+)
+
+// How long an active session is trusted before the database is asked again.
+// Revocations made by this instance reach the cache at once; this bounds how
+// long one made by another instance goes unnoticed.
+const sessionCacheTTL = 30 * time.Second
+
+// sessionCache remembers IsSessionRevoked answers so authenticated requests
+// do not each query the database.
+type sessionCache struct {
+	mu		sync.Mutex
+	entries	map[string]sessionCacheEntry
+	swept	time.Time
+}
+
+type sessionCacheEntry struct {
+	revoked	bool
+	expires	time.Time
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{
+		entries: make(map[string]sessionCacheEntry),
+		swept: time.Now(),
+	}
+}
+
+func (c *sessionCache) get(sessionID string) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[sessionID]
+
+	if !ok || time.Now().After(entry.expires) {
+		return false, false
+	}
+
+	return entry.revoked, true
+}
+
+// set stores an answer. Revoked sessions never become active again, so an
+// active answer read before a concurrent revocation cannot overwrite it.
+// Revoked entries outlive every access token issued for the session.
+func (c *sessionCache) set(sessionID string, revoked bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+
+	if entry, ok := c.entries[sessionID]; ok && entry.revoked && !revoked && now.Before(entry.expires) {
+		return
+	}
+
+	ttl := sessionCacheTTL
+
+	if revoked {
+		ttl = accessTokenTTL
+	}
+
+	c.entries[sessionID] = sessionCacheEntry{revoked: revoked, expires: now.Add(ttl)}
+
+	if now.Sub(c.swept) < sessionCacheTTL {
+		return
+	}
+
+	for id, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, id)
+		}
+	}
+
+	c.swept = now
+}
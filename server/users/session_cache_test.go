@@ -0,0 +1,112 @@
+package users
+
+import (
+	"database/sql/driver"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsSessionRevokedCaches(t *testing.T) {
+	const sessionID = "8f0e2c1a-0000-4000-8000-0000000000aa"
+
+	type check struct {
+		wantRevoked	bool
+		wantErr		bool
+	}
+
+	tests := []struct {
+		name		string
+		active		bool
+		failFirst	bool
+		steps		func(s *UserService)
+		checks		[]check
+		wantQueries	int64
+	}{
+		{
+			name: "active session is queried once",
+			active: true,
+			checks: []check{{}, {}, {}},
+			wantQueries: 1,
+		},
+		{
+			name: "revoked session is queried once",
+			checks: []check{{wantRevoked: true}, {wantRevoked: true}},
+			wantQueries: 1,
+		},
+		{
+			name: "revocation replaces a cached active session",
+			active: true,
+			steps: func(s *UserService) {
+				s.IsSessionRevoked(sessionID)
+				s.revokeSession(sessionID)
+			},
+			checks: []check{{wantRevoked: true}},
+			wantQueries: 1,
+		},
+		{
+			name: "revocation before the first check",
+			active: true,
+			steps: func(s *UserService) {
+				s.revokeSession(sessionID)
+			},
+			checks: []check{{wantRevoked: true}},
+			wantQueries: 0,
+		},
+		{
+			name: "expired entries are queried again",
+			active: true,
+			steps: func(s *UserService) {
+				s.IsSessionRevoked(sessionID)
+				s.sessions.entries[sessionID] = sessionCacheEntry{expires: time.Now().Add(-time.Second)}
+			},
+			checks: []check{{}},
+			wantQueries: 2,
+		},
+		{
+			name: "errors are not cached",
+			active: true,
+			failFirst: true,
+			checks: []check{{wantErr: true}, {}, {}},
+			wantQueries: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB(t)
+			var queries atomic.Int64
+
+			db.on(`SELECT EXISTS\(SELECT 1 FROM refresh_tokens`, func(args []driver.Value) fakeResult {
+				if queries.Add(1) == 1 && tt.failFirst {
+					return fakeResult{err: errors.New("connection reset")}
+				}
+
+				return row([]string{"exists"}, tt.active)
+			})
+
+			s := newTestService(t, db)
+
+			if tt.steps != nil {
+				tt.steps(s)
+			}
+
+			for i, c := range tt.checks {
+				revoked, err := s.IsSessionRevoked(sessionID)
+
+				if (err != nil) != c.wantErr {
+					t.Fatalf("check %d: got error %v, want error %v", i, err, c.wantErr)
+				}
+
+				if err == nil && revoked != c.wantRevoked {
+					t.Errorf("check %d: got revoked %v, want %v", i, revoked, c.wantRevoked)
+				}
+			}
+
+			if got := queries.Load(); got != tt.wantQueries {
+				t.Errorf("got %d queries, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
@@ -4,14 +4,79 @@ import (
 	"time"
 )
 
+// User is the storage model. Handlers respond with PublicUser instead so the
+// password hash never leaves the server.
 type User struct {
+	ID			string		`json:"-"`
+	Username	string		`json:"-"`
+	Password	string		`json:"-"`
+	DisplayName	string		`json:"-"`
+	AvatarURL	string		`json:"-"`
+	Bio			string		`json:"-"`
+	Role		string		`json:"-"`
+	CreatedAt	time.Time	`json:"-"`
+	UpdatedAt	time.Time	`json:"-"`
+}
+
+type PublicUser struct {
 	ID			string		`json:"id"`
 	Username	string		`json:"username"`
-	Password	string		`json:"password"`
+	DisplayName	string		`json:"display_name"`
+	AvatarURL	string		`json:"avatar_url"`
+	Bio			string		`json:"bio"`
+	Role		string		`json:"role"`
 	CreatedAt	time.Time	`json:"created_at"`
 	UpdatedAt	time.Time	`json:"updated_at"`
 }
 
+func (u *User) toPublic() PublicUser {
+	return PublicUser{
+		ID: u.ID,
+		Username: u.Username,
+		DisplayName: u.DisplayName,
+		AvatarURL: u.AvatarURL,
+		Bio: u.Bio,
+		Role: u.Role,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
+
+func toPublicUsers(users []User) []PublicUser {
+	publicUsers := make([]PublicUser, 0, len(users))
+
+	for i := range users {
+		publicUsers = append(publicUsers, users[i].toPublic())
+	}
+
+	return publicUsers
+}
+
+type RefreshToken struct {
+	ID			string		`json:"id"`
+	UserID		string		`json:"user_id"`
+	FamilyID	string		`json:"family_id"`
+	TokenHash	string		`json:"-"`
+	ExpiresAt	time.Time	`json:"expires_at"`
+	RevokedAt	*time.Time	`json:"revoked_at"`
+	ReplacedBy	*string		`json:"replaced_by"`
+	CreatedAt	time.Time	`json:"created_at"`
+}
+
+type LoginAttempt struct {
+	Key				string		`json:"key"`
+	FailedCount		int			`json:"failed_count"`
+	LastFailedAt	time.Time	`json:"last_failed_at"`
+	LockedUntil		*time.Time	`json:"locked_until"`
+}
+
+type TokenPair struct {
+	AccessToken		string	`json:"access_token"`
+	RefreshToken	string	`json:"refresh_token"`
+	TokenType		string	`json:"token_type"`
+	ExpiresIn		int		`json:"expires_in"`
+}
+
 type CreateUserPayload struct {
 	Username	string		`json:"username"`
 	Password	string		`json:"password"`
@@ -21,3 +86,23 @@ type LoginPayload struct {
 	Username	string		`json:"username"`
 	Password	string		`json:"password"`
 }
+
+type RefreshTokenPayload struct {
+	RefreshToken	string		`json:"refresh_token"`
+}
+
+// Fields left out of the request body are not changed.
+type UpdateProfilePayload struct {
+	DisplayName	*string		`json:"display_name"`
+	AvatarURL	*string		`json:"avatar_url"`
+	Bio			*string		`json:"bio"`
+}
+
+type ChangePasswordPayload struct {
+	CurrentPassword	string	`json:"current_password"`
+	NewPassword		string	`json:"new_password"`
+}
+
+type UpdateRolePayload struct {
+	Role	string		`json:"role"`
+}
@@ -0,0 +1,176 @@
+package users
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+const (
+	minUsernameLength	= 3
+	maxUsernameLength	= 32
+	minPasswordLength	= 8
+
+	// Width of users.username. Accounts created before the 32 character
+	// limit may be longer and must still be able to log in.
+	maxStoredUsernameLength	= 256
+
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordBytes	= 72
+
+	maxDisplayNameLength	= 64
+	maxAvatarURLLength		= 2048
+	maxBioLength			= 500
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// PasswordPolicy rejects weak passwords, including any found in a local list
+// of known breached passwords.
+type PasswordPolicy struct {
+	breached	map[string]struct{}
+}
+
+// NewPasswordPolicy loads the breached password list at path. A missing file
+// only disables the breached-list check.
+func NewPasswordPolicy(path string) (*PasswordPolicy, error) {
+	p := &PasswordPolicy{breached: make(map[string]struct{})}
+
+	file, err := os.Open(path)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Printf("Breached password list %s not found, skipping breached password check", path)
+			return p, nil
+		}
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p.breached[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *PasswordPolicy) validate(password string) string {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "must be at least 8 characters"
+	}
+
+	if len(password) > maxPasswordBytes {
+		return "must be at most 72 bytes"
+	}
+
+	if _, ok := p.breached[strings.ToLower(password)]; ok {
+		return "is too common, choose another password"
+	}
+
+	return ""
+}
+
+func validateUsername(username string) string {
+	if username == "" {
+		return "is required"
+	}
+
+	if len(username) < minUsernameLength || len(username) > maxUsernameLength {
+		return "must be between 3 and 32 characters"
+	}
+
+	if !usernamePattern.MatchString(username) {
+		return "may only contain letters, digits, '_', '.' and '-', and must start with a letter or digit"
+	}
+
+	return ""
+}
+
+func (p *PasswordPolicy) validateCreateUserPayload(payload CreateUserPayload) error {
+	fieldErrs := utils.FieldErrors{}
+
+	if msg := validateUsername(payload.Username); msg != "" {
+		fieldErrs["username"] = msg
+	}
+
+	if msg := p.validate(payload.Password); msg != "" {
+		fieldErrs["password"] = msg
+	}
+
+	if len(fieldErrs) > 0 {
+		return fieldErrs
+	}
+
+	return nil
+}
+
+// validateLoginPayload only bounds the input; the username rules and the
+// password policy are not applied so users with older accounts can still log
+// in.
+func validateLoginPayload(payload LoginPayload) error {
+	fieldErrs := utils.FieldErrors{}
+
+	if payload.Username == "" {
+		fieldErrs["username"] = "is required"
+	} else if len(payload.Username) > maxStoredUsernameLength {
+		fieldErrs["username"] = "must be at most 256 characters"
+	}
+
+	if payload.Password == "" {
+		fieldErrs["password"] = "is required"
+	} else if len(payload.Password) > maxPasswordBytes {
+		fieldErrs["password"] = "must be at most 72 bytes"
+	}
+
+	if len(fieldErrs) > 0 {
+		return fieldErrs
+	}
+
+	return nil
+}
+
+func validateUpdateProfilePayload(payload UpdateProfilePayload) error {
+	fieldErrs := utils.FieldErrors{}
+
+	if payload.DisplayName != nil && utf8.RuneCountInString(*payload.DisplayName) > maxDisplayNameLength {
+		fieldErrs["display_name"] = "must be at most 64 characters"
+	}
+
+	if payload.AvatarURL != nil && *payload.AvatarURL != "" {
+		if len(*payload.AvatarURL) > maxAvatarURLLength {
+			fieldErrs["avatar_url"] = "must be at most 2048 characters"
+		} else if u, err := url.Parse(*payload.AvatarURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fieldErrs["avatar_url"] = "must be an absolute http or https URL"
+		}
+	}
+
+	if payload.Bio != nil && utf8.RuneCountInString(*payload.Bio) > maxBioLength {
+		fieldErrs["bio"] = "must be at most 500 characters"
+	}
+
+	if len(fieldErrs) > 0 {
+		return fieldErrs
+	}
+
+	return nil
+}
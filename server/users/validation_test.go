@@ -0,0 +1,155 @@
+package users
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nambuitechx/nam-chilling-room-server/utils"
+)
+
+func fieldErrors(t *testing.T, err error) utils.FieldErrors {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+
+	var fieldErrs utils.FieldErrors
+
+	if !errors.As(err, &fieldErrs) {
+		t.Fatalf("got %v, want field errors", err)
+	}
+
+	return fieldErrs
+}
+
+func TestValidateCreateUserPayload(t *testing.T) {
+	policy := &PasswordPolicy{breached: map[string]struct{}{"password123": {}}}
+
+	tests := []struct {
+		name	string
+		payload	CreateUserPayload
+		want	utils.FieldErrors
+	}{
+		{name: "valid", payload: CreateUserPayload{Username: "alice_01", Password: "correct horse"}},
+		{
+			name: "missing fields",
+			payload: CreateUserPayload{},
+			want: utils.FieldErrors{"username": "is required", "password": "must be at least 8 characters"},
+		},
+		{
+			name: "username too short",
+			payload: CreateUserPayload{Username: "al", Password: "correct horse"},
+			want: utils.FieldErrors{"username": "must be between 3 and 32 characters"},
+		},
+		{
+			name: "username too long",
+			payload: CreateUserPayload{Username: strings.Repeat("a", 33), Password: "correct horse"},
+			want: utils.FieldErrors{"username": "must be between 3 and 32 characters"},
+		},
+		{
+			name: "username with invalid characters",
+			payload: CreateUserPayload{Username: "_alice bob", Password: "correct horse"},
+			want: utils.FieldErrors{"username": "may only contain letters, digits, '_', '.' and '-', and must start with a letter or digit"},
+		},
+		{
+			name: "password too long",
+			payload: CreateUserPayload{Username: "alice", Password: strings.Repeat("a", 73)},
+			want: utils.FieldErrors{"password": "must be at most 72 bytes"},
+		},
+		{
+			name: "breached password",
+			payload: CreateUserPayload{Username: "alice", Password: "Password123"},
+			want: utils.FieldErrors{"password": "is too common, choose another password"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fieldErrors(t, policy.validateCreateUserPayload(tt.payload))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateLoginPayload(t *testing.T) {
+	tests := []struct {
+		name	string
+		payload	LoginPayload
+		want	utils.FieldErrors
+	}{
+		{name: "valid", payload: LoginPayload{Username: "alice", Password: "x"}},
+		{
+			// Older accounts may predate the registration rules
+			name: "username longer than the registration limit",
+			payload: LoginPayload{Username: strings.Repeat("a", 64), Password: "correct horse"},
+		},
+		{
+			name: "missing fields",
+			payload: LoginPayload{},
+			want: utils.FieldErrors{"username": "is required", "password": "is required"},
+		},
+		{
+			name: "oversized fields",
+			payload: LoginPayload{Username: strings.Repeat("a", 257), Password: strings.Repeat("a", 73)},
+			want: utils.FieldErrors{"username": "must be at most 256 characters", "password": "must be at most 72 bytes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fieldErrors(t, validateLoginPayload(tt.payload))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateProfilePayload(t *testing.T) {
+	text := func(s string) *string { return &s }
+
+	tests := []struct {
+		name	string
+		payload	UpdateProfilePayload
+		want	utils.FieldErrors
+	}{
+		{name: "empty", payload: UpdateProfilePayload{}},
+		{name: "clear avatar", payload: UpdateProfilePayload{AvatarURL: text("")}},
+		{
+			name: "valid",
+			payload: UpdateProfilePayload{DisplayName: text("Alice"), AvatarURL: text("https://example.com/a.png"), Bio: text("hi")},
+		},
+		{
+			name: "too long",
+			payload: UpdateProfilePayload{DisplayName: text(strings.Repeat("é", 65)), Bio: text(strings.Repeat("a", 501))},
+			want: utils.FieldErrors{"display_name": "must be at most 64 characters", "bio": "must be at most 500 characters"},
+		},
+		{
+			name: "relative avatar url",
+			payload: UpdateProfilePayload{AvatarURL: text("/a.png")},
+			want: utils.FieldErrors{"avatar_url": "must be an absolute http or https URL"},
+		},
+		{
+			name: "non http avatar url",
+			payload: UpdateProfilePayload{AvatarURL: text("javascript:alert(1)")},
+			want: utils.FieldErrors{"avatar_url": "must be an absolute http or https URL"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fieldErrors(t, validateUpdateProfilePayload(tt.payload))
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -6,18 +6,35 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func ValidateTokenString(tokenString string) (*AuthorizedUserInfo, error) {
+// SignToken signs claims with the current key and stamps its id in the kid header.
+func (ks *KeySet) SignToken(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.current.method, claims)
+	token.Header["kid"] = ks.current.id
+
+	return token.SignedString(ks.current.signKey)
+}
+
+func (ks *KeySet) ValidateTokenString(tokenString string) (*AuthorizedUserInfo, error) {
 	claims := &AuthorizedUserInfo{}
 
 	token, err := jwt.ParseWithClaims(
 		tokenString,
 		claims,
 		func(t *jwt.Token) (any, error) {
+			// Tokens issued before kid headers existed belong to the current key
+			key := ks.current
+
+			if kid, ok := t.Header["kid"].(string); ok {
+				if key, ok = ks.keys[kid]; !ok {
+					return nil, errors.New("unknown signing key")
+				}
+			}
+
 			// check signing method
-			if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			if t.Method.Alg() != key.method.Alg() {
 				return nil, errors.New("unexpected signing method")
 			}
-			return []byte("secret"), nil
+			return key.verifyKey, nil
 		},
 	)
 
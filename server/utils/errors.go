@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Error kinds shared by every package. Handlers map them to HTTP statuses with
+// StatusCode, so services never need to know about HTTP.
+var (
+	ErrNotFound		= errors.New("not found")
+	ErrConflict		= errors.New("conflict")
+	ErrValidation	= errors.New("validation failed")
+	ErrUnauthorized	= errors.New("unauthorized")
+	ErrForbidden	= errors.New("forbidden")
+	ErrTooLarge		= errors.New("payload too large")
+	ErrTooManyRequests	= errors.New("too many requests")
+)
+
+// Error is a typed error with a stable, machine-readable code such as
+// "user_not_found". errors.Is matches it against its kind.
+type Error struct {
+	Kind	error
+	Code	string
+	Message	string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+// FieldErrors holds one validation message per invalid payload field.
+type FieldErrors map[string]string
+
+func (e FieldErrors) Error() string {
+	fields := make([]string, 0, len(e))
+
+	for field := range e {
+		fields = append(fields, field)
+	}
+
+	sort.Strings(fields)
+
+	for i, field := range fields {
+		fields[i] = field + ": " + e[field]
+	}
+
+	return "validation failed: " + strings.Join(fields, "; ")
+}
+
+func (e FieldErrors) Unwrap() error {
+	return ErrValidation
+}
+
+func NotFound(code string, message string) *Error {
+	return &Error{Kind: ErrNotFound, Code: code, Message: message}
+}
+
+func Conflict(code string, message string) *Error {
+	return &Error{Kind: ErrConflict, Code: code, Message: message}
+}
+
+func Validation(code string, message string) *Error {
+	return &Error{Kind: ErrValidation, Code: code, Message: message}
+}
+
+func Unauthorized(code string, message string) *Error {
+	return &Error{Kind: ErrUnauthorized, Code: code, Message: message}
+}
+
+func Forbidden(code string, message string) *Error {
+	return &Error{Kind: ErrForbidden, Code: code, Message: message}
+}
+
+func TooManyRequests(code string, message string) *Error {
+	return &Error{Kind: ErrTooManyRequests, Code: code, Message: message}
+}
+
+// StatusCode maps an error to its HTTP status, defaulting to 500.
+func StatusCode(err error) int {
+	switch {
+		case errors.Is(err, ErrNotFound):
+			return http.StatusNotFound
+		case errors.Is(err, ErrConflict):
+			return http.StatusConflict
+		case errors.Is(err, ErrValidation):
+			return http.StatusBadRequest
+		case errors.Is(err, ErrUnauthorized):
+			return http.StatusUnauthorized
+		case errors.Is(err, ErrForbidden):
+			return http.StatusForbidden
+		case errors.Is(err, ErrTooLarge):
+			return http.StatusRequestEntityTooLarge
+		case errors.Is(err, ErrTooManyRequests):
+			return http.StatusTooManyRequests
+		default:
+			return http.StatusInternalServerError
+	}
+}
+
+// ErrorCode returns the code of a typed error, or a generic one derived from
+// the response status.
+func ErrorCode(err error, statusCode int) string {
+	var appErr *Error
+
+	if errors.As(err, &appErr) {
+		return appErr.Code
+	}
+
+	var fieldErrs FieldErrors
+
+	if errors.As(err, &fieldErrs) {
+		return "validation_failed"
+	}
+
+	switch statusCode {
+		case http.StatusBadRequest:
+			return "bad_request"
+		case http.StatusUnauthorized:
+			return "unauthorized"
+		case http.StatusForbidden:
+			return "forbidden"
+		case http.StatusNotFound:
+			return "not_found"
+		case http.StatusConflict:
+			return "conflict"
+		case http.StatusTooManyRequests:
+			return "too_many_requests"
+		default:
+			return "internal_error"
+	}
+}
+
+// IsUniqueViolation reports whether a Postgres error is a unique constraint
+// violation, which is how concurrent duplicate inserts surface.
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
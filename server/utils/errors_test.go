@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestErrorStatusAndCode(t *testing.T) {
+	tests := []struct {
+		name		string
+		err			error
+		wantStatus	int
+		wantCode	string
+	}{
+		{name: "not found", err: NotFound("user_not_found", "user not found"), wantStatus: http.StatusNotFound, wantCode: "user_not_found"},
+		{name: "conflict", err: Conflict("username_exists", "username exists"), wantStatus: http.StatusConflict, wantCode: "username_exists"},
+		{name: "validation", err: Validation("invalid_role", "invalid role"), wantStatus: http.StatusBadRequest, wantCode: "invalid_role"},
+		{name: "unauthorized", err: Unauthorized("invalid_token", "invalid token"), wantStatus: http.StatusUnauthorized, wantCode: "invalid_token"},
+		{name: "forbidden", err: Forbidden("insufficient_role", "requires role admin"), wantStatus: http.StatusForbidden, wantCode: "insufficient_role"},
+		{name: "too many requests", err: TooManyRequests("login_locked", "locked"), wantStatus: http.StatusTooManyRequests, wantCode: "login_locked"},
+		{name: "wrapped typed error", err: fmt.Errorf("load user: %w", NotFound("user_not_found", "user not found")), wantStatus: http.StatusNotFound, wantCode: "user_not_found"},
+		{name: "field errors", err: FieldErrors{"username": "is required"}, wantStatus: http.StatusBadRequest, wantCode: "validation_failed"},
+		{name: "bare kind", err: fmt.Errorf("upload: %w", ErrTooLarge), wantStatus: http.StatusRequestEntityTooLarge, wantCode: "internal_error"},
+		{name: "untyped error", err: errors.New("connection reset"), wantStatus: http.StatusInternalServerError, wantCode: "internal_error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := StatusCode(tt.err)
+
+			if status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", status, tt.wantStatus)
+			}
+
+			if code := ErrorCode(tt.err, status); code != tt.wantCode {
+				t.Errorf("got code %q, want %q", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	tests := []struct {
+		name		string
+		status		int
+		err			error
+		wantCode	string
+		wantFields	map[string]string
+	}{
+		{name: "typed error", status: http.StatusNotFound, err: NotFound("user_not_found", "user not found"), wantCode: "user_not_found"},
+		{name: "status fallback", status: http.StatusBadRequest, err: errors.New("invalid json"), wantCode: "bad_request"},
+		{
+			name: "field errors",
+			status: http.StatusBadRequest,
+			err: fmt.Errorf("update profile: %w", FieldErrors{"bio": "too long", "display_name": "is required"}),
+			wantCode: "validation_failed",
+			wantFields: map[string]string{"bio": "too long", "display_name": "is required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ResponseError(rec, "Failed", tt.status, tt.err)
+
+			if rec.Code != tt.status {
+				t.Errorf("got status %d, want %d", rec.Code, tt.status)
+			}
+
+			var body struct {
+				Message	string				`json:"message"`
+				Code	string				`json:"code"`
+				Error	string				`json:"error"`
+				Fields	map[string]string	`json:"fields"`
+			}
+
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatalf("invalid body %s: %v", rec.Body, err)
+			}
+
+			if body.Message != "Failed" || body.Code != tt.wantCode || body.Error != tt.err.Error() {
+				t.Errorf("got body %+v, want code %q", body, tt.wantCode)
+			}
+
+			if !reflect.DeepEqual(body.Fields, tt.wantFields) {
+				t.Errorf("got fields %v, want %v", body.Fields, tt.wantFields)
+			}
+		})
+	}
+}
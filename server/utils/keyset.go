@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/configs"
+)
+
+type signingKey struct {
+	id			string
+	method		jwt.SigningMethod
+
+	// signKey is nil for keys that are only kept to verify older tokens
+	signKey		any
+	verifyKey	any
+}
+
+// KeySet signs tokens with the current key and verifies them against every
+// known key, so tokens issued before a rotation stay valid until they expire.
+type KeySet struct {
+	current	*signingKey
+	keys	map[string]*signingKey
+}
+
+type JWK struct {
+	Kty	string	`json:"kty"`
+	Kid	string	`json:"kid"`
+	Use	string	`json:"use"`
+	Alg	string	`json:"alg"`
+	N	string	`json:"n,omitempty"`
+	E	string	`json:"e,omitempty"`
+	Crv	string	`json:"crv,omitempty"`
+	X	string	`json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys	[]JWK	`json:"keys"`
+}
+
+func NewKeySet(localEnv *configs.LocalEnv) (*KeySet, error) {
+	current, err := loadSigningKey(localEnv)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{
+		current: current,
+		keys: map[string]*signingKey{current.id: current},
+	}
+
+	for _, entry := range strings.Split(localEnv.JWTPreviousKeys, ",") {
+		entry = strings.TrimSpace(entry)
+
+		if entry == "" {
+			continue
+		}
+
+		kid, path, ok := strings.Cut(entry, "=")
+
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid JWT_PREVIOUS_KEYS entry %q", entry)
+		}
+
+		if _, exists := ks.keys[kid]; exists {
+			return nil, fmt.Errorf("duplicate jwt key id %q", kid)
+		}
+
+		key, err := loadVerificationKey(kid, path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ks.keys[kid] = key
+	}
+
+	return ks, nil
+}
+
+func loadSigningKey(localEnv *configs.LocalEnv) (*signingKey, error) {
+	key := &signingKey{id: localEnv.JWTKeyID}
+
+	switch localEnv.JWTAlgorithm {
+		case "HS256":
+			if localEnv.JWTSecret == "" {
+				return nil, errors.New("jwt secret is empty")
+			}
+
+			key.method = jwt.SigningMethodHS256
+			key.signKey = []byte(localEnv.JWTSecret)
+			key.verifyKey = key.signKey
+
+		case "RS256":
+			pemBytes, err := os.ReadFile(localEnv.JWTPrivateKeyFile)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to read jwt private key: %w", err)
+			}
+
+			privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse rsa private key: %w", err)
+			}
+
+			key.method = jwt.SigningMethodRS256
+			key.signKey = privateKey
+			key.verifyKey = &privateKey.PublicKey
+
+		case "EdDSA":
+			pemBytes, err := os.ReadFile(localEnv.JWTPrivateKeyFile)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to read jwt private key: %w", err)
+			}
+
+			privateKey, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse ed25519 private key: %w", err)
+			}
+
+			key.method = jwt.SigningMethodEdDSA
+			key.signKey = privateKey
+			key.verifyKey = privateKey.(crypto.Signer).Public()
+
+		default:
+			return nil, fmt.Errorf("unsupported jwt algorithm %q", localEnv.JWTAlgorithm)
+	}
+
+	return key, nil
+}
+
+// hmacKeyPrefix marks a JWT_PREVIOUS_KEYS path as a raw HMAC secret.
+const hmacKeyPrefix = "hs256:"
+
+// loadVerificationKey reads a retired key. path is an RSA or Ed25519 PEM key,
+// public or private, so the old JWT_PRIVATE_KEY_FILE can be moved over as is.
+// Raw HMAC secrets must be marked with hmacKeyPrefix; key material is never
+// guessed to be a secret, which would let public keys sign HS256 tokens.
+func loadVerificationKey(kid string, path string) (*signingKey, error) {
+	secretPath, isSecret := strings.CutPrefix(path, hmacKeyPrefix)
+
+	if isSecret {
+		path = secretPath
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwt key %q: %w", kid, err)
+	}
+
+	if isSecret {
+		secret := []byte(strings.TrimSpace(string(data)))
+
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("jwt key %q is empty", kid)
+		}
+
+		if block, _ := pem.Decode(data); block != nil {
+			return nil, fmt.Errorf("jwt key %q is a PEM key, not an hmac secret", kid)
+		}
+
+		return &signingKey{id: kid, method: jwt.SigningMethodHS256, verifyKey: secret}, nil
+	}
+
+	if block, _ := pem.Decode(data); block == nil {
+		return nil, fmt.Errorf("jwt key %q is not a PEM key; use %s=%s%s for an hmac secret", kid, kid, hmacKeyPrefix, path)
+	}
+
+	if rsaKey, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: kid, method: jwt.SigningMethodRS256, verifyKey: rsaKey}, nil
+	}
+
+	if edKey, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: kid, method: jwt.SigningMethodEdDSA, verifyKey: edKey}, nil
+	}
+
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{id: kid, method: jwt.SigningMethodRS256, verifyKey: &rsaKey.PublicKey}, nil
+	}
+
+	if edKey, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{id: kid, method: jwt.SigningMethodEdDSA, verifyKey: edKey.(crypto.Signer).Public()}, nil
+	}
+
+	return nil, fmt.Errorf("jwt key %q is not a supported RSA or Ed25519 key", kid)
+}
+
+// JWKS lists the public keys other services can verify our tokens with.
+// HMAC secrets are never published.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, key := range ks.keys {
+		switch verifyKey := key.verifyKey.(type) {
+			case *rsa.PublicKey:
+				jwks.Keys = append(jwks.Keys, JWK{
+					Kty: "RSA",
+					Kid: key.id,
+					Use: "sig",
+					Alg: key.method.Alg(),
+					N: base64.RawURLEncoding.EncodeToString(verifyKey.N.Bytes()),
+					E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(verifyKey.E)).Bytes()),
+				})
+
+			case ed25519.PublicKey:
+				jwks.Keys = append(jwks.Keys, JWK{
+					Kty: "OKP",
+					Kid: key.id,
+					Use: "sig",
+					Alg: key.method.Alg(),
+					Crv: "Ed25519",
+					X: base64.RawURLEncoding.EncodeToString(verifyKey),
+				})
+		}
+	}
+
+	return jwks
+}
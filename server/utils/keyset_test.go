@@ -0,0 +1,315 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/nambuitechx/nam-chilling-room-server/configs"
+)
+
+// testKeys holds PEM files for one RSA and one Ed25519 key pair plus an HMAC secret.
+type testKeys struct {
+	rsaPrivate	string
+	rsaPublic	string
+	edPrivate	string
+	edPublic	string
+	secret		string
+}
+
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+
+	return path
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatalf("failed to generate ed25519 key: %v", err)
+	}
+
+	der := func(key any, public bool) []byte {
+		var b []byte
+
+		if public {
+			b, err = x509.MarshalPKIXPublicKey(key)
+		} else {
+			b, err = x509.MarshalPKCS8PrivateKey(key)
+		}
+
+		if err != nil {
+			t.Fatalf("failed to marshal key: %v", err)
+		}
+
+		return b
+	}
+
+	secret := filepath.Join(dir, "secret")
+
+	if err := os.WriteFile(secret, []byte("old secret\n"), 0600); err != nil {
+		t.Fatalf("failed to write secret: %v", err)
+	}
+
+	return testKeys{
+		rsaPrivate: writePEM(t, dir, "rsa.pem", "PRIVATE KEY", der(rsaKey, false)),
+		rsaPublic: writePEM(t, dir, "rsa.pub", "PUBLIC KEY", der(&rsaKey.PublicKey, true)),
+		edPrivate: writePEM(t, dir, "ed.pem", "PRIVATE KEY", der(edPrivate, false)),
+		edPublic: writePEM(t, dir, "ed.pub", "PUBLIC KEY", der(edPublic, true)),
+		secret: secret,
+	}
+}
+
+func testClaims() *AuthorizedUserInfo {
+	return &AuthorizedUserInfo{
+		ID: "user-1",
+		Username: "alice",
+		SessionID: "session-1",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+}
+
+func mustKeySet(t *testing.T, env *configs.LocalEnv) *KeySet {
+	t.Helper()
+
+	ks, err := NewKeySet(env)
+
+	if err != nil {
+		t.Fatalf("failed to create key set: %v", err)
+	}
+
+	return ks
+}
+
+func TestKeySetSignsAndValidates(t *testing.T) {
+	keys := newTestKeys(t)
+
+	tests := []struct {
+		name	string
+		env		configs.LocalEnv
+		wantAlg	string
+	}{
+		{name: "hs256", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret"}, wantAlg: "HS256"},
+		{name: "rs256", env: configs.LocalEnv{JWTAlgorithm: "RS256", JWTKeyID: "rs", JWTPrivateKeyFile: keys.rsaPrivate}, wantAlg: "RS256"},
+		{name: "eddsa", env: configs.LocalEnv{JWTAlgorithm: "EdDSA", JWTKeyID: "ed", JWTPrivateKeyFile: keys.edPrivate}, wantAlg: "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ks := mustKeySet(t, &tt.env)
+
+			token, err := ks.SignToken(testClaims())
+
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &AuthorizedUserInfo{})
+
+			if err != nil {
+				t.Fatalf("failed to parse header: %v", err)
+			}
+
+			if parsed.Header["kid"] != tt.env.JWTKeyID || parsed.Header["alg"] != tt.wantAlg {
+				t.Errorf("got header %v, want kid %q and alg %q", parsed.Header, tt.env.JWTKeyID, tt.wantAlg)
+			}
+
+			claims, err := ks.ValidateTokenString(token)
+
+			if err != nil {
+				t.Fatalf("failed to validate: %v", err)
+			}
+
+			if claims.ID != "user-1" || claims.SessionID != "session-1" {
+				t.Errorf("got claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	keys := newTestKeys(t)
+
+	current := configs.LocalEnv{
+		JWTAlgorithm: "EdDSA",
+		JWTKeyID: "2026-02",
+		JWTPrivateKeyFile: keys.edPrivate,
+		JWTPreviousKeys: "2026-01=" + keys.rsaPublic + ", legacy=" + hmacKeyPrefix + keys.secret,
+	}
+
+	// sign returns a token from an issuer configured with env
+	sign := func(env configs.LocalEnv) func(t *testing.T) string {
+		return func(t *testing.T) string {
+			token, err := mustKeySet(t, &env).SignToken(testClaims())
+
+			if err != nil {
+				t.Fatalf("failed to sign: %v", err)
+			}
+
+			return token
+		}
+	}
+
+	tests := []struct {
+		name	string
+		token	func(t *testing.T) string
+		wantErr	bool
+	}{
+		{name: "current key", token: sign(current)},
+		{name: "retired rsa key", token: sign(configs.LocalEnv{JWTAlgorithm: "RS256", JWTKeyID: "2026-01", JWTPrivateKeyFile: keys.rsaPrivate})},
+		{name: "retired hmac secret", token: sign(configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "legacy", JWTSecret: "old secret"})},
+		{
+			name: "token without kid belongs to the current key",
+			token: func(t *testing.T) string {
+				token, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, testClaims()).SignedString(mustKeySet(t, &current).current.signKey)
+
+				if err != nil {
+					t.Fatalf("failed to sign: %v", err)
+				}
+
+				return token
+			},
+		},
+		{name: "unknown kid", token: sign(configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "2025-12", JWTSecret: "old secret"}), wantErr: true},
+		{name: "wrong secret for a known kid", token: sign(configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "legacy", JWTSecret: "guessed"}), wantErr: true},
+		{
+			name: "hs256 signed with a published rsa key",
+			token: func(t *testing.T) string {
+				public, _ := os.ReadFile(keys.rsaPublic)
+				token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+				token.Header["kid"] = "2026-01"
+
+				signed, err := token.SignedString(public)
+
+				if err != nil {
+					t.Fatalf("failed to sign: %v", err)
+				}
+
+				return signed
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := mustKeySet(t, &current).ValidateTokenString(tt.token(t))
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewKeySetRejectsBadConfig(t *testing.T) {
+	keys := newTestKeys(t)
+
+	tests := []struct {
+		name	string
+		env		configs.LocalEnv
+	}{
+		{name: "empty secret", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs"}},
+		{name: "unsupported algorithm", env: configs.LocalEnv{JWTAlgorithm: "none", JWTKeyID: "x", JWTSecret: "secret"}},
+		{name: "missing private key", env: configs.LocalEnv{JWTAlgorithm: "RS256", JWTKeyID: "rs", JWTPrivateKeyFile: filepath.Join(t.TempDir(), "missing.pem")}},
+		{name: "wrong key type", env: configs.LocalEnv{JWTAlgorithm: "RS256", JWTKeyID: "rs", JWTPrivateKeyFile: keys.edPrivate}},
+		{name: "malformed previous key", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret", JWTPreviousKeys: keys.rsaPublic}},
+		{name: "duplicate kid", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret", JWTPreviousKeys: "hs=" + keys.rsaPublic}},
+		{name: "unmarked hmac secret", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret", JWTPreviousKeys: "old=" + keys.secret}},
+		{name: "pem key marked as a secret", env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret", JWTPreviousKeys: "old=" + hmacKeyPrefix + keys.rsaPublic}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewKeySet(&tt.env); err == nil {
+				t.Errorf("got no error")
+			}
+		})
+	}
+}
+
+func TestJWKSPublishesOnlyPublicKeys(t *testing.T) {
+	keys := newTestKeys(t)
+
+	tests := []struct {
+		name		string
+		env			configs.LocalEnv
+		wantKids	[]string
+	}{
+		{
+			name: "hmac only",
+			env: configs.LocalEnv{JWTAlgorithm: "HS256", JWTKeyID: "hs", JWTSecret: "secret"},
+			wantKids: []string{},
+		},
+		{
+			name: "asymmetric current with retired keys",
+			env: configs.LocalEnv{
+				JWTAlgorithm: "EdDSA",
+				JWTKeyID: "ed",
+				JWTPrivateKeyFile: keys.edPrivate,
+				JWTPreviousKeys: "rs=" + keys.rsaPrivate + ",ed-old=" + keys.edPublic + ",hs=" + hmacKeyPrefix + keys.secret,
+			},
+			wantKids: []string{"ed", "ed-old", "rs"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jwks := mustKeySet(t, &tt.env).JWKS()
+			kids := []string{}
+
+			for _, key := range jwks.Keys {
+				kids = append(kids, key.Kid)
+
+				switch key.Kty {
+					case "RSA":
+						if key.Alg != "RS256" || key.N == "" || key.E == "" {
+							t.Errorf("incomplete rsa key %+v", key)
+						}
+
+					case "OKP":
+						if key.Alg != "EdDSA" || key.Crv != "Ed25519" || key.X == "" {
+							t.Errorf("incomplete ed25519 key %+v", key)
+						}
+
+					default:
+						t.Errorf("unexpected key type %q", key.Kty)
+				}
+			}
+
+			sort.Strings(kids)
+
+			if !reflect.DeepEqual(kids, tt.wantKids) {
+				t.Errorf("got kids %v, want %v", kids, tt.wantKids)
+			}
+		})
+	}
+}
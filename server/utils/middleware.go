@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type contextKey string
+
+const authorizedUserKey contextKey = "authorizedUser"
+
+// SessionChecker reports whether the session behind an access token was
+// revoked by logout, a role change or account deletion. Authenticate asks on
+// every request, so implementations should answer from memory when they can.
+type SessionChecker interface {
+	IsSessionRevoked(sessionID string) (bool, error)
+}
+
+// Authenticate rejects requests without a valid bearer token, or whose session
+// was revoked, and stores the token's AuthorizedUserInfo in the request
+// context.
+func Authenticate(keySet *KeySet, sessions SessionChecker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			tokenString := BearerToken(r)
+
+			if tokenString == "" {
+				ResponseError(w, "Unauthorized", 401, Unauthorized("missing_token", "missing bearer token"))
+				return
+			}
+
+			claims, err := keySet.ValidateTokenString(tokenString)
+
+			if err != nil {
+				ResponseError(w, "Unauthorized", 401, Unauthorized("invalid_token", err.Error()))
+				return
+			}
+
+			revoked, err := sessions.IsSessionRevoked(claims.SessionID)
+
+			if err != nil {
+				ResponseError(w, "Failed to check session", StatusCode(err), err)
+				return
+			}
+
+			if revoked {
+				ResponseError(w, "Unauthorized", 401, Unauthorized("session_revoked", "session revoked"))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), authorizedUserKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// GetAuthorizedUser returns the user stored by Authenticate.
+func GetAuthorizedUser(ctx context.Context) (*AuthorizedUserInfo, bool) {
+	claims, ok := ctx.Value(authorizedUserKey).(*AuthorizedUserInfo)
+	return claims, ok
+}
+
+// BearerToken returns the token of an "Authorization: Bearer <token>" header,
+// or an empty string.
+func BearerToken(r *http.Request) string {
+	scheme, tokenString, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(tokenString)
+}
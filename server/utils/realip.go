@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// RealIP replaces RemoteAddr with the client address from X-Forwarded-For or
+// X-Real-IP, but only when the request comes straight from a trusted proxy.
+// Anyone else could put any address in those headers, which would let them
+// dodge per-IP limits, so their requests keep the socket peer address.
+func RealIP(trustedProxies []netip.Prefix) func(http.Handler) http.Handler {
+	trusted := func(addr netip.Addr) bool {
+		for _, prefix := range trustedProxies {
+			if prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if peer, ok := remoteAddr(r.RemoteAddr); ok && trusted(peer) {
+				if ip, ok := forwardedIP(r, trusted); ok {
+					r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedIP walks X-Forwarded-For from the right, skipping our own proxies,
+// since every hop appends the address it received the request from and only
+// the entries added by trusted proxies can be believed.
+func forwardedIP(r *http.Request, trusted func(netip.Addr) bool) (netip.Addr, bool) {
+	if header := r.Header.Values("X-Forwarded-For"); len(header) > 0 {
+		hops := strings.Split(strings.Join(header, ","), ",")
+		var client netip.Addr
+
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+
+			if err != nil {
+				break
+			}
+
+			client = addr.Unmap()
+
+			if !trusted(client) {
+				break
+			}
+		}
+
+		return client, client.IsValid()
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+func remoteAddr(address string) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		host = address
+	}
+
+	addr, err := netip.ParseAddr(host)
+
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
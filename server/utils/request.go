@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// MaxBodyBytes caps every JSON request body.
+const MaxBodyBytes = 1 << 20
+
+// DecodeJSON decodes the request body into dst, refusing bodies larger than
+// MaxBodyBytes.
+func DecodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBodyBytes)
+
+	if err := json.NewDecoder(r.Body).Decode(dst); err != nil {
+		var maxBytesErr *http.MaxBytesError
+
+		if errors.As(err, &maxBytesErr) {
+			return &Error{Kind: ErrTooLarge, Code: "payload_too_large", Message: "request body too large"}
+		}
+		return &Error{Kind: ErrValidation, Code: "invalid_json", Message: err.Error()}
+	}
+
+	return nil
+}
+
+func GetQueryInt(r *http.Request, key string, defaultValue int) (int, error) {
+    valStr := r.URL.Query().Get(key)
+
+    if valStr == "" {
+        return defaultValue, nil
+    }
+
+    return strconv.Atoi(valStr)
+}
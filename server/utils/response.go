@@ -2,6 +2,7 @@ package utils
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 )
 
@@ -11,9 +12,16 @@ func ResponseError(w http.ResponseWriter, message string, statusCode int, err er
 
 	payload := map[string]any {
 		"message": message,
+		"code": ErrorCode(err, statusCode),
 		"error": err.Error(),
 	}
 
+	var fieldErrs FieldErrors
+
+	if errors.As(err, &fieldErrs) {
+		payload["fields"] = fieldErrs
+	}
+
 	if err := json.NewEncoder(w).Encode(payload); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"net/http"
+)
+
+// Roles are ordered: every role is granted the permissions of the ones below it.
+const (
+	RoleUser		= "user"
+	RoleModerator	= "moderator"
+	RoleAdmin		= "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser: 1,
+	RoleModerator: 2,
+	RoleAdmin: 3,
+}
+
+func IsValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// HasRole reports whether role grants at least the required role.
+func HasRole(role string, required string) bool {
+	return roleRanks[role] >= roleRanks[required]
+}
+
+// RequireRole only lets through users holding at least the given role. It must
+// run after Authenticate.
+func RequireRole(required string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetAuthorizedUser(r.Context())
+
+			if !ok {
+				ResponseError(w, "Unauthorized", 401, Unauthorized("missing_token", "missing bearer token"))
+				return
+			}
+
+			if !HasRole(claims.Role, required) {
+				ResponseError(w, "Forbidden", 403, Forbidden("insufficient_role", "requires role " + required))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -5,5 +5,7 @@ import "github.com/golang-jwt/jwt/v5"
 type AuthorizedUserInfo struct {
 	ID			string		`json:"id"`
 	Username	string		`json:"username"`
+	SessionID	string		`json:"sid,omitempty"`
+	Role		string		`json:"role,omitempty"`
 	jwt.RegisteredClaims
 }